@@ -9,7 +9,6 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -40,18 +39,18 @@ func (d *Date) String() string {
 
 // Set implement for flag
 func (d *Date) Set(s string) error {
-	i, err := strconv.ParseInt(s, 10, 64)
+	ns, err := connection.ParseTimestamp(s)
 	if err == nil {
-		*d = Date(time.Unix(i, 0))
+		*d = Date(time.Unix(0, ns))
 		return nil
 	}
-	t, err := time.Parse(time.RFC3339, s)
+	t, err := time.Parse(time.RFC3339Nano, s)
 	if err == nil {
 		*d = Date(t)
 		return nil
 	}
 
-	return fmt.Errorf("must be RFC3339 %s or timestamp", time.RFC3339)
+	return fmt.Errorf("must be RFC3339 %s or timestamp (with optional fraction)", time.RFC3339Nano)
 }
 
 var version string
@@ -67,9 +66,17 @@ func main() {
 
 		appName       string
 		target        string
+		key           string
+		retain        bool
+		ttl           time.Duration
+		fireDelay     time.Duration
+		fireAt        Date
 		listenAddr    string
 		listenEvents  = channels{}
 		launcherEvent string
+		kickTarget    string
+		queryNames    string
+		queryLimit    int
 		recoverSince  = Date(time.Unix(0, 0))
 		recoverUntil  = Date(time.Unix(0, 0))
 		interactive   bool
@@ -85,12 +92,20 @@ func main() {
 	cli.BoolVar(&showInfo, "i", false, "show server info")
 	cli.BoolVar(&interactive, "I", false, "interactive mode")
 	cli.StringVar(&appName, "app", "", "app name")
-	cli.StringVar(&target, "to", "", "fire to specify app")
-	cli.StringVar(&listenAddr, "server", "127.0.0.1:6300", "listen event address")
+	cli.StringVar(&target, "to", "", "fire to specify app, comma list or pattern (e.g. app1,worker-*)")
+	cli.StringVar(&key, "key", "", "fire with compaction key")
+	cli.BoolVar(&retain, "retain", false, "fire as retained event")
+	cli.DurationVar(&ttl, "ttl", 0, "fire with time-to-live")
+	cli.DurationVar(&fireDelay, "delay", 0, "server delivers the fired event after duration")
+	cli.Var(&fireAt, "at", "server delivers the fired event at time, use RFC3339 or timestamp")
+	cli.StringVar(&listenAddr, "server", "127.0.0.1:6300", "listen event address, 多個位址以逗號分隔或 srv://{name}")
 	cli.StringVar(&launcherEvent, "fire", "", "fire event {name}:{data}")
 	cli.Var(&listenEvents, "event", "listen events")
-	cli.Var(&recoverSince, "since", fmt.Sprintf("request recover since, use RFC3339 %s or timestamp", time.RFC3339))
-	cli.Var(&recoverUntil, "until", fmt.Sprintf("request recover until, use RFC3339 %s or timestamp", time.RFC3339))
+	cli.StringVar(&queryNames, "query", "", "query history events by name pattern, comma list (e.g. job.*,user.login), use with -since -until -limit")
+	cli.IntVar(&queryLimit, "limit", 100, "max events of -query, 0 for all")
+	cli.StringVar(&kickTarget, "kick", "", "disconnect app, pattern or #{conn id} (-app must be in server ADMIN)")
+	cli.Var(&recoverSince, "since", fmt.Sprintf("request recover since, use RFC3339 %s or timestamp (e.g. 1484027821.123)", time.RFC3339Nano))
+	cli.Var(&recoverUntil, "until", fmt.Sprintf("request recover until, use RFC3339 %s or timestamp (e.g. 1484027821.123)", time.RFC3339Nano))
 	cli.Parse(os.Args[1:])
 
 	if verbose {
@@ -101,17 +116,32 @@ func main() {
 		os.Exit(0)
 	}
 
+	if queryNames != "" {
+		q := connection.Query{
+			Names: connection.ParseTargets(queryNames),
+			Since: time.Time(recoverSince).UnixNano(),
+			Until: time.Time(recoverUntil).UnixNano(),
+		}
+		if err := query(appName, listenAddr, q, queryLimit); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if kickTarget != "" {
+		if err := kick(appName, listenAddr, kickTarget); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var (
 		la launcher.Launcher
-		li = listener.New(func() (client.Conn, error) {
-			return client.Dial(appName, listenAddr)
-		})
+		li = listener.NewContext(client.NewDialer(appName, listenAddr).DialContext)
 	)
 
 	if launcherEvent != "" || interactive {
-		la = launcher.New(client.NewPool(func() (client.Conn, error) {
-			return client.Dial("", listenAddr)
-		}, 30))
+		la = launcher.New(client.NewPool(client.NewDialer("", listenAddr).Dial, 30))
 	}
 
 	if interactive {
@@ -171,14 +201,25 @@ func main() {
 
 	// launcher
 	if ev := strings.SplitN(launcherEvent, ":", 2); len(ev) == 2 {
-		var err error
+		e := &client.Event{
+			Target: target,
+			Name:   event.Event(ev[0]),
+			Data:   event.RawData(ev[1]),
+			Key:    key,
+			Retain: retain,
+			TTL:    ttl,
+			At:     time.Time(fireAt),
+			Delay:  fireDelay,
+		}
 		if target == "" {
-			err = la.Fire(event.Event(ev[0]), event.RawData(ev[1]))
+			err := la.FireEvent(e)
+			if verbose {
+				log.Printf("fire: %v error(%v)\n", ev, err)
+			}
 		} else {
-			err = la.FireTo(target, event.Event(ev[0]), event.RawData(ev[1]))
-		}
-		if verbose {
-			log.Printf("fire: %v error(%v)\n", ev, err)
+			// 指定傳送時顯示 server 回傳結果
+			r, err := la.FireEventWait(e)
+			fmt.Printf("fire to %s: %s %v\n", target, r, err)
 		}
 		defer la.Close()
 	}
@@ -226,8 +267,8 @@ func main() {
 
 	li.On(event.Ready, func(ev event.Event, _ event.RawData) {
 		// Recover
-		since := time.Time(recoverSince).Unix()
-		until := time.Time(recoverUntil).Unix()
+		since := time.Time(recoverSince).UnixNano()
+		until := time.Time(recoverUntil).UnixNano()
 		log.Printf("recover since=%d until=%d\n", since, until)
 		li.Recover(since, until)
 	}).On(event.Connecting, func(ev event.Event, _ event.RawData) {
@@ -240,12 +281,75 @@ func main() {
 		if showInfo {
 			li.Info()
 		}
+	}).On(event.RecoverEnd, func(ev event.Event, v event.RawData) {
+		// 重送完畢
+		log.Printf("%s: %s\n", ev, v)
 	}).On(event.Disconnected, func(ev event.Event, v event.RawData) {
 		// Disconnected
 		log.Printf("%s: %s\n", ev, v)
 	}).RunForever(quit, time.Second*3, listenEvents...)
 }
 
+// query 逐頁查詢並印出, limit 為 0 時全部印出
+func query(appName, addr string, q connection.Query, limit int) error {
+	conn, err := client.NewDialer(appName, addr).Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Auth(0); err != nil {
+		return err
+	}
+	for {
+		q.Limit = 0
+		if limit > 0 {
+			q.Limit = limit
+		}
+		ret, err := conn.Query(q)
+		if err != nil {
+			return err
+		}
+		for _, r := range ret.Rows {
+			printLine(r.Name, r.Data)
+		}
+		if limit > 0 {
+			if limit -= ret.Count; limit <= 0 {
+				return nil
+			}
+		}
+		if ret.Next.IsZero() {
+			return nil
+		}
+		q.After = ret.Next
+	}
+}
+
+func kick(appName, addr, target string) error {
+	conn, err := client.NewDialer(appName, addr).Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Auth(connection.Writable); err != nil {
+		return err
+	}
+	if err := conn.Kick(target); err != nil {
+		return err
+	}
+	for {
+		v, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		if r, ok := v.(*client.Reply); ok && r.Match("kick", target) {
+			fmt.Println(r)
+			return nil
+		}
+	}
+}
+
 func buildHandler(cmdName string, cmdArgs []string) event.Handler {
 	return func(ev event.Event, rd event.RawData) {
 		cmd := exec.Command(cmdName, append(cmdArgs, string(ev), string(rd))...)
@@ -2,11 +2,14 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
@@ -27,23 +30,158 @@ func (i Flag) String() string {
 	} else {
 		w = "-"
 	}
+	if i&connection.Meta == connection.Meta {
+		return fmt.Sprintf("%s%sm", r, w)
+	}
 	return fmt.Sprintf("%s%s", r, w)
 }
 
-// Reply 包裝回應內容
+// Response Receive 回傳的 server 回應
+// *Reply / *Receipt / *Row / *Result / *Event / *Tagged / *Unknown
+type Response interface {
+	// 回應的協議前綴, ex: connection.CReply
+	Kind() byte
+}
+
+// Reply 包裝回應內容, ex: subscribe a.* OK
 type Reply struct {
 	s string
 }
 
+// NewReply 建立回應, 包裝或模擬 Conn 時使用
+func NewReply(s string) *Reply {
+	return &Reply{s}
+}
+
 func (r *Reply) String() string {
 	return r.s
 }
 
+// Kind 同 connection.CReply
+func (r *Reply) Kind() byte {
+	return connection.CReply
+}
+
+// Command 回應的指令名稱, ex: subscribe
+func (r *Reply) Command() string {
+	if fields := strings.Fields(r.s); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// Args 指令名稱之後的欄位, ex: [a.* OK]
+func (r *Reply) Args() []string {
+	if fields := strings.Fields(r.s); len(fields) > 1 {
+		return fields[1:]
+	}
+	return nil
+}
+
+// Match 是否為 command 對 arg 的回應, ex: Match("subscribe", "a.*")
+func (r *Reply) Match(command, arg string) bool {
+	args := r.Args()
+	return r.Command() == command && len(args) > 0 && args[0] == arg
+}
+
+// Tagged 帶編號請求的回應, Response 可能是 *connection.Error
+type Tagged struct {
+	Tag      int64
+	Response Response
+}
+
+// Kind 同 connection.CTag
+func (t *Tagged) Kind() byte {
+	return connection.CTag
+}
+
+// Unknown 無法辨識的回應 (ex: 新版 server 的指令)
+type Unknown struct {
+	Line []byte
+}
+
+// Kind 回應的前綴
+func (u *Unknown) Kind() byte {
+	if len(u.Line) == 0 {
+		return 0
+	}
+	return u.Line[0]
+}
+
+// Receipt 指定傳送結果
+type Receipt struct {
+	ID int64
+	// 收到 (含存入收件匣) 的 app 數量
+	Count  int
+	Status string
+}
+
+// Err 目標收到或已存入收件匣時為 nil
+func (r *Receipt) Err() error {
+	switch r.Status {
+	case connection.ReceiptDelivered, connection.ReceiptQueued:
+		return nil
+	}
+	return errors.New(r.Status)
+}
+
+func (r *Receipt) String() string {
+	return fmt.Sprintf("%s(%d)", r.Status, r.Count)
+}
+
+// Kind 同 connection.CReceipt
+func (r *Receipt) Kind() byte {
+	return connection.CReceipt
+}
+
+// Row 查詢結果的一筆事件
+type Row struct {
+	QueryID  int64
+	Name     event.Event
+	Data     event.RawData
+	Position connection.Position
+}
+
+// Kind 同 connection.CRow
+func (r *Row) Kind() byte {
+	return connection.CRow
+}
+
+// Result 查詢結果
+type Result struct {
+	ID    int64
+	Count int
+	Rows  []*Row
+	// 還有下一頁時不為零值, 放進 Query.After 接續查詢
+	Next connection.Position
+}
+
+// Kind 同 connection.CQueryEnd
+func (r *Result) Kind() byte {
+	return connection.CQueryEnd
+}
+
 // Event 包裝事件名稱跟資料
 type Event struct {
 	Target string // 定傳送目標
 	Name   event.Event
 	Data   event.RawData
+	Key    string        // 壓縮識別鍵, server 依 key 只保留最新一筆
+	Retain bool          // server 保留此事件名稱最後一筆, 新訂閱者會先收到
+	TTL    time.Duration // 存活時間, 過期後 server 不再重送
+	At     time.Time     // 指定 server 送出時間
+	Delay  time.Duration // server 收到後延遲送出
+	// 以下只在登入時帶 connection.Meta 收到的事件才有
+	ReceivedAt time.Time // server 收到的時間
+	ExpiresAt  time.Time // 過期時間
+}
+
+// Kind 同 connection.CEvent, pong 為 connection.CPong
+func (e *Event) Kind() byte {
+	if e.Name == event.PONG {
+		return connection.CPong
+	}
+	return connection.CEvent
 }
 
 // Conn 包裝 net.Conn
@@ -52,12 +190,21 @@ type Conn interface {
 	Recover(int64, int64) error
 	Auth(int) error
 	Subscribe(...string) error
+	SubscribeContext(context.Context, ...string) error
 	Unsubscribe(...string) error
 	Fire(event.Event, event.RawData) error
 	FireTo(string, event.Event, event.RawData) error
+	FireEvent(*Event) error
+	FireEventContext(context.Context, *Event) error
+	FireEventWait(*Event) (*Receipt, error)
+	Query(connection.Query) (*Result, error)
 	Ping(string) error
 	Info() error
-	Receive() (interface{}, error)
+	InfoWait() (*connection.Info, error)
+	Kick(string) error
+	Do(int64, byte, string) error
+	Receive() (Response, error)
+	ReceiveContext(context.Context) (Response, error)
 	Conn() net.Conn
 	Err() error
 }
@@ -69,12 +216,27 @@ type conn struct {
 	w    *bufio.Writer
 	r    *bufio.Reader
 	err  error
+	// 最後配發的 receipt 編號
+	receipt int64
+	// 最後配發的查詢編號
+	query int64
+	// 最後配發的請求編號 (InfoWait)
+	tag int64
 }
 
+// 讓阻塞中的讀寫立即逾時
+var aLongTimeAgo = time.Unix(1, 0)
+
 // Dial 回傳 conn 實體物件
 func Dial(name, addr string) (Conn, error) {
+	return DialContext(context.Background(), name, addr)
+}
+
+// DialContext 同 Dial, ctx 結束或逾時時中斷連線
+func DialContext(ctx context.Context, name, addr string) (Conn, error) {
 
-	c, err := net.Dial("tcp", addr)
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +258,9 @@ func (c *conn) Close() error {
 	return c.conn.Close()
 }
 
-func (c *conn) Receive() (ret interface{}, err error) {
+// Receive 讀取一個回應, server 錯誤回傳 *connection.Error, 其他錯誤為連線錯誤
+// 帶編號請求 (Do) 的回應以 *Tagged 回傳, 包含錯誤
+func (c *conn) Receive() (ret Response, err error) {
 
 	line, err := connection.ReadLine(c.r)
 	// TODO 隔離測試時 conn 是 nil
@@ -105,17 +269,71 @@ func (c *conn) Receive() (ret interface{}, err error) {
 	}
 	// log.Printf("<- client [%s]: %v = [%s] %v\n", c.name, line, line, err)
 
+	if line[0] != connection.CTag {
+		return c.parse(line)
+	}
+
+	tag, line, err := connection.ParseTag(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	ret, err = c.parse(line)
+	if e, ok := err.(*connection.Error); ok {
+		return &Tagged{Tag: tag, Response: e}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Tagged{Tag: tag, Response: ret}, nil
+}
+
+func (c *conn) parse(line []byte) (ret Response, err error) {
+
 	switch line[0] {
 	case connection.CReply:
 		ret = &Reply{strings.TrimSpace(string(line[1:]))}
 
+	case connection.CReceipt:
+		id, n, status, e := connection.ParseReceipt(line[1:])
+		if e != nil {
+			err = e
+			return
+		}
+		ret = &Receipt{ID: id, Count: n, Status: status}
+
+	case connection.CRow:
+		id, pos, p, e := connection.ReadRow(c.r, line[1:])
+		if e != nil {
+			err = e
+			return
+		}
+		eventName, eventData, e := connection.ParseEvent(p)
+		if e != nil {
+			err = e
+			return
+		}
+		b, e := event.Uncompress(eventData)
+		if e != nil {
+			err = e
+			return
+		}
+		ret = &Row{QueryID: id, Name: event.Event(eventName), Data: b, Position: pos}
+
+	case connection.CQueryEnd:
+		id, n, next, e := connection.ParseQueryEnd(line[1:])
+		if e != nil {
+			err = e
+			return
+		}
+		ret = &Result{ID: id, Count: n, Next: next}
+
 	case connection.CErr:
 		p, e := connection.ReadLen(c.r, line[1:])
 		if e != nil {
 			err = e
 			return
 		}
-		return nil, errors.New(string(p))
+		return nil, connection.ParseError(p)
 
 	case connection.CPong:
 		p, e := connection.ReadLen(c.r, line[1:])
@@ -130,7 +348,12 @@ func (c *conn) Receive() (ret interface{}, err error) {
 		}
 
 	case connection.CEvent:
-		p, e := connection.ReadLen(c.r, line[1:])
+		head, h, e := connection.ParseHeader(line[1:])
+		if e != nil {
+			err = e
+			return
+		}
+		p, e := connection.ReadLen(c.r, head)
 		if e != nil {
 			err = e
 			return
@@ -148,20 +371,71 @@ func (c *conn) Receive() (ret interface{}, err error) {
 			err = e
 			return
 		}
-		ret = &Event{
-			Name: event.Event(eventName),
-			Data: b,
+		ev := &Event{
+			Name:   event.Event(eventName),
+			Data:   b,
+			Key:    h.Key,
+			Retain: h.Retain,
 		}
+		if h.ReceivedAt > 0 {
+			ev.ReceivedAt = time.Unix(0, h.ReceivedAt)
+		}
+		if h.ExpiresAt > 0 {
+			ev.ExpiresAt = time.Unix(0, h.ExpiresAt)
+		}
+		ret = ev
+
+	default:
+		// line 指向 bufio 的暫存區, 需複製
+		ret = &Unknown{Line: append([]byte(nil), line...)}
 	}
 
 	return ret, err
 }
 
+// ReceiveContext 同 Receive, 依 ctx 設定讀取期限
+// ctx 結束時可能停在資料中間, 之後應關閉連線
+func (c *conn) ReceiveContext(ctx context.Context) (ret Response, err error) {
+	err = c.withContext(ctx, c.setReadDeadline, func() error {
+		ret, err = c.Receive()
+		return err
+	})
+	return
+}
+
+// Do 送出帶編號的指令, tag 由呼叫端配發 (> 0), server 的回應以同樣編號的 *Tagged 回傳
+// cmd 可為 CAddChan / CDelChan / CPing / CInfo / CKick / CRecover, arg 同各指令的內容
+func (c *conn) Do(tag int64, cmd byte, arg string) error {
+	if tag <= 0 {
+		return errors.New("client: tag must be positive")
+	}
+	switch cmd {
+	case connection.CAddChan, connection.CDelChan, connection.CKick, connection.CRecover:
+		connection.WriteTag(c.w, tag)
+		c.w.WriteByte(cmd)
+		c.w.WriteString(arg)
+	case connection.CPing:
+		connection.WriteTag(c.w, tag)
+		connection.WritePing(c.w, arg)
+	case connection.CInfo:
+		connection.WriteTag(c.w, tag)
+		connection.WriteInfo(c.w)
+	case connection.CReset:
+		connection.WriteTag(c.w, tag)
+		c.w.WriteByte(cmd)
+	default:
+		return fmt.Errorf("client: command [%c] can't be tagged", cmd)
+	}
+	return c.flush(connection.EOL)
+}
+
+// Auth 一律帶 connection.Reply, 唯寫連線仍收得到回覆/錯誤/receipt
 func (c *conn) Auth(flags int) error {
-	connection.WriteAuth(c.w, c.name, flags)
+	connection.WriteAuth(c.w, c.name, flags|connection.Reply)
 	return c.flush(connection.EOL)
 }
 
+// Recover since/until 為 unix nano
 func (c *conn) Recover(since, until int64) error {
 	connection.WriteRecover(c.w, since, until)
 	return c.flush(connection.EOL)
@@ -172,26 +446,120 @@ func (c *conn) Subscribe(chans ...string) error {
 	return c.flush(nil)
 }
 
+// SubscribeContext 同 Subscribe, 依 ctx 設定寫入期限
+func (c *conn) SubscribeContext(ctx context.Context, chans ...string) error {
+	return c.withContext(ctx, c.setWriteDeadline, func() error {
+		return c.Subscribe(chans...)
+	})
+}
+
 func (c *conn) Unsubscribe(chans ...string) error {
 	connection.WriteUnsubscribe(c.w, chans...)
 	return c.flush(nil)
 }
 
 func (c *conn) Fire(ev event.Event, rd event.RawData) error {
-	rd, err := event.Compress(rd)
-	if err != nil {
-		return err
-	}
-	connection.WriteEvent(c.w, connection.MakeEventStream(ev, rd))
-	return c.flush(connection.EOL)
+	return c.FireEvent(&Event{Name: ev, Data: rd})
 }
 
 func (c *conn) FireTo(name string, ev event.Event, rd event.RawData) error {
-	rd, err := event.Compress(rd)
+	return c.FireEvent(&Event{Target: name, Name: ev, Data: rd})
+}
+
+// FireEvent 送出事件, 附帶 Event 上的屬性 (ex: Key)
+func (c *conn) FireEvent(e *Event) error {
+	return c.writeEvent(e, 0)
+}
+
+// FireEventContext 同 FireEvent, 依 ctx 設定寫入期限
+func (c *conn) FireEventContext(ctx context.Context, e *Event) error {
+	return c.withContext(ctx, c.setWriteDeadline, func() error {
+		return c.FireEvent(e)
+	})
+}
+
+// FireEventWait 送出指定傳送事件並等待 server 回傳結果
+// 等待期間會讀取並略過其他回應, 不可與 listener 共用連線
+func (c *conn) FireEventWait(e *Event) (*Receipt, error) {
+	if e.Target == "" {
+		return nil, errors.New("receipt only for targeted event")
+	}
+
+	id := atomic.AddInt64(&c.receipt, 1)
+	if err := c.writeEvent(e, id); err != nil {
+		return nil, err
+	}
+
+	for {
+		v, err := c.Receive()
+		if err != nil {
+			if _, ok := err.(*connection.Error); !ok {
+				return nil, err
+			}
+			// 其他請求的 server 錯誤
+			continue
+		}
+		if r, ok := v.(*Receipt); ok && r.ID == id {
+			return r, nil
+		}
+	}
+}
+
+// Query 查詢歷史事件, q.ID 由 conn 配發
+// 與 FireEventWait 相同, 等待期間會讀取並略過其他回應, 不可與 listener 共用連線
+func (c *conn) Query(q connection.Query) (*Result, error) {
+	q.ID = atomic.AddInt64(&c.query, 1)
+	connection.WriteQuery(c.w, q)
+	if err := c.flush(connection.EOL); err != nil {
+		return nil, err
+	}
+
+	var (
+		rows   []*Row
+		srvErr error
+	)
+	for {
+		v, err := c.Receive()
+		if err != nil {
+			if _, ok := err.(*connection.Error); !ok {
+				return nil, err
+			}
+			// server 會在結束訊息之前送出查詢錯誤
+			srvErr = err
+			continue
+		}
+		switch v := v.(type) {
+		case *Row:
+			if v.QueryID == q.ID {
+				rows = append(rows, v)
+			}
+		case *Result:
+			if v.ID == q.ID {
+				if srvErr != nil {
+					return nil, srvErr
+				}
+				v.Rows = rows
+				return v, nil
+			}
+		}
+	}
+}
+
+func (c *conn) writeEvent(e *Event, receipt int64) error {
+	rd, err := event.Compress(e.Data)
 	if err != nil {
 		return err
 	}
-	connection.WriteEventTo(c.w, name, connection.MakeEventStream(ev, rd))
+	h := connection.Header{Key: e.Key, Retain: e.Retain, TTL: e.TTL, Delay: e.Delay, Receipt: receipt}
+	if !e.At.IsZero() {
+		h.At = e.At.UnixNano()
+	}
+	p := connection.MakeEventStream(e.Name, rd)
+	if e.Target == "" {
+		connection.WriteEventWithHeader(c.w, h, p)
+	} else {
+		connection.WriteEventToWithHeader(c.w, e.Target, h, p)
+	}
 	return c.flush(connection.EOL)
 }
 
@@ -205,6 +573,108 @@ func (c *conn) Info() error {
 	return c.flush(connection.EOL)
 }
 
+// InfoWait 送出帶編號的 info 請求並等待回應, 回傳解析後的 server 狀態
+// 與 FireEventWait 相同, 等待期間會讀取並略過其他回應, 不可與 listener 共用連線
+func (c *conn) InfoWait() (*connection.Info, error) {
+	tag := atomic.AddInt64(&c.tag, 1)
+	if err := c.Do(tag, connection.CInfo, ""); err != nil {
+		return nil, err
+	}
+
+	for {
+		v, err := c.Receive()
+		if err != nil {
+			if _, ok := err.(*connection.Error); !ok {
+				return nil, err
+			}
+			continue
+		}
+		t, ok := v.(*Tagged)
+		if !ok || t.Tag != tag {
+			continue
+		}
+		switch r := t.Response.(type) {
+		case *connection.Error:
+			return nil, r
+		case *Event:
+			return ParseInfo(r.Data)
+		}
+		return nil, fmt.Errorf("client: unexpected info response %#v", t.Response)
+	}
+}
+
+// ParseInfo 解析 info 事件的資料 (已解壓縮)
+func ParseInfo(rd event.RawData) (*connection.Info, error) {
+	info := &connection.Info{}
+	if err := event.Unmarshal(rd, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Kick 要求 server 中斷 target 指定的連線 (app, pattern 或 #{id})
+// 需在 server env ADMIN 名單內, 結果以 Reply 回傳
+func (c *conn) Kick(target string) error {
+	connection.WriteKick(c.w, target)
+	return c.flush(connection.EOL)
+}
+
+func (c *conn) setReadDeadline(t time.Time) error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *conn) setWriteDeadline(t time.Time) error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+// withContext 以 ctx 的期限執行 f, ctx 被取消時中斷阻塞中的讀寫並回傳 ctx.Err()
+func (c *conn) withContext(ctx context.Context, setDeadline func(time.Time) error, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := setDeadline(deadline); err != nil {
+		return err
+	}
+	defer setDeadline(time.Time{})
+
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			select {
+			case <-ctx.Done():
+				setDeadline(aLongTimeAgo)
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+
+	err := f()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// 連線期限可能比 ctx 的計時器先到
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !deadline.IsZero() && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
 func (c *conn) flush(p []byte) error {
 	c.w.Write(p)
 	if err := c.w.Flush(); err != nil {
@@ -3,9 +3,12 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
@@ -74,6 +77,31 @@ func TestConn_ReceiveErr(t *testing.T) {
 	}
 }
 
+func TestConn_ReceiveTyped(t *testing.T) {
+
+	c := createConn("!27\r\nDUPAUTH hub: duplicate auth\r\n*subscribe a.* OK\r\n$x\r\n")
+
+	_, err := c.Receive()
+	if e, ok := err.(*connection.Error); !ok || e.Code != connection.ErrCodeDupAuth || e.Message != "hub: duplicate auth" {
+		t.Errorf("expect DUPAUTH *connection.Error, but %#v", err)
+	}
+
+	ret, err := c.Receive()
+	if r, ok := ret.(*Reply); !ok || err != nil || !r.Match("subscribe", "a.*") || r.Match("subscribe", "b") || r.Kind() != connection.CReply {
+		t.Errorf("expect subscribe reply, but %#v %v", ret, err)
+	}
+
+	// 無法辨識的前綴不再回傳 nil, nil
+	ret, err = c.Receive()
+	if u, ok := ret.(*Unknown); !ok || err != nil || string(u.Line) != "$x" || u.Kind() != '$' {
+		t.Errorf("expect *Unknown, but %#v %v", ret, err)
+	}
+
+	if _, err := c.Receive(); connection.ErrorCode(err) != "" {
+		t.Error("expect io error without code, but", err)
+	}
+}
+
 func TestConn_ReceivePong(t *testing.T) {
 
 	pongText := "123\r\n456\r\n789"
@@ -167,7 +195,8 @@ func TestConn_Auth(t *testing.T) {
 	prefix := connection.CAuth
 	authText := "test name"
 	flags := connection.Writable | connection.Readable
-	expect := fmt.Sprintf("%c%s:%d\r\n", prefix, authText, 3)
+	// 一律帶 Reply
+	expect := fmt.Sprintf("%c%s:%d\r\n", prefix, authText, flags|connection.Reply)
 
 	c.name = authText
 	c.Auth(flags)
@@ -179,9 +208,9 @@ func TestConn_Recover(t *testing.T) {
 	buf, bw, c := createBWC()
 
 	prefix := connection.CRecover
-	since := int64(12345600)
+	since := int64(1484027821123456789)
 	until := int64(0)
-	expect := fmt.Sprintf("%c%d:%d\r\n", prefix, since, until)
+	expect := fmt.Sprintf("%c%s:%s\r\n", prefix, "1484027821.123456789", "0")
 
 	c.Recover(since, until)
 
@@ -240,3 +269,137 @@ func TestConn_Ping(t *testing.T) {
 
 	checkBuf("Ping", t, buf, bw, expect)
 }
+
+func TestConn_FireEventWait(t *testing.T) {
+	buf, _, c := createBWC()
+	c.r = createBufReader("!3\r\nerr\r\n^9:1:delivered\r\n^1:0:no such target\r\n")
+
+	if _, err := c.FireEventWait(&Event{Name: "a.b"}); err == nil {
+		t.Error("broadcast must not wait receipt")
+	}
+
+	r, err := c.FireEventWait(&Event{Target: "app", Name: "a.b", Data: event.RawData("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != 1 || r.Status != connection.ReceiptNoTarget || r.Err() == nil {
+		t.Errorf("receipt error %+v", r)
+	}
+	if !strings.Contains(buf.String(), " receipt=1\r\n") {
+		t.Errorf("fire with receipt header error [%s]", buf)
+	}
+}
+
+func TestConn_Query(t *testing.T) {
+
+	rd, _ := event.Compress(event.RawData("123"))
+	p := connection.MakeEventStream("job.run", rd)
+
+	resp := bytes.NewBuffer(nil)
+	rw := bufio.NewWriter(resp)
+	// 其他查詢的結果略過
+	connection.WriteRow(rw, 9, connection.Position{At: 1, Seq: 1}, p)
+	rw.Write(connection.EOL)
+	connection.WriteRow(rw, 1, connection.Position{At: 100, Seq: 2}, p)
+	rw.Write(connection.EOL)
+	connection.WriteQueryEnd(rw, 1, 1, connection.Position{At: 100, Seq: 2})
+	rw.Write(connection.EOL)
+	rw.Flush()
+
+	req := bytes.NewBuffer(nil)
+	c := &conn{r: bufio.NewReader(resp), w: bufio.NewWriter(req)}
+	ret, err := c.Query(connection.Query{Names: []string{"job.*"}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := req.String(); s != "?1 name=job.%2A limit=1\r\n" {
+		t.Errorf("query request error [%s]", s)
+	}
+	if ret.ID != 1 || ret.Count != 1 || len(ret.Rows) != 1 || ret.Next != (connection.Position{At: 100, Seq: 2}) {
+		t.Errorf("query result error %+v", ret)
+	}
+	if r := ret.Rows[0]; r.Name != "job.run" || r.Data.String() != "123" || r.Position.Seq != 2 {
+		t.Errorf("query row error %+v", r)
+	}
+}
+
+func TestConn_InfoWait(t *testing.T) {
+
+	b, _ := event.Marshal(connection.Info{
+		Uptime: time.Minute,
+		Events: connection.EventCounts{Received: 3},
+		Auth:   map[string]*connection.ConnInfo{"worker": {ID: 2, Sent: 5}},
+	})
+	rd, _ := event.Compress(b)
+
+	resp := bytes.NewBuffer(nil)
+	rw := bufio.NewWriter(resp)
+	// 其他的事件與請求回應略過
+	connection.WriteEvent(rw, connection.MakeEventStream(event.Info, rd))
+	rw.Write(connection.EOL)
+	connection.WriteTag(rw, 9)
+	connection.WriteEvent(rw, connection.MakeEventStream(event.Info, rd))
+	rw.Write(connection.EOL)
+	connection.WriteTag(rw, 1)
+	connection.WriteEvent(rw, connection.MakeEventStream(event.Info, rd))
+	rw.Write(connection.EOL)
+	rw.Flush()
+
+	req := bytes.NewBuffer(nil)
+	c := &conn{r: bufio.NewReader(resp), w: bufio.NewWriter(req)}
+	info, err := c.InfoWait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := req.String(); s != ":1#\r\n" {
+		t.Errorf("info request error [%s]", s)
+	}
+	if info.Uptime != time.Minute || info.Events.Received != 3 || info.Auth["worker"].Sent != 5 {
+		t.Errorf("info result error %+v", info)
+	}
+}
+
+func TestConn_Context(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// 不回應, 讓 client 讀取阻塞
+		c, err := ln.Accept()
+		if err == nil {
+			defer c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, "", ln.Addr().String()); err == nil {
+		t.Error("DialContext with canceled ctx must fail")
+	}
+
+	c, err := DialContext(context.Background(), "", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := c.ReceiveContext(ctx); err != context.DeadlineExceeded {
+		t.Error("ReceiveContext expect deadline exceeded, but", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+	if _, err := c.ReceiveContext(ctx); err != context.Canceled {
+		t.Error("ReceiveContext expect canceled, but", err)
+	}
+
+	if err := c.FireEventContext(context.Background(), &Event{Name: "a.b"}); err != nil {
+		t.Error("FireEventContext error", err)
+	}
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SRVPrefix 位址以此開頭時由 DNS SRV 記錄取得 ex: srv://_events._tcp.example.com
+const SRVPrefix = "srv://"
+
+// 測試時替換
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// Dialer 多位址連線, 依序嘗試直到成功
+// 最近連線失敗的位址排到最後, 主機恢復後會優先連回前面的位址
+type Dialer interface {
+	Dial() (Conn, error)
+	DialContext(context.Context) (Conn, error)
+	// 單一位址的連線逾時, 預設 3s
+	Timeout(time.Duration)
+	// 失敗的位址在此期間內排到最後, 預設 10s
+	Cooldown(time.Duration)
+	// 目前的嘗試順序
+	Addrs(context.Context) ([]string, error)
+}
+
+type dialer struct {
+	mu       sync.Mutex
+	name     string
+	spec     string
+	timeout  time.Duration
+	cooldown time.Duration
+	// 位址最後失敗時間
+	failed map[string]time.Time
+	dial   func(ctx context.Context, name, addr string) (Conn, error)
+}
+
+// NewDialer 回傳多位址 Dialer, spec 為逗號分隔的 host:port 或 srv://{name}
+// Dial / DialContext 可直接交給 listener.New / listener.NewContext / NewPool
+func NewDialer(name, spec string) Dialer {
+	return &dialer{
+		name:     name,
+		spec:     spec,
+		timeout:  time.Second * 3,
+		cooldown: time.Second * 10,
+		failed:   map[string]time.Time{},
+		dial:     DialContext,
+	}
+}
+
+func (d *dialer) Timeout(t time.Duration) {
+	d.mu.Lock()
+	d.timeout = t
+	d.mu.Unlock()
+}
+
+func (d *dialer) Cooldown(t time.Duration) {
+	d.mu.Lock()
+	d.cooldown = t
+	d.mu.Unlock()
+}
+
+// resolve 依 spec 取得位址, SRV 記錄依 priority / weight 排序
+func (d *dialer) resolve(ctx context.Context) ([]string, error) {
+	if !strings.HasPrefix(d.spec, SRVPrefix) {
+		addrs := []string{}
+		for _, s := range strings.Split(d.spec, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				addrs = append(addrs, s)
+			}
+		}
+		if len(addrs) == 0 {
+			return nil, errors.New("client: empty address")
+		}
+		return addrs, nil
+	}
+
+	_, srvs, err := lookupSRV(ctx, "", "", strings.TrimPrefix(d.spec, SRVPrefix))
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("client: no srv record for %s", d.spec)
+	}
+	return addrs, nil
+}
+
+func (d *dialer) Addrs(ctx context.Context) ([]string, error) {
+	addrs, err := d.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// 維持原本順序, 冷卻中的位址依失敗時間先後排到最後
+	now := time.Now()
+	healthy, cooling := []string{}, []string{}
+	for _, addr := range addrs {
+		t, ok := d.failed[addr]
+		if !ok || now.Sub(t) >= d.cooldown {
+			healthy = append(healthy, addr)
+			continue
+		}
+		cooling = append(cooling, addr)
+	}
+	sort.SliceStable(cooling, func(i, j int) bool {
+		return d.failed[cooling[i]].Before(d.failed[cooling[j]])
+	})
+
+	return append(healthy, cooling...), nil
+}
+
+func (d *dialer) Dial() (Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+func (d *dialer) DialContext(ctx context.Context) (Conn, error) {
+	addrs, err := d.Addrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	timeout := d.timeout
+	d.mu.Unlock()
+
+	errs := []string{}
+	for _, addr := range addrs {
+		dctx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			dctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		c, err := d.dial(dctx, d.name, addr)
+		cancel()
+
+		d.mu.Lock()
+		if err == nil {
+			delete(d.failed, addr)
+		} else {
+			d.failed[addr] = time.Now()
+		}
+		d.mu.Unlock()
+
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+	}
+
+	return nil, fmt.Errorf("client: dial fail [%s]", strings.Join(errs, "; "))
+}
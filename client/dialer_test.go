@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDialer(t *testing.T) {
+
+	down := map[string]bool{"a:1": true}
+	tried := []string{}
+	d := NewDialer("test", "a:1, b:2,c:3").(*dialer)
+	d.dial = func(ctx context.Context, name, addr string) (Conn, error) {
+		tried = append(tried, addr)
+		if down[addr] {
+			return nil, errors.New("refused")
+		}
+		return &conn{name: name}, nil
+	}
+
+	// 主機斷線時改連下一個位址
+	if _, err := d.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"a:1", "b:2"}; !reflect.DeepEqual(tried, expect) {
+		t.Errorf("tried expect %v, but %v", expect, tried)
+	}
+
+	// 冷卻中的位址排到最後
+	tried = tried[:0]
+	d.Dial()
+	if expect := []string{"b:2"}; !reflect.DeepEqual(tried, expect) {
+		t.Errorf("tried expect %v, but %v", expect, tried)
+	}
+
+	// 全部失敗
+	down["b:2"], down["c:3"] = true, true
+	tried = tried[:0]
+	if _, err := d.Dial(); err == nil {
+		t.Error("expect error when all address down")
+	}
+	if expect := []string{"b:2", "c:3", "a:1"}; !reflect.DeepEqual(tried, expect) {
+		t.Errorf("tried expect %v, but %v", expect, tried)
+	}
+	// 依失敗時間先後
+	addrs, _ := d.Addrs(context.Background())
+	if expect := []string{"b:2", "c:3", "a:1"}; !reflect.DeepEqual(addrs, expect) {
+		t.Errorf("addrs expect %v, but %v", expect, addrs)
+	}
+
+	// 冷卻結束後連回主機
+	down = map[string]bool{}
+	d.Cooldown(0)
+	tried = tried[:0]
+	d.Dial()
+	if expect := []string{"a:1"}; !reflect.DeepEqual(tried, expect) {
+		t.Errorf("tried expect %v, but %v", expect, tried)
+	}
+}
+
+func TestDialer_srv(t *testing.T) {
+
+	defer func(f func(context.Context, string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = f
+	}(lookupSRV)
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_events._tcp.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return name, []*net.SRV{
+			{Target: "primary.example.com.", Port: 6300, Priority: 1},
+			{Target: "replica.example.com.", Port: 6301, Priority: 2},
+		}, nil
+	}
+
+	addrs, err := NewDialer("", "srv://_events._tcp.example.com").Addrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"primary.example.com:6300", "replica.example.com:6301"}; !reflect.DeepEqual(addrs, expect) {
+		t.Errorf("addrs expect %v, but %v", expect, addrs)
+	}
+
+	if _, err := NewDialer("", "srv://x").Dial(); err == nil {
+		t.Error("expect lookup error")
+	}
+}
+
+func TestDialer_context(t *testing.T) {
+
+	d := NewDialer("", "a:1,b:2").(*dialer)
+	d.Timeout(time.Millisecond * 10)
+	n := 0
+	d.dial = func(ctx context.Context, name, addr string) (Conn, error) {
+		n++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	// 單一位址逾時後繼續嘗試下一個
+	if _, err := d.Dial(); err == nil || n != 2 {
+		t.Errorf("expect 2 timeout dial, but %d %v", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n = 0
+	if _, err := d.DialContext(ctx); err != context.Canceled || n != 1 {
+		t.Errorf("expect context.Canceled after 1 dial, but %d %v", n, err)
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/colindev/events/connection"
+)
+
+// Future 帶編號請求的回應
+type Future struct {
+	Tag  int64
+	done chan struct{}
+	resp Response
+	err  error
+}
+
+func newFuture(tag int64) *Future {
+	return &Future{Tag: tag, done: make(chan struct{})}
+}
+
+func (f *Future) resolve(resp Response, err error) {
+	if e, ok := resp.(*connection.Error); ok {
+		resp, err = nil, e
+	}
+	f.resp, f.err = resp, err
+	close(f.done)
+}
+
+// Done 收到回應或連線中斷時關閉
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result 等待回應, server 錯誤回傳 *connection.Error
+func (f *Future) Result() (Response, error) {
+	<-f.done
+	return f.resp, f.err
+}
+
+// Wait 同 Result, ctx 結束時回傳 ctx.Err(), 之後收到的回應會被略過
+func (f *Future) Wait(ctx context.Context) (Response, error) {
+	select {
+	case <-f.done:
+		return f.resp, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Dispatcher 在同一條連線上同時送出多個請求, 每個請求以 Future 取得回應
+// 沒有編號的回應 (事件/收據/查詢結果/錯誤) 依序送到 Stream
+type Dispatcher interface {
+	// Do 同 Conn.Do, 編號由 dispatcher 配發
+	Do(cmd byte, arg string) *Future
+	Subscribe(ch string) *Future
+	Unsubscribe(ch string) *Future
+	Ping(m string) *Future
+	Info() *Future
+	Kick(target string) *Future
+	// 需持續讀取, 否則會卡住所有回應; 連線中斷後關閉
+	Stream() <-chan Response
+	// 連線中斷的原因
+	Err() error
+	Close() error
+}
+
+type dispatcher struct {
+	mu      sync.Mutex
+	conn    Conn
+	tag     int64
+	pending map[int64]*Future
+	err     error
+	// 寫入需依序
+	wmu    sync.Mutex
+	stream chan Response
+	quit   chan struct{}
+	once   sync.Once
+}
+
+// NewDispatcher 接手 c 的讀取, 之後不可再直接呼叫 c.Receive
+func NewDispatcher(c Conn) Dispatcher {
+	d := &dispatcher{
+		conn:    c,
+		pending: map[int64]*Future{},
+		stream:  make(chan Response, 100),
+		quit:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *dispatcher) run() {
+	defer close(d.stream)
+	for {
+		resp, err := d.conn.Receive()
+		if e, ok := err.(*connection.Error); ok {
+			resp, err = e, nil
+		}
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		if t, ok := resp.(*Tagged); ok {
+			d.mu.Lock()
+			f := d.pending[t.Tag]
+			delete(d.pending, t.Tag)
+			d.mu.Unlock()
+			if f != nil {
+				f.resolve(t.Response, nil)
+			}
+			continue
+		}
+		select {
+		case d.stream <- resp:
+		case <-d.quit:
+		}
+	}
+}
+
+// fail 連線中斷, 所有等待中的請求回傳 err
+func (d *dispatcher) fail(err error) {
+	d.mu.Lock()
+	select {
+	case <-d.quit:
+		err = ErrClosed
+	default:
+	}
+	d.err = err
+	pending := d.pending
+	d.pending = map[int64]*Future{}
+	d.mu.Unlock()
+
+	for _, f := range pending {
+		f.resolve(nil, err)
+	}
+}
+
+func (d *dispatcher) Do(cmd byte, arg string) *Future {
+	d.mu.Lock()
+	d.tag++
+	f := newFuture(d.tag)
+	if d.err != nil {
+		err := d.err
+		d.mu.Unlock()
+		f.resolve(nil, err)
+		return f
+	}
+	// 先登記再送出, 回應可能比 Do 返回還快
+	d.pending[f.Tag] = f
+	d.mu.Unlock()
+
+	d.wmu.Lock()
+	err := d.conn.Do(f.Tag, cmd, arg)
+	d.wmu.Unlock()
+	if err != nil {
+		d.mu.Lock()
+		_, ok := d.pending[f.Tag]
+		delete(d.pending, f.Tag)
+		d.mu.Unlock()
+		if ok {
+			f.resolve(nil, err)
+		}
+	}
+	return f
+}
+
+func (d *dispatcher) Subscribe(ch string) *Future {
+	return d.Do(connection.CAddChan, ch)
+}
+
+func (d *dispatcher) Unsubscribe(ch string) *Future {
+	return d.Do(connection.CDelChan, ch)
+}
+
+func (d *dispatcher) Ping(m string) *Future {
+	return d.Do(connection.CPing, m)
+}
+
+func (d *dispatcher) Info() *Future {
+	return d.Do(connection.CInfo, "")
+}
+
+func (d *dispatcher) Kick(target string) *Future {
+	return d.Do(connection.CKick, target)
+}
+
+func (d *dispatcher) Stream() <-chan Response {
+	return d.stream
+}
+
+func (d *dispatcher) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+func (d *dispatcher) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.quit)
+		err = d.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/event"
+)
+
+func TestDispatcher(t *testing.T) {
+
+	cli, srv := net.Pipe()
+	d := NewDispatcher(&conn{
+		Mutex: &sync.Mutex{},
+		conn:  cli,
+		w:     bufio.NewWriter(cli),
+		r:     bufio.NewReader(cli),
+	})
+	defer d.Close()
+
+	// server: 讀完兩個請求後先送事件, 再以相反順序回覆
+	go func() {
+		r, w := bufio.NewReader(srv), bufio.NewWriter(srv)
+		var tags []int64
+		for len(tags) < 2 {
+			line, err := connection.ReadLine(r)
+			if err != nil {
+				return
+			}
+			tag, p, _ := connection.ParseTag(line[1:])
+			if p[0] == connection.CPing {
+				connection.ReadLen(r, p[1:])
+			}
+			tags = append(tags, tag)
+		}
+		rd, _ := event.Compress(event.RawData("x"))
+		connection.WriteEvent(w, connection.MakeEventStream("a.b", rd))
+		w.Write(connection.EOL)
+		connection.WriteTag(w, tags[1])
+		connection.WriteLen(w, connection.CErr, 12)
+		w.WriteString("DENIED nope.")
+		w.Write(connection.EOL)
+		connection.WriteTag(w, tags[0])
+		w.WriteString("*subscribe a.* OK")
+		w.Write(connection.EOL)
+		w.Flush()
+		srv.Close()
+	}()
+
+	sub := d.Subscribe("a.*")
+	kick := d.Kick("worker")
+	if sub.Tag == kick.Tag {
+		t.Fatal("tag must be unique")
+	}
+
+	resp := <-d.Stream()
+	if e, ok := resp.(*Event); !ok || e.Name != "a.b" || string(e.Data) != "x" {
+		t.Errorf("expect event in stream, but %#v", resp)
+	}
+
+	if _, err := kick.Result(); connection.ErrorCode(err) != connection.ErrCodeDenied {
+		t.Error("expect DENIED, but", err)
+	}
+	if r, err := sub.Result(); err != nil || !r.(*Reply).Match("subscribe", "a.*") {
+		t.Error("subscribe result error", r, err)
+	}
+
+	// 連線中斷後 stream 關閉, 新的請求直接回傳錯誤
+	for range d.Stream() {
+	}
+	if d.Err() == nil {
+		t.Error("expect conn error after server closed")
+	}
+	if _, err := d.Ping("x").Result(); err == nil {
+		t.Error("expect error after conn closed")
+	}
+}
@@ -2,28 +2,69 @@ package client
 
 import (
 	"container/list"
-	"errors"
+	"context"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
 )
 
 // Pool 連線池
 type Pool interface {
+	// Get 借出連線, 借出的連線 Close 時放回連線池
+	// 放回前同步送出 reset 並等待回應 (最多 3 秒), Close 會阻塞到收到回應或逾時
 	Get() Conn
+	// GetContext 同 Get, 連線數已滿時等待到 ctx 結束
+	GetContext(context.Context) (Conn, error)
 	ActiveConn() int
 	MaxActive(int)
+	// 閒置超過 d 的連線借出前關閉, 0 不限制
+	IdleTimeout(d time.Duration)
+	// 建立超過 d 的連線不再借出, 0 不限制
+	MaxLifetime(d time.Duration)
+	// 借出閒置的連線前檢查, 回傳錯誤時關閉該連線改用其他連線, idle 為閒置時間
+	TestOnBorrow(func(c Conn, idle time.Duration) error)
+	Stats() PoolStats
+}
+
+// PoolStats 連線池狀態
+type PoolStats struct {
+	// 已建立的連線數 (含閒置)
+	Active int
+	Idle   int
+	// 連線數已滿需等待的次數與累計等待時間
+	Waits        int64
+	WaitDuration time.Duration
+	// 等待到 ctx 結束的次數
+	Timeouts int64
+}
+
+// pooledConn 記錄連線建立與開始閒置的時間
+type pooledConn struct {
+	c       Conn
+	created time.Time
+	idleAt  time.Time
 }
 
 type pool struct {
 	dial       func() (Conn, error)
 	mu         sync.Mutex
-	cond       *sync.Cond
 	list       list.List
 	maxIdle    int
 	maxActive  int
 	activeConn int
+	// 等待連線的 channel, 依序喚醒
+	waiters      list.List
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+	testOnBorrow func(Conn, time.Duration) error
+	waits        int64
+	waitDuration time.Duration
+	timeouts     int64
+	// 測試時替換
+	now func() time.Time
 }
 
 // NewPool return pool instance
@@ -31,6 +72,7 @@ func NewPool(dial func() (Conn, error), maxIdle int) Pool {
 	return &pool{
 		dial:    dial,
 		maxIdle: maxIdle,
+		now:     time.Now,
 	}
 }
 
@@ -44,14 +86,42 @@ func (p *pool) MaxActive(n int) {
 	p.mu.Unlock()
 }
 
+func (p *pool) IdleTimeout(d time.Duration) {
+	p.mu.Lock()
+	p.idleTimeout = d
+	p.mu.Unlock()
+}
+
+func (p *pool) MaxLifetime(d time.Duration) {
+	p.mu.Lock()
+	p.maxLifetime = d
+	p.mu.Unlock()
+}
+
+func (p *pool) TestOnBorrow(f func(Conn, time.Duration) error) {
+	p.mu.Lock()
+	p.testOnBorrow = f
+	p.mu.Unlock()
+}
+
 func (p *pool) Get() Conn {
 
-	c, err := p.get()
+	c, err := p.GetContext(context.Background())
 	if err != nil {
 		return &errConn{err}
 	}
 
-	return &maskConn{p: p, c: c}
+	return c
+}
+
+func (p *pool) GetContext(ctx context.Context) (Conn, error) {
+
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &maskConn{p: p, c: c.c, pc: c}, nil
 }
 
 func (p *pool) ActiveConn() int {
@@ -62,30 +132,74 @@ func (p *pool) ActiveConn() int {
 	return n
 }
 
+func (p *pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PoolStats{
+		Active:       p.activeConn,
+		Idle:         p.list.Len(),
+		Waits:        p.waits,
+		WaitDuration: p.waitDuration,
+		Timeouts:     p.timeouts,
+	}
+}
+
+// release 需在 p.mu 內呼叫
 func (p *pool) release() {
 	p.activeConn--
-	if p.cond != nil {
-		p.cond.Signal()
+	p.notify()
+}
+
+// notify 喚醒最早等待的 get, 需在 p.mu 內呼叫
+func (p *pool) notify() {
+	if el := p.waiters.Front(); el != nil {
+		close(p.waiters.Remove(el).(chan struct{}))
 	}
 }
 
-func (p *pool) get() (Conn, error) {
+// expired 連線超過閒置時間或存活時間, 需在 p.mu 內呼叫
+func (p *pool) expired(c *pooledConn, now time.Time) bool {
+	if p.idleTimeout > 0 && now.Sub(c.idleAt) >= p.idleTimeout {
+		return true
+	}
+	return p.maxLifetime > 0 && now.Sub(c.created) >= p.maxLifetime
+}
+
+func (p *pool) get(ctx context.Context) (*pooledConn, error) {
 
 	p.mu.Lock()
 
 	for {
+		if err := ctx.Err(); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
 
-		for i, n := 0, p.list.Len(); i < n; i++ {
-			el := p.list.Front()
-			// init or return
-			if el == nil {
-				break
+		// 最近放回的連線在前面
+		if el := p.list.Front(); el != nil {
+			c := p.list.Remove(el).(*pooledConn)
+			now := p.now()
+			if p.expired(c, now) {
+				p.release()
+				p.mu.Unlock()
+				c.c.Close()
+				p.mu.Lock()
+				continue
 			}
-
-			c := el.Value.(Conn)
-			p.list.Remove(el)
+			test := p.testOnBorrow
 			p.mu.Unlock()
-			return c, nil
+			if test == nil {
+				return c, nil
+			}
+			err := test(c.c, now.Sub(c.idleAt))
+			if err == nil {
+				return c, nil
+			}
+			c.c.Close()
+			p.mu.Lock()
+			p.release()
+			continue
 		}
 
 		if p.maxActive == 0 || p.activeConn < p.maxActive {
@@ -97,55 +211,124 @@ func (p *pool) get() (Conn, error) {
 				p.mu.Lock()
 				p.release()
 				p.mu.Unlock()
-				c = nil
+				return nil, err
 			}
-			return c, err
+			return &pooledConn{c: c, created: p.now()}, nil
 		}
 
-		if p.cond == nil {
-			p.cond = sync.NewCond(&p.mu)
+		// 連線數已滿, 等待放回或關閉
+		wait := make(chan struct{})
+		el := p.waiters.PushBack(wait)
+		p.waits++
+		start := time.Now()
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+			p.mu.Lock()
+			p.waitDuration += time.Since(start)
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.waitDuration += time.Since(start)
+			p.timeouts++
+			select {
+			case <-wait:
+				// 已被喚醒, 轉給下一個等待者
+				p.notify()
+			default:
+				p.waiters.Remove(el)
+			}
 		}
-		p.cond.Wait()
 	}
 }
 
-// TODO 依照後續的使用狀況觀察評估
-// 是否還原連線的初始狀態
-// 作法有
-// 1. maxIdle 設定為 0, 讓連線池每次都重新建立連線
-// 2. 回收連線後先把 flags 設定成 read only 或 0
-// 3. 送個 reset 給 server 處理
-func (p *pool) put(c Conn) error {
-	// TODO 評估處理超時連線
+// 放回前送出 reset 讓連線回到未登入狀態, 下一個使用者需重新 Auth
+// reset 失敗 (ex: 舊版 server) 的連線直接關閉
+func (p *pool) put(c *pooledConn) error {
+
+	err := c.c.Err()
+	if err == nil {
+		err = reset(c.c)
+	}
+
 	p.mu.Lock()
 
-	if err := c.Err(); err == nil {
+	now := p.now()
+	if err == nil && !(p.maxLifetime > 0 && now.Sub(c.created) >= p.maxLifetime) {
+		c.idleAt = now
 		p.list.PushFront(c)
 		if p.list.Len() > p.maxIdle {
-			c = p.list.Remove(p.list.Back()).(Conn)
+			c = p.list.Remove(p.list.Back()).(*pooledConn)
 		} else {
 			c = nil
 		}
 	}
 
 	if c == nil {
-		if p.cond != nil {
-			p.cond.Signal()
-		}
+		p.notify()
 		p.mu.Unlock()
 		return nil
 	}
 
 	p.release()
 	p.mu.Unlock()
-	return c.Close()
+	return c.c.Close()
 }
 
-// 只能 Auth, Fire, FireTo, Close, Receive, Ping, Info
-// 不處理其他方法,省略清除原本通訊設定
+// PingCheck 供 TestOnBorrow 使用, 閒置超過 idle 的連線送出帶編號的 ping 並在 timeout 內等待 pong
+func PingCheck(idle, timeout time.Duration) func(Conn, time.Duration) error {
+	return func(c Conn, d time.Duration) error {
+		if d < idle {
+			return nil
+		}
+		tag := time.Now().UnixNano()
+		if err := c.Do(tag, connection.CPing, "check"); err != nil {
+			return err
+		}
+		return waitTag(c, tag, timeout)
+	}
+}
+
+// 等待 reset 回應的時間
+var resetTimeout = time.Second * 3
+
+// reset 清除連線的訂閱與權限, 之前使用者沒讀取的回應一併略過
+func reset(c Conn) error {
+	tag := time.Now().UnixNano()
+	if err := c.Do(tag, connection.CReset, ""); err != nil {
+		return err
+	}
+	return waitTag(c, tag, resetTimeout)
+}
+
+// waitTag 讀取到編號 tag 的回應為止, 其他回應略過
+func waitTag(c Conn, tag int64, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		v, err := c.ReceiveContext(ctx)
+		if err != nil {
+			if _, ok := err.(*connection.Error); ok {
+				continue
+			}
+			return err
+		}
+		if t, ok := v.(*Tagged); ok && t.Tag == tag {
+			if err, ok := t.Response.(*connection.Error); ok {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// maskConn 借出的連線, Close 時放回連線池
 type maskConn struct {
-	p *pool
-	c Conn
+	p  *pool
+	c  Conn
+	mu sync.Mutex
+	// 已放回時為 nil
+	pc *pooledConn
 }
 
 func (m *maskConn) Fire(ev event.Event, rd event.RawData) error {
@@ -154,29 +337,65 @@ func (m *maskConn) Fire(ev event.Event, rd event.RawData) error {
 func (m *maskConn) FireTo(name string, ev event.Event, rd event.RawData) error {
 	return m.c.FireTo(name, ev, rd)
 }
+func (m *maskConn) FireEvent(e *Event) error {
+	return m.c.FireEvent(e)
+}
+func (m *maskConn) FireEventContext(ctx context.Context, e *Event) error {
+	return m.c.FireEventContext(ctx, e)
+}
+func (m *maskConn) FireEventWait(e *Event) (*Receipt, error) {
+	return m.c.FireEventWait(e)
+}
 func (m *maskConn) Ping(s string) error {
 	return m.c.Ping(s)
 }
 func (m *maskConn) Info() error {
 	return m.c.Info()
 }
-func (m *maskConn) Receive() (interface{}, error) {
+func (m *maskConn) InfoWait() (*connection.Info, error) {
+	return m.c.InfoWait()
+}
+func (m *maskConn) Query(q connection.Query) (*Result, error) {
+	return m.c.Query(q)
+}
+func (m *maskConn) Kick(s string) error {
+	return m.c.Kick(s)
+}
+func (m *maskConn) Do(tag int64, cmd byte, arg string) error {
+	return m.c.Do(tag, cmd, arg)
+}
+func (m *maskConn) Receive() (Response, error) {
 	return m.c.Receive()
 }
+func (m *maskConn) ReceiveContext(ctx context.Context) (Response, error) {
+	return m.c.ReceiveContext(ctx)
+}
 func (m *maskConn) Auth(i int) error {
 	return m.c.Auth(i)
 }
+
+// Close 放回連線池, 重複 Close 回傳 ErrClosed (連線可能已借給其他使用者)
 func (m *maskConn) Close() error {
-	return m.p.put(m.c)
+	m.mu.Lock()
+	pc := m.pc
+	m.pc = nil
+	m.mu.Unlock()
+	if pc == nil {
+		return ErrClosed
+	}
+	return m.p.put(pc)
+}
+func (m *maskConn) Recover(since, until int64) error {
+	return m.c.Recover(since, until)
 }
-func (m *maskConn) Recover(int64, int64) error {
-	return errors.New("pooled conn not support RecoverSince()")
+func (m *maskConn) Subscribe(chs ...string) error {
+	return m.c.Subscribe(chs...)
 }
-func (m *maskConn) Subscribe(...string) error {
-	return errors.New("pooled conn not support Subscribe()")
+func (m *maskConn) SubscribeContext(ctx context.Context, chs ...string) error {
+	return m.c.SubscribeContext(ctx, chs...)
 }
-func (m *maskConn) Unsubscribe(...string) error {
-	return errors.New("pooled conn not support Unsubscribe()")
+func (m *maskConn) Unsubscribe(chs ...string) error {
+	return m.c.Unsubscribe(chs...)
 }
 func (m *maskConn) Conn() net.Conn {
 	return m.c.Conn()
@@ -188,15 +407,24 @@ func (m *maskConn) Err() error {
 // errConn
 type errConn struct{ err error }
 
-func (err *errConn) Fire(event.Event, event.RawData) error           { return err.err }
-func (err *errConn) FireTo(string, event.Event, event.RawData) error { return err.err }
-func (err *errConn) Receive() (interface{}, error)                   { return nil, err.err }
-func (err *errConn) Close() error                                    { return err.err }
-func (err *errConn) Auth(int) error                                  { return err.err }
-func (err *errConn) Ping(string) error                               { return err.err }
-func (err *errConn) Info() error                                     { return err.err }
-func (err *errConn) Recover(int64, int64) error                      { return err.err }
-func (err *errConn) Subscribe(...string) error                       { return err.err }
-func (err *errConn) Unsubscribe(...string) error                     { return err.err }
-func (err *errConn) Conn() net.Conn                                  { return nil }
-func (err *errConn) Err() error                                      { return err.err }
+func (err *errConn) Fire(event.Event, event.RawData) error             { return err.err }
+func (err *errConn) FireTo(string, event.Event, event.RawData) error   { return err.err }
+func (err *errConn) FireEvent(*Event) error                            { return err.err }
+func (err *errConn) FireEventWait(*Event) (*Receipt, error)            { return nil, err.err }
+func (err *errConn) Receive() (Response, error)                        { return nil, err.err }
+func (err *errConn) Close() error                                      { return err.err }
+func (err *errConn) Auth(int) error                                    { return err.err }
+func (err *errConn) Ping(string) error                                 { return err.err }
+func (err *errConn) Info() error                                       { return err.err }
+func (err *errConn) InfoWait() (*connection.Info, error)               { return nil, err.err }
+func (err *errConn) Kick(string) error                                 { return err.err }
+func (err *errConn) Do(int64, byte, string) error                      { return err.err }
+func (err *errConn) FireEventContext(context.Context, *Event) error    { return err.err }
+func (err *errConn) SubscribeContext(context.Context, ...string) error { return err.err }
+func (err *errConn) ReceiveContext(context.Context) (Response, error)  { return nil, err.err }
+func (err *errConn) Query(connection.Query) (*Result, error)           { return nil, err.err }
+func (err *errConn) Recover(int64, int64) error                        { return err.err }
+func (err *errConn) Subscribe(...string) error                         { return err.err }
+func (err *errConn) Unsubscribe(...string) error                       { return err.err }
+func (err *errConn) Conn() net.Conn                                    { return nil }
+func (err *errConn) Err() error                                        { return err.err }
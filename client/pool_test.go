@@ -1,18 +1,25 @@
 package client
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"math/rand"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
 )
 
 type fake struct {
 	fn func(...interface{})
+	// 最後送出的請求編號, Receive 回應同樣的編號
+	tag int64
 }
 
 func (m *fake) Auth(i int) error {
@@ -27,6 +34,14 @@ func (m *fake) FireTo(name string, ev event.Event, rd event.RawData) error {
 	m.fn(m.FireTo, name, ev, rd)
 	return nil
 }
+func (m *fake) FireEvent(e *Event) error {
+	m.fn(m.FireEvent, e)
+	return nil
+}
+func (m *fake) FireEventWait(e *Event) (*Receipt, error) {
+	m.fn(m.FireEventWait, e)
+	return &Receipt{Status: connection.ReceiptDelivered}, nil
+}
 func (m *fake) Ping(s string) error {
 	m.fn(m.Ping, s)
 	return nil
@@ -35,13 +50,42 @@ func (m *fake) Info() error {
 	m.fn(m.Info)
 	return nil
 }
+func (m *fake) Query(q connection.Query) (*Result, error) {
+	m.fn(m.Query, q)
+	return &Result{ID: q.ID}, nil
+}
+func (m *fake) FireEventContext(ctx context.Context, e *Event) error {
+	return m.FireEvent(e)
+}
+func (m *fake) SubscribeContext(ctx context.Context, chs ...string) error {
+	return m.Subscribe(chs...)
+}
+func (m *fake) ReceiveContext(ctx context.Context) (Response, error) {
+	return m.Receive()
+}
+func (m *fake) Kick(s string) error {
+	m.fn(m.Kick, s)
+	return nil
+}
+func (m *fake) Do(tag int64, cmd byte, arg string) error {
+	m.fn(m.Do, tag, cmd, arg)
+	m.tag = tag
+	return nil
+}
+func (m *fake) InfoWait() (*connection.Info, error) {
+	m.fn(m.InfoWait)
+	return &connection.Info{}, nil
+}
 func (m *fake) Close() error {
 	m.fn(m.Close)
 	return nil
 }
-func (m *fake) Receive() (interface{}, error) {
+func (m *fake) Receive() (Response, error) {
 	m.fn(m.Receive)
-	return "ok", nil
+	if m.tag > 0 {
+		return &Tagged{Tag: m.tag, Response: &Reply{"ok"}}, nil
+	}
+	return &Reply{"ok"}, nil
 }
 func (m *fake) Recover(since, until int64) error {
 	m.fn(m.Recover, since, until)
@@ -99,3 +143,129 @@ func TestPool(t *testing.T) {
 		t.Log("end:", <-end)
 	}
 }
+
+// okConn 不會出錯的 fake, 記錄關閉次數
+type okConn struct {
+	fake
+	id     int
+	closed *int32
+}
+
+func (m *okConn) Err() error { return nil }
+func (m *okConn) Close() error {
+	atomic.AddInt32(m.closed, 1)
+	return nil
+}
+
+func TestPool_health(t *testing.T) {
+
+	var (
+		dialed int
+		closed int32
+		now    = time.Now()
+	)
+	p := NewPool(func() (Conn, error) {
+		dialed++
+		return &okConn{fake: fake{fn: func(...interface{}) {}}, id: dialed, closed: &closed}, nil
+	}, 3)
+	p.(*pool).now = func() time.Time { return now }
+	p.MaxActive(1)
+
+	c := p.Get()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := p.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Error("expect deadline exceeded, but", err)
+	}
+	if s := p.Stats(); s.Active != 1 || s.Idle != 0 || s.Waits != 1 || s.Timeouts != 1 {
+		t.Errorf("stats error %+v", s)
+	}
+
+	// 等待中的 get 在連線放回後取得同一條連線
+	got := make(chan Conn)
+	go func() { got <- p.Get() }()
+	for p.Stats().Waits != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+	c = <-got
+	if dialed != 1 {
+		t.Error("expect reuse idle conn, dialed", dialed)
+	}
+	c.Close()
+
+	// 重複 Close 不再放回
+	if err := c.Close(); err != ErrClosed {
+		t.Error("expect ErrClosed, but", err)
+	}
+	if s := p.Stats(); s.Active != 1 || s.Idle != 1 {
+		t.Errorf("double close must not put back %+v", s)
+	}
+
+	// 閒置逾時
+	p.IdleTimeout(time.Minute)
+	now = now.Add(time.Minute)
+	c = p.Get()
+	if dialed != 2 || atomic.LoadInt32(&closed) != 1 {
+		t.Error("expect idle conn closed", dialed, closed)
+	}
+	c.Close()
+
+	// 借出前檢查失敗
+	p.TestOnBorrow(func(c Conn, idle time.Duration) error {
+		return errors.New("unhealthy")
+	})
+	c = p.Get()
+	if dialed != 3 || atomic.LoadInt32(&closed) != 2 {
+		t.Error("expect unhealthy conn closed", dialed, closed)
+	}
+	p.TestOnBorrow(nil)
+
+	// 超過存活時間的連線不放回
+	p.MaxLifetime(time.Hour)
+	now = now.Add(time.Hour)
+	c.Close()
+	if s := p.Stats(); s.Active != 0 || s.Idle != 0 || atomic.LoadInt32(&closed) != 3 {
+		t.Errorf("expect expired conn closed %+v", s)
+	}
+}
+
+func TestPingCheck(t *testing.T) {
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	c := &conn{
+		Mutex: &sync.Mutex{},
+		conn:  cli,
+		w:     bufio.NewWriter(cli),
+		r:     bufio.NewReader(cli),
+	}
+	check := PingCheck(time.Second, time.Millisecond*100)
+
+	if err := check(c, time.Millisecond); err != nil {
+		t.Error("recently used conn should skip check, but", err)
+	}
+
+	go func() {
+		r, w := bufio.NewReader(srv), bufio.NewWriter(srv)
+		line, err := connection.ReadLine(r)
+		if err != nil {
+			return
+		}
+		tag, p, _ := connection.ParseTag(line[1:])
+		connection.ReadLen(r, p[1:])
+		connection.WriteTag(w, tag)
+		connection.WriteLen(w, connection.CPong, 5)
+		w.WriteString("check")
+		w.Write(connection.EOL)
+		w.Flush()
+		// 第二次 ping 不回應
+		connection.ReadLine(r)
+	}()
+	if err := check(c, time.Second); err != nil {
+		t.Error("ping check error", err)
+	}
+	if err := check(c, time.Second); err == nil {
+		t.Error("expect timeout when no pong")
+	}
+}
@@ -0,0 +1,433 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/event"
+)
+
+// ErrClosed 已經關閉的 ResilientConn 或已放回連線池的連線
+var ErrClosed = errors.New("client: conn closed")
+
+// ResilientConn 斷線時自動重連的 Conn
+// 重連後依序重新登入, 訂閱原本的頻道, 設定 RecoverOnReconnect 時 recover 斷線期間的事件
+// 登入一律帶 connection.Meta, recover 從最後收到事件的 server 收到時間之後開始, 不使用本地時鐘
+// 還沒收到事件 (或舊版 server 沒有 header) 時交給 server (since=0, 上次斷線的時間); 匿名連線沒有斷線紀錄, 不會重送
+type ResilientConn interface {
+	Conn
+	// 重連間隔從 min 開始倍增到 max, 每次加上隨機抖動
+	Backoff(min, max time.Duration)
+	RecoverOnReconnect(bool)
+	// 狀態變化: event.Connecting / event.Connected / event.Disconnected (資料為錯誤訊息)
+	OnState(func(event.Event, event.RawData))
+}
+
+type resilient struct {
+	mu      sync.Mutex
+	dial    func() (Conn, error)
+	conn    Conn
+	flags   int
+	authed  bool
+	chs     []string
+	recover bool
+	// 曾經連線成功過, 之後的連線才需要 recover
+	connected bool
+	// 最後收到事件的 server 收到時間 (unix nano)
+	last     int64
+	min, max time.Duration
+	onState  func(event.Event, event.RawData)
+	closed   bool
+	quit     chan struct{}
+	// 正在連線時, 其他呼叫等待此 channel
+	connecting chan struct{}
+}
+
+// NewResilient 回傳自動重連的 Conn, 第一次使用時才連線
+func NewResilient(dial func() (Conn, error)) ResilientConn {
+	return &resilient{
+		dial: dial,
+		min:  time.Millisecond * 100,
+		max:  time.Second * 30,
+		quit: make(chan struct{}),
+	}
+}
+
+func (r *resilient) Backoff(min, max time.Duration) {
+	if min <= 0 || max < min {
+		return
+	}
+	r.mu.Lock()
+	r.min, r.max = min, max
+	r.mu.Unlock()
+}
+
+func (r *resilient) RecoverOnReconnect(b bool) {
+	r.mu.Lock()
+	r.recover = b
+	r.mu.Unlock()
+}
+
+func (r *resilient) OnState(f func(event.Event, event.RawData)) {
+	r.mu.Lock()
+	r.onState = f
+	r.mu.Unlock()
+}
+
+func (r *resilient) emit(ev event.Event, rd event.RawData) {
+	r.mu.Lock()
+	f := r.onState
+	r.mu.Unlock()
+	if f != nil {
+		f(ev, rd)
+	}
+}
+
+// backoff 第 n 次重試前的等待時間, 介於 d/2 ~ d
+func backoff(n int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// isConnErr 連線層的錯誤才重連, server 回傳的錯誤直接交給呼叫端
+func isConnErr(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// get 回傳目前連線, 沒有連線時重連直到成功/ctx 結束/Close
+func (r *resilient) get(ctx context.Context) (Conn, error) {
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if c := r.conn; c != nil {
+			r.mu.Unlock()
+			return c, nil
+		}
+		if wait := r.connecting; wait != nil {
+			r.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		r.connecting = done
+		r.mu.Unlock()
+
+		err := r.connect(ctx)
+
+		r.mu.Lock()
+		r.connecting = nil
+		close(done)
+		r.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *resilient) connect(ctx context.Context) error {
+	for n := 0; ; n++ {
+		r.emit(event.Connecting, event.RawData(fmt.Sprint(n)))
+		c, err := r.dial()
+		if err == nil {
+			if err = r.setup(c); err != nil {
+				c.Close()
+			}
+		}
+		if err == nil {
+			r.mu.Lock()
+			r.conn = c
+			r.connected = true
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				c.Close()
+				return ErrClosed
+			}
+			r.emit(event.Connected, nil)
+			return nil
+		}
+		r.emit(event.Disconnected, event.RawData(err.Error()))
+
+		r.mu.Lock()
+		d := backoff(n, r.min, r.max)
+		r.mu.Unlock()
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.quit:
+			return ErrClosed
+		}
+	}
+}
+
+// setup 新連線還原登入/訂閱/recover
+func (r *resilient) setup(c Conn) error {
+	r.mu.Lock()
+	authed, flags := r.authed, r.flags
+	chs := append([]string{}, r.chs...)
+	again := r.recover && r.connected
+	since := r.last
+	r.mu.Unlock()
+
+	if authed {
+		if err := written(c, c.Auth(flags)); err != nil {
+			return err
+		}
+	}
+	if len(chs) > 0 {
+		if err := written(c, c.Subscribe(chs...)); err != nil {
+			return err
+		}
+	}
+	if again {
+		// recover 包含 since, 最後收到的事件不重送
+		if since > 0 {
+			since++
+		}
+		return written(c, c.Recover(since, 0))
+	}
+	return nil
+}
+
+// broken 關閉壞掉的連線 c, 下次使用時重連
+// 同一條連線只處理一次, 多個呼叫同時失敗也只重連一次
+func (r *resilient) broken(c Conn, err error) {
+	r.mu.Lock()
+	if r.conn != c {
+		r.mu.Unlock()
+		return
+	}
+	r.conn = nil
+	r.mu.Unlock()
+
+	c.Close()
+	r.emit(event.Disconnected, event.RawData(err.Error()))
+}
+
+// written 寫入時 flush 失敗只記錄在 Err, 一併當成此次的錯誤
+func written(c Conn, err error) error {
+	if err == nil {
+		err = c.Err()
+	}
+	return err
+}
+
+// do 執行 f, 連線錯誤時重連後再試
+func (r *resilient) do(ctx context.Context, f func(Conn) error) error {
+	for {
+		c, err := r.get(ctx)
+		if err != nil {
+			return err
+		}
+		// 先前寫入失敗的連線
+		if err = c.Err(); err == nil {
+			err = f(c)
+		}
+		if err == nil || !isConnErr(err) {
+			return err
+		}
+		r.broken(c, err)
+	}
+}
+
+func (r *resilient) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.quit)
+	c := r.conn
+	r.conn = nil
+	r.mu.Unlock()
+
+	if c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+// Auth 一律帶 connection.Meta, 記錄事件的 server 收到時間作為 recover 的起點
+func (r *resilient) Auth(flags int) error {
+	flags |= connection.Meta
+	err := r.do(context.Background(), func(c Conn) error { return written(c, c.Auth(flags)) })
+	if err == nil {
+		r.mu.Lock()
+		r.authed, r.flags = true, flags
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *resilient) Recover(since, until int64) error {
+	return r.do(context.Background(), func(c Conn) error { return written(c, c.Recover(since, until)) })
+}
+
+func (r *resilient) Subscribe(chs ...string) error {
+	return r.SubscribeContext(context.Background(), chs...)
+}
+
+func (r *resilient) SubscribeContext(ctx context.Context, chs ...string) error {
+	err := r.do(ctx, func(c Conn) error { return written(c, c.SubscribeContext(ctx, chs...)) })
+	if err == nil {
+		r.mu.Lock()
+	NEXT:
+		for _, ch := range chs {
+			for _, x := range r.chs {
+				if x == ch {
+					continue NEXT
+				}
+			}
+			r.chs = append(r.chs, ch)
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *resilient) Unsubscribe(chs ...string) error {
+	err := r.do(context.Background(), func(c Conn) error { return written(c, c.Unsubscribe(chs...)) })
+	if err == nil {
+		r.mu.Lock()
+		list := r.chs[:0]
+		for _, x := range r.chs {
+			keep := true
+			for _, ch := range chs {
+				if x == ch {
+					keep = false
+				}
+			}
+			if keep {
+				list = append(list, x)
+			}
+		}
+		r.chs = list
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *resilient) Fire(ev event.Event, rd event.RawData) error {
+	return r.FireEvent(&Event{Name: ev, Data: rd})
+}
+
+func (r *resilient) FireTo(name string, ev event.Event, rd event.RawData) error {
+	return r.FireEvent(&Event{Target: name, Name: ev, Data: rd})
+}
+
+func (r *resilient) FireEvent(e *Event) error {
+	return r.FireEventContext(context.Background(), e)
+}
+
+func (r *resilient) FireEventContext(ctx context.Context, e *Event) error {
+	return r.do(ctx, func(c Conn) error { return written(c, c.FireEventContext(ctx, e)) })
+}
+
+func (r *resilient) FireEventWait(e *Event) (ret *Receipt, err error) {
+	err = r.do(context.Background(), func(c Conn) (err error) {
+		ret, err = c.FireEventWait(e)
+		return
+	})
+	return
+}
+
+func (r *resilient) Query(q connection.Query) (ret *Result, err error) {
+	err = r.do(context.Background(), func(c Conn) (err error) {
+		ret, err = c.Query(q)
+		return
+	})
+	return
+}
+
+func (r *resilient) Ping(m string) error {
+	return r.do(context.Background(), func(c Conn) error { return written(c, c.Ping(m)) })
+}
+
+func (r *resilient) Info() error {
+	return r.do(context.Background(), func(c Conn) error { return written(c, c.Info()) })
+}
+
+func (r *resilient) InfoWait() (ret *connection.Info, err error) {
+	err = r.do(context.Background(), func(c Conn) (err error) {
+		ret, err = c.InfoWait()
+		return
+	})
+	return
+}
+
+func (r *resilient) Kick(target string) error {
+	return r.do(context.Background(), func(c Conn) error { return written(c, c.Kick(target)) })
+}
+
+// Do 寫入失敗時重連後以同一編號重送; 已送出但斷線前沒收到回應的請求不會重送
+func (r *resilient) Do(tag int64, cmd byte, arg string) error {
+	return r.do(context.Background(), func(c Conn) error { return written(c, c.Do(tag, cmd, arg)) })
+}
+
+func (r *resilient) Receive() (Response, error) {
+	return r.ReceiveContext(context.Background())
+}
+
+// ReceiveContext 斷線時重連後繼續讀取, 只有 Close/ctx 結束/server 錯誤才返回
+func (r *resilient) ReceiveContext(ctx context.Context) (ret Response, err error) {
+	err = r.do(ctx, func(c Conn) (err error) {
+		ret, err = c.ReceiveContext(ctx)
+		if err != nil && ctx.Err() != nil {
+			// 可能停在資料中間, 換一條連線
+			r.broken(c, err)
+		}
+		return
+	})
+	if e, ok := ret.(*Event); ok && err == nil && !e.ReceivedAt.IsZero() {
+		r.mu.Lock()
+		r.last = e.ReceivedAt.UnixNano()
+		r.mu.Unlock()
+	}
+	return
+}
+
+func (r *resilient) Conn() net.Conn {
+	r.mu.Lock()
+	c := r.conn
+	r.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.Conn()
+}
+
+func (r *resilient) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/event"
+)
+
+func TestBackoff(t *testing.T) {
+
+	min, max := time.Millisecond*100, time.Second
+	for n, expect := range []time.Duration{min, min * 2, min * 4, min * 8, max, max} {
+		for i := 0; i < 20; i++ {
+			if d := backoff(n, min, max); d < expect/2 || d > expect {
+				t.Errorf("backoff(%d) expect %v ~ %v, but %v", n, expect/2, expect, d)
+			}
+		}
+	}
+}
+
+func TestResilient(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// 第一條連線收到訂閱後斷線, 第二條連線檢查重送的指令後送出事件
+	lines := make(chan []string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(c)
+			expect := 2
+			if i == 1 {
+				expect = 3
+			}
+			got := []string{}
+			for len(got) < expect {
+				line, err := connection.ReadLine(r)
+				if err != nil {
+					break
+				}
+				got = append(got, string(line))
+			}
+			lines <- got
+			rd, _ := event.Compress(event.RawData(strconv.Itoa(i + 1)))
+			w := bufio.NewWriter(c)
+			// 帶 server 收到的時間, 重連後從此之後 recover
+			connection.WriteEventWithHeader(w, connection.Header{ReceivedAt: 1484027821500000000}, connection.MakeEventStream("a.b", rd))
+			w.Write(connection.EOL)
+			w.Flush()
+			if i == 0 {
+				c.Close()
+			} else {
+				defer c.Close()
+			}
+		}
+		time.Sleep(time.Second)
+	}()
+
+	var mu sync.Mutex
+	states := []event.Event{}
+
+	rc := NewResilient(func() (Conn, error) { return Dial("test", ln.Addr().String()) })
+	defer rc.Close()
+	rc.Backoff(time.Millisecond, time.Millisecond*10)
+	rc.RecoverOnReconnect(true)
+	rc.OnState(func(ev event.Event, rd event.RawData) {
+		mu.Lock()
+		states = append(states, ev)
+		mu.Unlock()
+	})
+
+	if err := rc.Auth(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Subscribe("a.*"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []string{"1", "2"} {
+		ret, err := rc.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, ok := ret.(*Event)
+		if !ok {
+			t.Fatalf("expect *Event, but %#v", ret)
+		}
+		if e.Name != "a.b" || string(e.Data) != expect {
+			t.Errorf("expect a.b %s, but %s %s", expect, e.Name, e.Data)
+		}
+	}
+
+	first, second := <-lines, <-lines
+	if len(first) != 2 || first[0] != "$test:15" || first[1] != "+a.*" {
+		t.Errorf("first conn: %q", first)
+	}
+	if len(second) != 3 || second[0] != first[0] || second[1] != "+a.*" || second[2] != ">1484027821.500000001:0" {
+		t.Errorf("second conn expect auth, subscribe, recover but %q", second)
+	}
+
+	mu.Lock()
+	expect := []event.Event{event.Connecting, event.Connected, event.Disconnected, event.Connecting, event.Connected}
+	if len(states) != len(expect) {
+		t.Errorf("states expect %v, but %v", expect, states)
+	} else {
+		for i := range expect {
+			if states[i] != expect[i] {
+				t.Errorf("states expect %v, but %v", expect, states)
+				break
+			}
+		}
+	}
+	mu.Unlock()
+
+	rc.Close()
+	if _, err := rc.Receive(); err != ErrClosed {
+		t.Errorf("expect ErrClosed after close, but %v", err)
+	}
+}
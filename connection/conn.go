@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -43,13 +44,131 @@ const (
 	CTarget byte = '<'
 	// CInfo 請求 server 資料
 	CInfo byte = '#'
+	// CReceipt 指定傳送的結果
+	CReceipt byte = '^'
+	// CKick 管理指令: 中斷指定連線
+	CKick byte = '~'
+	// CQuery 查詢歷史事件
+	CQuery byte = '?'
+	// CRow 查詢結果的一筆事件
+	CRow byte = '&'
+	// CQueryEnd 查詢結果結束
+	CQueryEnd byte = '%'
+	// CTag 請求編號, 放在指令前 (ex: `:3+a.*`), server 對此指令的回應帶同樣編號
+	CTag byte = ':'
+	// CReset 清除訂閱與權限, 連線回到未登入狀態 (連線池回收時使用)
+	CReset byte = '/'
 
 	// Writable flag
 	Writable = 1
 	// Readable flag
 	Readable = 2
+	// Meta flag, 收到的事件附帶 header (received / expires / key / retain), follow 使用
+	Meta = 4
+	// Reply flag, 沒有讀取權限時仍接收回覆/錯誤/receipt
+	// 沒有此旗標的唯寫連線 server 不寫出任何資料 (同舊版行為)
+	Reply = 8
 )
 
+// 指定傳送結果
+const (
+	// ReceiptDelivered 已送給目標
+	ReceiptDelivered = "delivered"
+	// ReceiptQueued 目標離線或尚未訂閱, 已存入收件匣/排程
+	ReceiptQueued = "queued"
+	// ReceiptNoTarget 沒有此目標
+	ReceiptNoTarget = "no such target"
+	// ReceiptExpired 事件已過期
+	ReceiptExpired = "expired"
+	// ReceiptDenied 連線沒有寫入權限
+	ReceiptDenied = "denied"
+	// ReceiptError server 內部錯誤 (ex: 寫入收件匣失敗), 細節記在 server log
+	ReceiptError = "error"
+)
+
+// 錯誤代碼, server 以 `!{len}\r\n{code} {message}` 送出
+const (
+	// ErrCodeUnknown 未分類的錯誤 (ex: store 錯誤)
+	ErrCodeUnknown = "ERR"
+	// ErrCodeProtocol 無法解析的指令
+	ErrCodeProtocol = "PROTOCOL"
+	// ErrCodeNeedAuth 第一個指令不是登入
+	ErrCodeNeedAuth = "NOAUTH"
+	// ErrCodeDupAuth 同名 app 已經登入
+	ErrCodeDupAuth = "DUPAUTH"
+	// ErrCodeDenied 沒有權限 (ex: 非管理者使用 kick)
+	ErrCodeDenied = "DENIED"
+	// ErrCodeKicked 連線被管理者中斷
+	ErrCodeKicked = "KICKED"
+	// ErrCodeOverflow recover 期間暫存的即時事件超過上限, 連線中斷, 需重新連線後 recover
+	ErrCodeOverflow = "OVERFLOW"
+)
+
+// Error server 回傳的錯誤
+type Error struct {
+	// 舊版 server 沒有代碼時為空字串
+	Code    string
+	Message string
+}
+
+// NewError 建立帶代碼的錯誤
+func NewError(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" || e.Message == "" {
+		return e.Code + e.Message
+	}
+	return e.Code + " " + e.Message
+}
+
+// Kind 同 CErr, 帶編號請求的錯誤以回應的形式回傳 (client.Tagged)
+func (e *Error) Kind() byte {
+	return CErr
+}
+
+// ToError 非 *Error 的錯誤以 ErrCodeUnknown 包裝
+func ToError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Code: ErrCodeUnknown, Message: err.Error()}
+}
+
+// ParseError 解析錯誤內容, 開頭不是大寫代碼時視為沒有代碼
+func ParseError(p []byte) *Error {
+	s := string(p)
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		i = len(s)
+	}
+	code := s[:i]
+	if code == "" {
+		return &Error{Message: s}
+	}
+	for _, r := range code {
+		if (r < 'A' || r > 'Z') && r != '_' {
+			return &Error{Message: s}
+		}
+	}
+	if i < len(s) {
+		i++
+	}
+	return &Error{Code: code, Message: s[i:]}
+}
+
+// ErrorCode 回傳 server 錯誤的代碼, 其他錯誤 (ex: 連線錯誤) 回傳空字串
+func ErrorCode(err error) string {
+	if e, ok := err.(*Error); ok {
+		if e.Code == "" {
+			return ErrCodeUnknown
+		}
+		return e.Code
+	}
+	return ""
+}
+
 var (
 	// OK preprocess to bytes
 	OK = []byte{0x1f, 0x8b, 0x8, 0x0, 0x0, 0x9, 0x6e, 0x88, 0x0, 0xff}
@@ -57,6 +176,282 @@ var (
 	EOL = []byte{'\r', '\n'}
 )
 
+// Header 事件附加屬性, 以空白分隔接在長度後面
+// ex: =123 key=user.1 retain=1 ttl=5s delay=1m receipt=1
+type Header struct {
+	// 壓縮 (compaction) 用的識別鍵
+	Key string
+	// server 保留此事件名稱最後一筆, 訂閱時補送
+	Retain bool
+	// 存活時間, 過期後不再重送/補送
+	TTL time.Duration
+	// 指定送出時間 (unix nano)
+	At int64
+	// 延遲送出, 以 server 收到的時間起算
+	Delay time.Duration
+	// 大於 0 時 server 以此編號回傳指定傳送結果
+	Receipt int64
+	// server 收到的時間 (unix nano), 只在送給 Meta 連線的事件
+	ReceivedAt int64
+	// 過期時間 (unix nano), 只在送給 Meta 連線的事件
+	ExpiresAt int64
+}
+
+// IsZero 沒有任何屬性
+func (h Header) IsZero() bool {
+	return h == Header{}
+}
+
+func (h Header) String() string {
+	s := []string{}
+	if h.Key != "" {
+		s = append(s, "key="+url.QueryEscape(h.Key))
+	}
+	if h.Retain {
+		s = append(s, "retain=1")
+	}
+	if h.TTL > 0 {
+		s = append(s, "ttl="+h.TTL.String())
+	}
+	if h.At > 0 {
+		s = append(s, "at="+FormatTimestamp(h.At))
+	}
+	if h.Delay > 0 {
+		s = append(s, "delay="+h.Delay.String())
+	}
+	if h.Receipt > 0 {
+		s = append(s, "receipt="+strconv.FormatInt(h.Receipt, 10))
+	}
+	if h.ReceivedAt > 0 {
+		s = append(s, "received="+FormatTimestamp(h.ReceivedAt))
+	}
+	if h.ExpiresAt > 0 {
+		s = append(s, "expires="+FormatTimestamp(h.ExpiresAt))
+	}
+	return strings.Join(s, " ")
+}
+
+// Position 歷史事件位置 (received_at, seq), 查詢分頁用
+type Position struct {
+	At  int64
+	Seq int64
+}
+
+// IsZero 沒有位置
+func (p Position) IsZero() bool {
+	return p == Position{}
+}
+
+func (p Position) String() string {
+	if p.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(p.At, 10) + ":" + strconv.FormatInt(p.Seq, 10)
+}
+
+// ParsePosition 解析 {received_at}:{seq}, 空字串為零值
+func ParsePosition(s string) (p Position, err error) {
+	if s == "" {
+		return
+	}
+	v := strings.SplitN(s, ":", 2)
+	if len(v) != 2 {
+		err = errors.New("schema error: expect {received_at}:{seq}")
+		return
+	}
+	if p.At, err = strconv.ParseInt(v[0], 10, 64); err != nil {
+		return
+	}
+	p.Seq, err = strconv.ParseInt(v[1], 10, 64)
+	return
+}
+
+// RecoverReport recover.begin / recover.end 事件資料
+// begin 只有 Since/Until, end 另外帶重送筆數跟錯誤
+type RecoverReport struct {
+	Since int64
+	Until int64
+	// 重送的事件數
+	Count int
+	// 一併送出的收件匣事件數
+	Inbox int
+	// 重送期間暫存, 重送完才送出的即時事件數
+	Live  int
+	Error string `json:",omitempty"`
+}
+
+// Info info 事件資料, server 狀態
+type Info struct {
+	// server 啟動時間 (unix nano)
+	StartedAt int64
+	Uptime    time.Duration
+	Events    EventCounts
+	// 等待寫入 store 的事件數
+	StoreBacklog int
+	// 具名連線
+	Auth map[string]*ConnInfo
+	// 匿名連線
+	Ghost []*ConnInfo
+}
+
+// EventCounts server 啟動後的事件數
+type EventCounts struct {
+	// client 送來的事件 (含 follow)
+	Received int64
+	// 存入 store 的事件
+	Saved int64
+	// 送給連線的事件 (含 recover 重送)
+	Delivered int64
+}
+
+// ConnInfo 單一連線狀態
+type ConnInfo struct {
+	ID      int64
+	Channel []event.Event
+	Name    string
+	// 沒有上一次登入紀錄時為 nil
+	LastAuth    *store.Auth `json:",omitempty"`
+	Flag        int
+	ConnectedAt int64
+	// 此連線送來 / 送出的事件數
+	Received int64
+	Sent     int64
+	// 等待寫出的訊息數
+	Pending int
+}
+
+// Query 歷史事件查詢條件
+// ex: ?1 name=job.*,user.* since=1484027821 until=1484027999.5 after=1484027821000000000:12 limit=100
+type Query struct {
+	// 由 client 配發, 對應回傳的結果
+	ID int64
+	// 事件名稱 pattern, 空的表示全部
+	Names []string
+	// unix nano, 小於等於 0 時不限制
+	Since int64
+	Until int64
+	// 從此位置之後開始 (不含), 接續上一頁用
+	After Position
+	// 筆數上限, 0 使用 server 預設值
+	Limit int
+}
+
+func (q Query) String() string {
+	s := []string{strconv.FormatInt(q.ID, 10)}
+	if len(q.Names) > 0 {
+		s = append(s, "name="+url.QueryEscape(JoinTargets(q.Names...)))
+	}
+	if q.Since > 0 {
+		s = append(s, "since="+FormatTimestamp(q.Since))
+	}
+	if q.Until > 0 {
+		s = append(s, "until="+FormatTimestamp(q.Until))
+	}
+	if !q.After.IsZero() {
+		s = append(s, "after="+q.After.String())
+	}
+	if q.Limit > 0 {
+		s = append(s, "limit="+strconv.Itoa(q.Limit))
+	}
+	return strings.Join(s, " ")
+}
+
+// ParseQuery 解析 {id} name=... since=... until=... after=... limit=..., 不認得的屬性略過
+func ParseQuery(p []byte) (q Query, err error) {
+	fields := strings.Fields(string(p))
+	if len(fields) == 0 {
+		err = errors.New("schema error: expect {id}")
+		return
+	}
+	if q.ID, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return
+	}
+
+	for _, attr := range fields[1:] {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			err = errors.New("query error:" + attr)
+			return
+		}
+		v, e := url.QueryUnescape(kv[1])
+		if e != nil {
+			err = e
+			return
+		}
+		switch kv[0] {
+		case "name":
+			q.Names = ParseTargets(v)
+		case "since":
+			q.Since, err = ParseTimestamp(v)
+		case "until":
+			q.Until, err = ParseTimestamp(v)
+		case "after":
+			q.After, err = ParsePosition(v)
+		case "limit":
+			q.Limit, err = strconv.Atoi(v)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// ParseHeader 拆開長度(或目標)與附加屬性
+// 回傳屬性之前的部份給 ParseLen / ParseTargetAndLen 使用, 不認得的屬性略過
+func ParseHeader(p []byte) ([]byte, Header, error) {
+	var h Header
+
+	i := bytes.IndexByte(p, ' ')
+	if i == -1 {
+		return p, h, nil
+	}
+
+	for _, attr := range strings.Fields(string(p[i+1:])) {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return p[:i], h, errors.New("header error:" + attr)
+		}
+		v, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return p[:i], h, err
+		}
+		switch kv[0] {
+		case "key":
+			h.Key = v
+		case "retain":
+			h.Retain = v == "1" || v == "true"
+		case "ttl":
+			if h.TTL, err = time.ParseDuration(v); err != nil {
+				return p[:i], h, err
+			}
+		case "at":
+			if h.At, err = ParseTimestamp(v); err != nil {
+				return p[:i], h, err
+			}
+		case "delay":
+			if h.Delay, err = time.ParseDuration(v); err != nil {
+				return p[:i], h, err
+			}
+		case "receipt":
+			if h.Receipt, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return p[:i], h, err
+			}
+		case "received":
+			if h.ReceivedAt, err = ParseTimestamp(v); err != nil {
+				return p[:i], h, err
+			}
+		case "expires":
+			if h.ExpiresAt, err = ParseTimestamp(v); err != nil {
+				return p[:i], h, err
+			}
+		}
+	}
+
+	return p[:i], h, nil
+}
+
 // ParseLen of socket stream
 func ParseLen(p []byte) (int64, error) {
 
@@ -97,6 +492,7 @@ func ParseLen(p []byte) (int64, error) {
 }
 
 // ParseTargetAndLen from socket stream
+// 目標可為逗號分隔的多個 app 或名稱 pattern, ex: <app1,worker-*:123
 func ParseTargetAndLen(p []byte) (appName string, length int64, err error) {
 	i := bytes.IndexByte(p, ':')
 	if i == -1 {
@@ -109,6 +505,43 @@ func ParseTargetAndLen(p []byte) (appName string, length int64, err error) {
 	return
 }
 
+// ParseTargets 拆開逗號分隔的目標, 去除空白與重複
+func ParseTargets(s string) []string {
+	list := []string{}
+	seen := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		list = append(list, t)
+	}
+	return list
+}
+
+// FormatConnID 組合連線 ID 目標, ex: #12
+func FormatConnID(id int64) string {
+	return "#" + strconv.FormatInt(id, 10)
+}
+
+// ParseConnID 解析 #{id} 目標
+func ParseConnID(s string) (int64, bool) {
+	if len(s) < 2 || s[0] != '#' {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(s[1:], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// JoinTargets 組合多個目標給 WriteEventTo 使用
+func JoinTargets(targets ...string) string {
+	return strings.Join(targets, ",")
+}
+
 // ParseEvent from socket stream
 func ParseEvent(p []byte) (event.Event, event.RawData, error) {
 
@@ -140,15 +573,73 @@ func ParseEvent(p []byte) (event.Event, event.RawData, error) {
 }
 
 // ParseSinceUntil from socket stream
+// 回傳 unix nano, 格式錯誤的部份視為 0
 func ParseSinceUntil(p []byte) (since int64, until int64) {
 	s := strings.SplitN(string(p), ":", 2)
-	since, _ = strconv.ParseInt(s[0], 10, 64)
+	since, _ = ParseTimestamp(s[0])
 	if len(s) == 2 {
-		until, _ = strconv.ParseInt(s[1], 10, 64)
+		until, _ = ParseTimestamp(s[1])
 	}
 	return
 }
 
+// ParseTimestamp 解析 {秒}[.{小數}] 格式, 回傳 unix nano
+// 相容舊版只送整數秒的 client
+func ParseTimestamp(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	var negate bool
+	if s[0] == '-' {
+		negate = true
+		s = s[1:]
+	}
+
+	var sec, frac int64
+	var err error
+	parts := strings.SplitN(s, ".", 2)
+	if parts[0] != "" {
+		sec, err = strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(parts) == 2 {
+		digits := parts[1]
+		if len(digits) > 9 {
+			digits = digits[:9]
+		}
+		if digits != "" {
+			frac, err = strconv.ParseInt(digits+strings.Repeat("0", 9-len(digits)), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	ns := sec*int64(time.Second) + frac
+	if negate {
+		ns = -ns
+	}
+	return ns, nil
+}
+
+// FormatTimestamp 將 unix nano 轉成 {秒}[.{小數}] 格式
+func FormatTimestamp(ns int64) string {
+	if ns < 0 {
+		return "-" + FormatTimestamp(-ns)
+	}
+
+	sec := strconv.FormatInt(ns/int64(time.Second), 10)
+	frac := ns % int64(time.Second)
+	if frac == 0 {
+		return sec
+	}
+
+	return sec + "." + strings.TrimRight(fmt.Sprintf("%09d", frac), "0")
+}
+
 // MakeEventStream build stream from event data
 func MakeEventStream(ev event.Event, rd event.RawData) []byte {
 	buf := bytes.NewBuffer(ev.Bytes())
@@ -167,7 +658,17 @@ func MakeEvent(ev event.Event, rd event.RawData, t time.Time) *store.Event {
 		Prefix:     ev.Type(),
 		Length:     len(p),
 		Raw:        string(p),
-		ReceivedAt: t.Unix(),
+		ReceivedAt: t.UnixNano(),
+	}
+}
+
+// MakeHeader 送給 Meta 連線的事件 header
+func MakeHeader(e *store.Event) Header {
+	return Header{
+		Key:        e.Key,
+		Retain:     e.Retain,
+		ReceivedAt: e.ReceivedAt,
+		ExpiresAt:  e.ExpiresAt,
 	}
 }
 
@@ -189,20 +690,173 @@ func WriteTargetAndLen(w *bufio.Writer, prefix byte, target string, n int) error
 	return err
 }
 
+// WriteLenAndHeader to buffer writer
+func WriteLenAndHeader(w *bufio.Writer, prefix byte, n int, h Header) error {
+	w.WriteByte(prefix)
+	w.WriteString(strconv.Itoa(n))
+	writeHeader(w, h)
+	_, err := w.Write(EOL)
+	return err
+}
+
+func writeHeader(w *bufio.Writer, h Header) {
+	if !h.IsZero() {
+		w.WriteByte(' ')
+		w.WriteString(h.String())
+	}
+}
+
 // WriteEvent to socket
 func WriteEvent(w *bufio.Writer, p []byte) error {
-	WriteLen(w, CEvent, len(p))
+	return WriteEventWithHeader(w, Header{}, p)
+}
+
+// WriteEventWithHeader to socket
+func WriteEventWithHeader(w *bufio.Writer, h Header, p []byte) error {
+	WriteLenAndHeader(w, CEvent, len(p), h)
 	_, err := w.Write(p)
 	return err
 }
 
 // WriteEventTo tosocket for specific target
 func WriteEventTo(w *bufio.Writer, name string, p []byte) error {
-	WriteTargetAndLen(w, CTarget, name, len(p))
+	return WriteEventToWithHeader(w, name, Header{}, p)
+}
+
+// WriteEventToWithHeader to socket for specific target
+func WriteEventToWithHeader(w *bufio.Writer, name string, h Header, p []byte) error {
+	w.WriteByte(CTarget)
+	w.WriteString(name)
+	w.WriteByte(':')
+	w.WriteString(strconv.Itoa(len(p)))
+	writeHeader(w, h)
+	w.Write(EOL)
 	_, err := w.Write(p)
 	return err
 }
 
+// WriteReceipt to socket, n 為收到 (含存入收件匣) 的 app 數量
+func WriteReceipt(w *bufio.Writer, id int64, n int, status string) error {
+	w.WriteByte(CReceipt)
+	w.WriteString(strconv.FormatInt(id, 10))
+	w.WriteByte(':')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteByte(':')
+	_, err := w.WriteString(status)
+	return err
+}
+
+// ParseReceipt 解析 {id}:{n}:{status}
+func ParseReceipt(p []byte) (id int64, n int, status string, err error) {
+	s := strings.SplitN(string(p), ":", 3)
+	if len(s) != 3 {
+		err = errors.New("schema error: expect {id}:{n}:{status}")
+		return
+	}
+
+	if id, err = strconv.ParseInt(s[0], 10, 64); err != nil {
+		return
+	}
+	n, err = strconv.Atoi(s[1])
+	status = s[2]
+	return
+}
+
+// WriteKick request to socket, target 同指定傳送 (app, pattern, #{id})
+func WriteKick(w *bufio.Writer, target string) error {
+	w.WriteByte(CKick)
+	_, err := w.WriteString(target)
+	return err
+}
+
+// WriteTag 寫出請求編號, 之後接著寫指令
+func WriteTag(w *bufio.Writer, tag int64) error {
+	w.WriteByte(CTag)
+	_, err := w.WriteString(strconv.FormatInt(tag, 10))
+	return err
+}
+
+// ParseTag 解析 {tag}{指令}, p 不含 CTag 前綴, 回傳編號之後的指令
+func ParseTag(p []byte) (int64, []byte, error) {
+	i := 0
+	for i < len(p) && p[i] >= '0' && p[i] <= '9' {
+		i++
+	}
+	if i == 0 || i == len(p) {
+		return 0, nil, fmt.Errorf("tag format error: %q", p)
+	}
+	tag, err := strconv.ParseInt(string(p[:i]), 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	return tag, p[i:], nil
+}
+
+// WriteQuery request to socket
+func WriteQuery(w *bufio.Writer, q Query) error {
+	w.WriteByte(CQuery)
+	_, err := w.WriteString(q.String())
+	return err
+}
+
+// WriteRow 寫出一筆查詢結果 &{id}:{received_at}:{seq}:{len}, p 同事件流 (name:data)
+func WriteRow(w *bufio.Writer, id int64, pos Position, p []byte) error {
+	w.WriteByte(CRow)
+	w.WriteString(strconv.FormatInt(id, 10))
+	w.WriteByte(':')
+	w.WriteString(pos.String())
+	w.WriteByte(':')
+	w.WriteString(strconv.Itoa(len(p)))
+	w.Write(EOL)
+	_, err := w.Write(p)
+	return err
+}
+
+// ParseRow 解析 {id}:{received_at}:{seq}:{len}
+func ParseRow(p []byte) (id int64, pos Position, length int64, err error) {
+	s := strings.SplitN(string(p), ":", 4)
+	if len(s) != 4 {
+		err = errors.New("schema error: expect {id}:{received_at}:{seq}:{len}")
+		return
+	}
+	if id, err = strconv.ParseInt(s[0], 10, 64); err != nil {
+		return
+	}
+	if pos, err = ParsePosition(s[1] + ":" + s[2]); err != nil {
+		return
+	}
+	length, err = ParseLen([]byte(s[3]))
+	return
+}
+
+// WriteQueryEnd 寫出查詢結束 %{id}:{n}:{next}, 沒有下一頁時 next 為空
+func WriteQueryEnd(w *bufio.Writer, id int64, n int, next Position) error {
+	w.WriteByte(CQueryEnd)
+	w.WriteString(strconv.FormatInt(id, 10))
+	w.WriteByte(':')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteByte(':')
+	_, err := w.WriteString(next.String())
+	return err
+}
+
+// ParseQueryEnd 解析 {id}:{n}:{next}
+func ParseQueryEnd(p []byte) (id int64, n int, next Position, err error) {
+	s := strings.SplitN(string(p), ":", 3)
+	if len(s) != 3 {
+		err = errors.New("schema error: expect {id}:{n}:{next}")
+		return
+	}
+	if id, err = strconv.ParseInt(s[0], 10, 64); err != nil {
+		return
+	}
+	if n, err = strconv.Atoi(s[1]); err != nil {
+		return
+	}
+	next, err = ParsePosition(s[2])
+	return
+}
+
 // WriteInfo request to socket
 func WriteInfo(w *bufio.Writer) error {
 	return w.WriteByte(CInfo)
@@ -222,10 +876,10 @@ func WriteAuth(w *bufio.Writer, name string, flags int) error {
 	return err
 }
 
-// WriteRecover to socket
+// WriteRecover to socket, since/until 為 unix nano
 func WriteRecover(w *bufio.Writer, since, until int64) error {
 	w.WriteByte(CRecover)
-	_, err := w.WriteString(strconv.FormatInt(since, 10) + ":" + strconv.FormatInt(until, 10))
+	_, err := w.WriteString(FormatTimestamp(since) + ":" + FormatTimestamp(until))
 	return err
 }
 
@@ -287,6 +941,24 @@ func ReadLen(r *bufio.Reader, p []byte) ([]byte, error) {
 	return buf, nil
 }
 
+// ReadRow parse and read follow stream of query row from reader
+func ReadRow(r *bufio.Reader, p []byte) (id int64, pos Position, b []byte, err error) {
+	var n int64
+	id, pos, n, err = ParseRow(p)
+	if err != nil {
+		return
+	}
+
+	b = make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+
+	// 取出後面換行
+	ReadLine(r)
+	return
+}
+
 // ReadTargetAndLen parse and read follow stream of event from reader
 func ReadTargetAndLen(r *bufio.Reader, p []byte) (target string, b []byte, err error) {
 	var n int64
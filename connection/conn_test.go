@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/colindev/events/event"
 )
@@ -30,6 +31,145 @@ func Test_ParseTargetAndLen(t *testing.T) {
 	if n, i, e := ParseTargetAndLen([]byte(":123")); n != "" || i != 123 || e != nil {
 		t.Error("ParseTargetAndLen(:123) error", n, i, e)
 	}
+	if n, i, e := ParseTargetAndLen([]byte("a,worker-*:123")); n != "a,worker-*" || i != 123 || e != nil {
+		t.Error("ParseTargetAndLen(a,worker-*:123) error", n, i, e)
+	}
+}
+
+func Test_ParseTargets(t *testing.T) {
+	if list := ParseTargets(" a, b,,worker-*,a "); fmt.Sprint(list) != "[a b worker-*]" {
+		t.Error("ParseTargets error", list)
+	}
+	if s := JoinTargets("a", "worker-*"); s != "a,worker-*" {
+		t.Error("JoinTargets error", s)
+	}
+}
+
+func Test_ConnID(t *testing.T) {
+	if s := FormatConnID(12); s != "#12" {
+		t.Error("FormatConnID error", s)
+	}
+	if id, ok := ParseConnID("#12"); !ok || id != 12 {
+		t.Error("ParseConnID error", id, ok)
+	}
+	for _, s := range []string{"12", "#", "#0", "#a", "app"} {
+		if _, ok := ParseConnID(s); ok {
+			t.Error("ParseConnID must fail", s)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := bufio.NewWriter(buf)
+	WriteKick(w, "#12")
+	checkBuf("writeKick", t, buf, w, "~#12")
+}
+
+func Test_Query(t *testing.T) {
+	q := Query{
+		ID:    3,
+		Names: []string{"job.*", "user.login"},
+		Since: 1484027821000000000,
+		Until: 1484027999500000000,
+		After: Position{At: 1484027821000000001, Seq: 12},
+		Limit: 50,
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := bufio.NewWriter(buf)
+	WriteQuery(w, q)
+	checkBuf("writeQuery", t, buf, w, "?3 name=job.%2A%2Cuser.login since=1484027821 until=1484027999.5 after=1484027821000000001:12 limit=50")
+
+	qq, err := ParseQuery(buf.Bytes()[1:])
+	if err != nil || fmt.Sprint(qq) != fmt.Sprint(q) {
+		t.Errorf("ParseQuery error %+v %v", qq, err)
+	}
+	if qq, err := ParseQuery([]byte("4")); err != nil || qq.ID != 4 || len(qq.Names) != 0 || !qq.After.IsZero() {
+		t.Errorf("ParseQuery empty error %+v %v", qq, err)
+	}
+	if _, err := ParseQuery([]byte("4 after=12")); err == nil {
+		t.Error("ParseQuery must fail with bad position")
+	}
+}
+
+func Test_Row(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := bufio.NewWriter(buf)
+	WriteRow(w, 3, Position{At: 100, Seq: 2}, []byte("a.b:xx"))
+	w.Write(EOL)
+	WriteQueryEnd(w, 3, 1, Position{})
+	w.Write(EOL)
+	checkBuf("writeRow", t, buf, w, "&3:100:2:6\r\na.b:xx\r\n%3:1:\r\n")
+
+	r := bufio.NewReader(buf)
+	line, _ := ReadLine(r)
+	id, pos, p, err := ReadRow(r, line[1:])
+	if id != 3 || pos != (Position{At: 100, Seq: 2}) || string(p) != "a.b:xx" || err != nil {
+		t.Error("ReadRow error", id, pos, string(p), err)
+	}
+	line, _ = ReadLine(r)
+	id, n, next, err := ParseQueryEnd(line[1:])
+	if id != 3 || n != 1 || !next.IsZero() || err != nil {
+		t.Error("ParseQueryEnd error", id, n, next, err)
+	}
+}
+
+func Test_Receipt(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := bufio.NewWriter(buf)
+	WriteReceipt(w, 12, 0, ReceiptNoTarget)
+	checkBuf("writeReceipt", t, buf, w, "^12:0:no such target")
+
+	if id, n, status, err := ParseReceipt([]byte("12:3:delivered")); id != 12 || n != 3 || status != ReceiptDelivered || err != nil {
+		t.Error("ParseReceipt error", id, n, status, err)
+	}
+	if _, _, _, err := ParseReceipt([]byte("12:delivered")); err == nil {
+		t.Error("ParseReceipt must fail without count")
+	}
+}
+
+func Test_Error(t *testing.T) {
+	for s, expect := range map[string]Error{
+		"DUPAUTH hub: duplicate auth x": {ErrCodeDupAuth, "hub: duplicate auth x"},
+		"NOAUTH":                        {ErrCodeNeedAuth, ""},
+		"some thing error":              {"", "some thing error"},
+		"EOF-ish error":                 {"", "EOF-ish error"},
+	} {
+		e := ParseError([]byte(s))
+		if *e != expect {
+			t.Errorf("ParseError(%q) expect %+v, but %+v", s, expect, *e)
+		}
+		if e.Error() != s {
+			t.Errorf("Error() expect %q, but %q", s, e.Error())
+		}
+	}
+
+	if code := ErrorCode(ToError(io.EOF)); code != ErrCodeUnknown {
+		t.Error("ToError code expect ERR, but", code)
+	}
+	if code := ErrorCode(io.EOF); code != "" {
+		t.Error("ErrorCode of io.EOF expect empty, but", code)
+	}
+	if code := ErrorCode(NewError(ErrCodeKicked, "kicked")); code != ErrCodeKicked {
+		t.Error("ErrorCode expect KICKED, but", code)
+	}
+}
+
+func Test_Tag(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := bufio.NewWriter(buf)
+	WriteTag(w, 12)
+	WriteSubscribe(w, "a.*")
+	checkBuf("writeTag", t, buf, w, ":12+a.*\r\n")
+
+	tag, p, err := ParseTag([]byte("12+a.*"))
+	if tag != 12 || string(p) != "+a.*" || err != nil {
+		t.Error("ParseTag error", tag, string(p), err)
+	}
+	for _, s := range []string{"", "12", "+a.*", "x1+a"} {
+		if _, _, err := ParseTag([]byte(s)); err == nil {
+			t.Errorf("ParseTag(%q) expect error", s)
+		}
+	}
 }
 
 func Test_ParseEvent(t *testing.T) {
@@ -71,15 +211,36 @@ func Test_MakeEventStream(t *testing.T) {
 }
 
 func Test_ParseSinceUntil(t *testing.T) {
-	if s, u := ParseSinceUntil([]byte("123:")); s != 123 || u != 0 {
+	if s, u := ParseSinceUntil([]byte("123:")); s != 123e9 || u != 0 {
 		t.Error("ParseSinceUntil(123:) fail", s, u)
 	}
-	if s, u := ParseSinceUntil([]byte("123:456")); s != 123 || u != 456 {
+	if s, u := ParseSinceUntil([]byte("123:456")); s != 123e9 || u != 456e9 {
 		t.Error("ParseSinceUntil(123:456) fail", s, u)
 	}
-	if s, u := ParseSinceUntil([]byte(":456")); s != 0 || u != 456 {
+	if s, u := ParseSinceUntil([]byte(":456")); s != 0 || u != 456e9 {
 		t.Error("ParseSinceUntil(:456) fail", s, u)
 	}
+	if s, u := ParseSinceUntil([]byte("123.5:456.000000789")); s != 123500000000 || u != 456000000789 {
+		t.Error("ParseSinceUntil(123.5:456.000000789) fail", s, u)
+	}
+}
+
+func Test_FormatTimestamp(t *testing.T) {
+	for ns, expect := range map[int64]string{
+		0:                   "0",
+		123e9:               "123",
+		123500000000:        "123.5",
+		1484027821123456789: "1484027821.123456789",
+		-1500000000:         "-1.5",
+	} {
+		s := FormatTimestamp(ns)
+		if s != expect {
+			t.Errorf("FormatTimestamp(%d) expect %s, but %s", ns, expect, s)
+		}
+		if n, err := ParseTimestamp(s); n != ns || err != nil {
+			t.Errorf("ParseTimestamp(%s) expect %d, but %d %v", s, ns, n, err)
+		}
+	}
 }
 
 func Test_ReadLine(t *testing.T) {
@@ -169,6 +330,62 @@ func Test_WriteEvent(t *testing.T) {
 	checkBuf("writeEvent", t, buf, w, expect)
 }
 
+func Test_WriteEventWithHeader(t *testing.T) {
+
+	eventText := "aaa.bbb:ccc"
+	h := Header{Key: "user 1"}
+	expect := fmt.Sprintf("%c%d key=user+1\r\n%s", CEvent, len(eventText), eventText)
+
+	buf := bytes.NewBuffer(nil)
+	w := bufio.NewWriter(buf)
+	WriteEventWithHeader(w, h, []byte(eventText))
+	checkBuf("writeEventWithHeader", t, buf, w, expect)
+
+	buf.Reset()
+	WriteEventToWithHeader(w, "app", h, []byte(eventText))
+	checkBuf("writeEventToWithHeader", t, buf, w, fmt.Sprintf("%capp:%d key=user+1\r\n%s", CTarget, len(eventText), eventText))
+}
+
+func Test_ParseHeader(t *testing.T) {
+
+	p, h, err := ParseHeader([]byte("123 key=user+1 unknown=x"))
+	if err != nil || string(p) != "123" || h.Key != "user 1" {
+		t.Errorf("ParseHeader fail [%s] %+v %v", p, h, err)
+	}
+
+	p, h, err = ParseHeader([]byte("123 retain=1"))
+	if err != nil || string(p) != "123" || !h.Retain || h.String() != "retain=1" {
+		t.Errorf("ParseHeader retain fail [%s] %+v %v", p, h, err)
+	}
+
+	p, h, err = ParseHeader([]byte("123 ttl=1.5s"))
+	if err != nil || h.TTL != 1500*time.Millisecond || h.String() != "ttl=1.5s" {
+		t.Errorf("ParseHeader ttl fail [%s] %+v %v", p, h, err)
+	}
+	if _, _, err := ParseHeader([]byte("123 ttl=x")); err == nil {
+		t.Error("ParseHeader must fail on broken ttl")
+	}
+
+	p, h, err = ParseHeader([]byte("123 at=1484027821.5 delay=1m0s"))
+	if err != nil || h.At != 1484027821500000000 || h.Delay != time.Minute || h.String() != "at=1484027821.5 delay=1m0s" {
+		t.Errorf("ParseHeader at/delay fail [%s] %+v %v", p, h, err)
+	}
+
+	p, h, err = ParseHeader([]byte("123 received=1484027821.5 expires=1484031421"))
+	if err != nil || h.ReceivedAt != 1484027821500000000 || h.ExpiresAt != 1484031421000000000 || h.String() != "received=1484027821.5 expires=1484031421" {
+		t.Errorf("ParseHeader received/expires fail [%s] %+v %v", p, h, err)
+	}
+
+	p, h, err = ParseHeader([]byte("app:123"))
+	if err != nil || string(p) != "app:123" || !h.IsZero() {
+		t.Errorf("ParseHeader without header fail [%s] %+v %v", p, h, err)
+	}
+
+	if _, _, err := ParseHeader([]byte("123 key")); err == nil {
+		t.Error("ParseHeader must fail on broken attribute")
+	}
+}
+
 var (
 	// use to test ReceiveEvent, benchmark
 	eventName = event.Event("stream.accountants")
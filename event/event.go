@@ -32,6 +32,12 @@ const (
 
 	// Error event
 	Error Event = "error"
+
+	// RecoverBegin server 開始重送
+	RecoverBegin Event = "recover.begin"
+
+	// RecoverEnd server 重送完畢
+	RecoverEnd Event = "recover.end"
 )
 
 type (
@@ -2,6 +2,8 @@ package launcher
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -15,21 +17,123 @@ type (
 	Launcher interface {
 		Fire(event.Event, event.RawData) error
 		FireTo(string, event.Event, event.RawData) error
+		FireEvent(*client.Event) error
+		FireEventContext(context.Context, *client.Event) error
+		FireAt(time.Time, event.Event, event.RawData) error
+		FireAfter(time.Duration, event.Event, event.RawData) error
+		FireToWait(string, event.Event, event.RawData) (*client.Receipt, error)
+		FireEventWait(*client.Event) (*client.Receipt, error)
+		FireEventWaitContext(context.Context, *client.Event) (*client.Receipt, error)
+		// FireEventAsync 排入待送後立即返回, 由 Result 取得最終結果
+		FireEventAsync(context.Context, *client.Event) *Result
+		OnReceipt(func(*client.Event, *client.Receipt))
+		// OutboxSync 設定 outbox 寫入後是否 fsync, 預設開啟; 關閉時只有系統當機才可能遺失最後寫入的事件
+		OutboxSync(bool)
+		// Flush 等待呼叫前排入的事件都送出 (或放棄)
+		Flush(context.Context) error
+		Stats() Stats
+		// CloseContext 同 Close, ctx 結束時放棄還沒送出的事件並回傳 ctx.Err()
+		CloseContext(context.Context) error
 		Close() error
 	}
 
+	// Stats 啟動後的累計數量
+	Stats struct {
+		// 排入待送的事件 (含 outbox 上次沒送出的)
+		Queued int64
+		Sent   int64
+		// 送出失敗後重新連線再送的次數
+		Retried int64
+		// 過期或 Close 逾時沒送出的事件
+		Dropped int64
+	}
+
+	// 送出請求, res 不為 nil 時回傳最終結果 (指定傳送含 receipt)
+	request struct {
+		ev  *client.Event
+		res *Result
+		// outbox 編號, 送出後 ack
+		seq int64
+	}
+
+	// 已送出的事件, 重連後重送用
+	sent struct {
+		ev *client.Event
+		at time.Time
+	}
+
 	launcher struct {
-		wg   sync.WaitGroup
-		pool client.Pool
-		c    chan *client.Event
+		wg        sync.WaitGroup
+		mu        sync.RWMutex
+		pool      client.Pool
+		c         chan *request
+		onReceipt func(*client.Event, *client.Receipt)
+		// 沒有設定 outbox 時為 nil
+		outbox *outbox
+		quit   chan struct{}
+		// Close 逾時, 不再重試
+		abort     chan struct{}
+		closeOnce sync.Once
+		abortOnce sync.Once
+		// 保護 closed; Close 後不再排入, 等 senders 都結束才關閉 l.c
+		cmu     sync.RWMutex
+		closed  bool
+		senders sync.WaitGroup
+
+		// 保護 stats, 每次送出/放棄後關閉 changed 通知 Flush
+		smu     sync.Mutex
+		stats   Stats
+		changed chan struct{}
 	}
 )
 
+var (
+	// ErrDropped Close 逾時前沒送出的事件 (有 outbox 時下次啟動會再送)
+	ErrDropped = errors.New("launcher: event dropped")
+	// ErrExpired 送出前已超過 TTL
+	ErrExpired = errors.New("launcher: event expired")
+	// ErrClosed Close 之後排入的事件
+	ErrClosed = errors.New("launcher: closed")
+)
+
+// Result 非同步送出的最終結果
+type Result struct {
+	done    chan struct{}
+	receipt *client.Receipt
+	err     error
+}
+
+func newResult() *Result {
+	return &Result{done: make(chan struct{})}
+}
+
+func (r *Result) resolve(rc *client.Receipt, err error) {
+	r.receipt, r.err = rc, err
+	close(r.done)
+}
+
+// Done 送出或放棄後關閉
+func (r *Result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait 等待最終結果, 指定傳送時回傳 server 的 receipt, ctx 結束時回傳 ctx.Err()
+func (r *Result) Wait(ctx context.Context) (*client.Receipt, error) {
+	select {
+	case <-r.done:
+		return r.receipt, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // New return a Launcher instance
 func New(pool client.Pool) Launcher {
 	l := &launcher{
-		pool: pool,
-		c:    make(chan *client.Event, 100),
+		pool:    pool,
+		c:       make(chan *request, 100),
+		abort:   make(chan struct{}),
+		changed: make(chan struct{}),
 	}
 
 	l.wg.Add(1)
@@ -38,63 +142,265 @@ func New(pool client.Pool) Launcher {
 	return l
 }
 
+// NewWithOutbox 同 New, Fire 的事件先附加到 dir 下的 outbox 檔案
+// 送出成功 (指定傳送有 OnReceipt 時為收到結果) 後才移除, 啟動時依序重送上次未送出的事件
+// 預設每筆寫入後 fsync (見 OutboxSync), 記憶體只保留事件在檔案中的位置
+// FireEventWait 系列仍只存在記憶體
+func NewWithOutbox(pool client.Pool, dir string) (Launcher, error) {
+	o, err := openOutbox(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &launcher{
+		pool:    pool,
+		c:       make(chan *request, 100),
+		outbox:  o,
+		quit:    make(chan struct{}),
+		abort:   make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	l.stats.Queued = int64(o.size())
+
+	l.wg.Add(1)
+	go l.reduce(5, time.Millisecond*300)
+	l.senders.Add(1)
+	go l.feed()
+
+	return l, nil
+}
+
+// feed 依序把 outbox 的事件交給 reduce, Close 後送完剩下的才結束
+func (l *launcher) feed() {
+	defer l.senders.Done()
+	for {
+		rec, ok := l.outbox.next(l.quit)
+		if !ok || l.aborted() {
+			return
+		}
+		// 檔案損壞讀不回來的事件放棄
+		if rec.err != nil {
+			l.outbox.ack(rec.Seq)
+			l.finish(&request{res: rec.res}, nil, rec.err)
+			continue
+		}
+		// 扣除寫入後經過的時間, 過期的事件不送
+		ev, ok := (&sent{ev: rec.Event, at: rec.At}).resend(time.Now())
+		if !ok {
+			l.outbox.ack(rec.Seq)
+			l.finish(&request{ev: rec.Event, res: rec.res}, nil, ErrExpired)
+			continue
+		}
+		select {
+		case l.c <- &request{ev: ev, res: rec.res, seq: rec.Seq}:
+		case <-l.abort:
+			return
+		}
+	}
+}
+
 func (l *launcher) Fire(ev event.Event, rd event.RawData) error {
 
-	l.c <- &client.Event{
+	return l.FireEvent(&client.Event{
 		Name: ev,
 		Data: rd,
+	})
+}
+
+func (l *launcher) FireTo(target string, ev event.Event, rd event.RawData) error {
+	return l.FireEvent(&client.Event{
+		Target: target,
+		Name:   ev,
+		Data:   rd,
+	})
+}
+
+// FireEvent 送出完整的事件 (可帶 Target/Key)
+func (l *launcher) FireEvent(e *client.Event) error {
+	return l.FireEventContext(context.Background(), e)
+}
+
+// FireEventContext 同 FireEvent, 佇列已滿時最多等到 ctx 結束 (有 outbox 時寫入檔案即返回)
+func (l *launcher) FireEventContext(ctx context.Context, e *client.Event) error {
+	return l.push(ctx, &request{ev: e})
+}
+
+// FireEventAsync 排入失敗時 Result 直接回傳錯誤
+func (l *launcher) FireEventAsync(ctx context.Context, e *client.Event) *Result {
+	res := newResult()
+	if err := l.push(ctx, &request{ev: e, res: res}); err != nil {
+		res.resolve(nil, err)
 	}
+	return res
+}
 
+// push 有 outbox 時先寫入檔案, 否則直接排入
+func (l *launcher) push(ctx context.Context, r *request) error {
+	if l.outbox == nil {
+		return l.enqueue(ctx, r)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.cmu.RLock()
+	defer l.cmu.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if err := l.outbox.push(r.ev, r.res); err != nil {
+		return err
+	}
+	l.count(func(s *Stats) { s.Queued++ })
 	return nil
 }
 
-func (l *launcher) FireTo(target string, ev event.Event, rd event.RawData) error {
-	l.c <- &client.Event{
+// enqueue 直接排入 reduce, Close 後回傳 ErrClosed
+func (l *launcher) enqueue(ctx context.Context, r *request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.cmu.RLock()
+	if l.closed {
+		l.cmu.RUnlock()
+		return ErrClosed
+	}
+	l.senders.Add(1)
+	l.cmu.RUnlock()
+	defer l.senders.Done()
+
+	select {
+	case l.c <- r:
+		l.count(func(s *Stats) { s.Queued++ })
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FireToWait 指定傳送並等待 server 回傳結果
+func (l *launcher) FireToWait(target string, ev event.Event, rd event.RawData) (*client.Receipt, error) {
+	return l.FireEventWait(&client.Event{
 		Target: target,
 		Name:   ev,
 		Data:   rd,
+	})
+}
+
+// FireEventWait 同 FireToWait, 可帶完整事件屬性
+func (l *launcher) FireEventWait(e *client.Event) (*client.Receipt, error) {
+	return l.FireEventWaitContext(context.Background(), e)
+}
+
+// FireEventWaitContext 同 FireEventWait, ctx 結束時不再等待 (事件可能已送出)
+func (l *launcher) FireEventWaitContext(ctx context.Context, e *client.Event) (*client.Receipt, error) {
+	if e.Target == "" {
+		return nil, errors.New("launcher: receipt only for targeted event")
 	}
 
-	return nil
+	// 不經過 outbox
+	res := newResult()
+	if err := l.enqueue(ctx, &request{ev: e, res: res}); err != nil {
+		return nil, err
+	}
+
+	return res.Wait(ctx)
+}
+
+// OnReceipt 設定後每個指定傳送都會等待結果並回呼 (不含斷線重送)
+func (l *launcher) OnReceipt(f func(*client.Event, *client.Receipt)) {
+	l.mu.Lock()
+	l.onReceipt = f
+	l.mu.Unlock()
+}
+
+func (l *launcher) OutboxSync(b bool) {
+	if l.outbox != nil {
+		l.outbox.setSync(b)
+	}
+}
+
+// FireAt 由 server 在指定時間送出
+func (l *launcher) FireAt(t time.Time, ev event.Event, rd event.RawData) error {
+	return l.FireEvent(&client.Event{
+		Name: ev,
+		Data: rd,
+		At:   t,
+	})
+}
+
+// FireAfter 由 server 延遲 d 後送出
+func (l *launcher) FireAfter(d time.Duration, ev event.Event, rd event.RawData) error {
+	return l.FireEvent(&client.Event{
+		Name:  ev,
+		Data:  rd,
+		Delay: d,
+	})
 }
 
 // Run try resent
+// 不改用 client.NewResilient: 重連要從連線池換一條連線, 斷線前送出的事件依 outbox / 最後 n 筆重送,
+// 每筆事件的結果 (Result / ack) 也要在這裡判斷, resilient 重連後自動重送會重複送出
 func (l *launcher) reduce(keep int, du time.Duration) {
 	conn := l.pool.Get()
 	conn.Auth(connection.Writable)
 	// 保留最後 n 筆資料
 	cache := list.New()
-	fire := func(c client.Conn, ca *client.Event) error {
-		var err error
-		switch ca.Target {
-		case "":
-			err = c.Fire(ca.Name, ca.Data)
-		default:
-			err = c.FireTo(ca.Target, ca.Name, ca.Data)
+	fire := func(c client.Conn, r *request) (*client.Receipt, error) {
+		l.mu.RLock()
+		cb := l.onReceipt
+		l.mu.RUnlock()
+
+		if r.ev.Target == "" || (r.res == nil && cb == nil) {
+			return nil, c.FireEvent(r.ev)
 		}
-		return err
+
+		rc, err := c.FireEventWait(r.ev)
+		if err != nil {
+			return nil, err
+		}
+		if cb != nil {
+			cb(r.ev, rc)
+		}
+		return rc, nil
 	}
-	for ca := range l.c {
+	for r := range l.c {
 		for cache.Len() > keep {
 			cache.Remove(cache.Front())
 		}
 		for {
-			if err := fire(conn, ca); err == nil {
-				cache.PushBack(ca)
+			// Close 逾時, 剩下的事件直接放棄
+			if l.aborted() {
+				l.finish(r, nil, ErrDropped)
+				break
+			}
+			rc, err := fire(conn, r)
+			if err == nil {
+				// 有 outbox 時由 outbox 重送, 不需要保留
+				if l.outbox == nil {
+					cache.PushBack(&sent{ev: r.ev, at: time.Now()})
+				}
+				// Close 逾時後 outbox 可能已關閉, 不再 ack (下次啟動再送)
+				if r.seq > 0 && !l.aborted() {
+					l.outbox.ack(r.seq)
+				}
+				l.finish(r, rc, nil)
 				break
 			}
+			l.count(func(s *Stats) { s.Retried++ })
 			conn.Close()
 			conn = l.pool.Get()
 			if err := conn.Auth(connection.Writable); err != nil {
-				time.Sleep(du)
-			} else {
+				l.sleep(du)
+			} else if l.outbox == nil {
 				// 每次斷線後重新連上,延遲一段時間才重送資料
-				time.Sleep(time.Second * 10)
+				l.sleep(time.Second * 10)
 
 				// 重送斷線前 n 筆資料
 				el := cache.Front()
 				for el != nil {
-					fire(conn, el.Value.(*client.Event))
+					if ev, ok := el.Value.(*sent).resend(time.Now()); ok {
+						conn.FireEvent(ev)
+					}
 					el = el.Next()
 				}
 			}
@@ -104,8 +410,132 @@ func (l *launcher) reduce(keep int, du time.Duration) {
 	l.wg.Done()
 }
 
-func (l *launcher) Close() error {
-	close(l.c)
-	l.wg.Wait()
+// resend 扣除已經過的時間, 過期的事件不重送
+func (s *sent) resend(t time.Time) (*client.Event, bool) {
+	if s.ev.TTL <= 0 && s.ev.Delay <= 0 {
+		return s.ev, true
+	}
+
+	elapsed := t.Sub(s.at)
+	ev := *s.ev
+	if ev.TTL > 0 {
+		if ev.TTL -= elapsed; ev.TTL <= 0 {
+			return nil, false
+		}
+	}
+	if ev.Delay > 0 {
+		// 已到期的延遲事件直接送出
+		if ev.Delay -= elapsed; ev.Delay < 0 {
+			ev.Delay = 0
+		}
+	}
+
+	return &ev, true
+}
+
+// sleep 等待 d, Close 逾時時立即返回
+func (l *launcher) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-l.abort:
+	}
+}
+
+func (l *launcher) aborted() bool {
+	select {
+	case <-l.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *launcher) count(f func(*Stats)) {
+	l.smu.Lock()
+	f(&l.stats)
+	close(l.changed)
+	l.changed = make(chan struct{})
+	l.smu.Unlock()
+}
+
+// finish 記錄事件送出或放棄, 並回傳結果
+func (l *launcher) finish(r *request, rc *client.Receipt, err error) {
+	l.count(func(s *Stats) {
+		if err == nil {
+			s.Sent++
+		} else {
+			s.Dropped++
+		}
+	})
+	if r.res != nil {
+		r.res.resolve(rc, err)
+	}
+}
+
+func (l *launcher) Stats() Stats {
+	l.smu.Lock()
+	defer l.smu.Unlock()
+	return l.stats
+}
+
+// Flush 在同一個 reduce 依序送出, 送出與放棄的數量追上呼叫時的排入數即完成
+func (l *launcher) Flush(ctx context.Context) error {
+	l.smu.Lock()
+	target := l.stats.Queued
+	for l.stats.Sent+l.stats.Dropped < target {
+		changed := l.changed
+		l.smu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.smu.Lock()
+	}
+	l.smu.Unlock()
 	return nil
 }
+
+// Close 送完佇列中的事件才返回
+func (l *launcher) Close() error {
+	return l.CloseContext(context.Background())
+}
+
+func (l *launcher) CloseContext(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		l.cmu.Lock()
+		l.closed = true
+		l.cmu.Unlock()
+		if l.outbox != nil {
+			// feed 送完 outbox 後結束
+			close(l.quit)
+		}
+		// 排入中的請求 (含 feed) 都結束後才關閉 l.c
+		go func() {
+			l.senders.Wait()
+			close(l.c)
+		}()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// 不再重試, 還沒送出的事件放棄 (outbox 中的下次啟動再送)
+		l.abortOnce.Do(func() { close(l.abort) })
+		err = ctx.Err()
+	}
+
+	if l.outbox != nil {
+		if e := l.outbox.close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -1,13 +1,18 @@
 package launcher
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/colindev/events/client"
+	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
 )
 
@@ -27,6 +32,16 @@ func (m *fake) FireTo(name string, ev event.Event, rd event.RawData) error {
 	m.fn("FireTo", name, ev, rd)
 	return nil
 }
+func (m *fake) FireEvent(e *client.Event) error {
+	if e.Target == "" {
+		return m.Fire(e.Name, e.Data)
+	}
+	return m.FireTo(e.Target, e.Name, e.Data)
+}
+func (m *fake) FireEventWait(e *client.Event) (*client.Receipt, error) {
+	m.fn("FireEventWait", e.Target, e.Name, e.Data)
+	return &client.Receipt{Status: "delivered"}, nil
+}
 func (m *fake) Ping(s string) error {
 	m.fn("Ping", s)
 	return nil
@@ -35,13 +50,38 @@ func (m *fake) Info() error {
 	m.fn("Info")
 	return nil
 }
+func (m *fake) Query(q connection.Query) (*client.Result, error) {
+	m.fn("Query", q)
+	return &client.Result{ID: q.ID}, nil
+}
+func (m *fake) FireEventContext(ctx context.Context, e *client.Event) error {
+	return m.FireEvent(e)
+}
+func (m *fake) SubscribeContext(ctx context.Context, chs ...string) error {
+	return m.Subscribe(chs...)
+}
+func (m *fake) ReceiveContext(ctx context.Context) (client.Response, error) {
+	return m.Receive()
+}
+func (m *fake) Kick(s string) error {
+	m.fn("Kick", s)
+	return nil
+}
+func (m *fake) Do(tag int64, cmd byte, arg string) error {
+	m.fn("Do", tag, cmd, arg)
+	return nil
+}
+func (m *fake) InfoWait() (*connection.Info, error) {
+	m.fn("InfoWait")
+	return &connection.Info{}, nil
+}
 func (m *fake) Close() error {
 	m.fn("Close")
 	return nil
 }
-func (m *fake) Receive() (interface{}, error) {
+func (m *fake) Receive() (client.Response, error) {
 	m.fn("Receive")
-	return "ok", nil
+	return &client.Reply{}, nil
 }
 func (m *fake) Recover(since, until int64) error {
 	m.fn("Recover", since, until)
@@ -131,3 +171,163 @@ func BenchmarkFireConn50delay50nano(b *testing.B) {
 
 	l.Close()
 }
+
+func TestSentResend(t *testing.T) {
+	now := time.Now()
+
+	s := &sent{ev: &client.Event{Name: "a.b"}, at: now.Add(-time.Hour)}
+	if ev, ok := s.resend(now); !ok || ev != s.ev {
+		t.Error("event without ttl must be resent as is")
+	}
+
+	s = &sent{ev: &client.Event{Name: "a.b", TTL: 10 * time.Second}, at: now.Add(-4 * time.Second)}
+	if ev, ok := s.resend(now); !ok || ev.TTL != 6*time.Second || s.ev.TTL != 10*time.Second {
+		t.Errorf("resend must reduce ttl %+v", ev)
+	}
+
+	if _, ok := s.resend(now.Add(6 * time.Second)); ok {
+		t.Error("expired event must not be resent")
+	}
+
+	s = &sent{ev: &client.Event{Name: "a.b", Delay: 10 * time.Second}, at: now.Add(-4 * time.Second)}
+	if ev, ok := s.resend(now); !ok || ev.Delay != 6*time.Second {
+		t.Errorf("resend must reduce delay %+v", ev)
+	}
+	if ev, ok := s.resend(now.Add(time.Minute)); !ok || ev.Delay != 0 {
+		t.Errorf("overdue event must be resent immediately %+v", ev)
+	}
+}
+
+func TestReceipt(t *testing.T) {
+
+	calls := make(chan string, 10)
+	l := New(client.NewPool(func() (client.Conn, error) {
+		return &fake{fn: func(v ...interface{}) {
+			if s, ok := v[0].(string); ok && s != "Err" {
+				calls <- s
+			}
+		}}, nil
+	}, 10))
+
+	r, err := l.FireToWait("app", "a.b", nil)
+	if err != nil || r.Status != "delivered" {
+		t.Errorf("FireToWait error %+v %v", r, err)
+	}
+	if _, err := l.FireEventWait(&client.Event{Name: "a.b"}); err == nil {
+		t.Error("broadcast must not wait receipt")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.FireEventWaitContext(ctx, &client.Event{Target: "app", Name: "a.b"}); err != context.Canceled {
+		t.Error("canceled ctx must not fire", err)
+	}
+
+	got := make(chan *client.Receipt, 1)
+	l.OnReceipt(func(e *client.Event, r *client.Receipt) { got <- r })
+	l.FireTo("app", "a.b", nil)
+	l.Fire("a.b", nil)
+	l.Close()
+
+	if r := <-got; r.Status != "delivered" {
+		t.Errorf("OnReceipt error %+v", r)
+	}
+	close(calls)
+	list := []string{}
+	for s := range calls {
+		list = append(list, s)
+	}
+	if fmt.Sprint(list) != "[Auth FireEventWait FireEventWait Fire]" {
+		t.Error("launcher calls error:", list)
+	}
+}
+
+// failConn 送出一定失敗
+type failConn struct {
+	fake
+}
+
+func (m *failConn) FireEvent(*client.Event) error { return errors.New("fake fire error") }
+func (m *failConn) Auth(int) error                { return errors.New("fake auth error") }
+func (m *failConn) Err() error                    { return errors.New("fake conn error") }
+
+func TestResult(t *testing.T) {
+
+	l := New(client.NewPool(func() (client.Conn, error) {
+		return &fake{fn: func(v ...interface{}) {}}, nil
+	}, 1))
+
+	ctx := context.Background()
+	broadcast := l.FireEventAsync(ctx, &client.Event{Name: "a.b"})
+	targeted := l.FireEventAsync(ctx, &client.Event{Target: "app", Name: "a.b"})
+	if err := l.Flush(ctx); err != nil {
+		t.Error("flush error", err)
+	}
+	if r, err := broadcast.Wait(ctx); r != nil || err != nil {
+		t.Error("broadcast result error", r, err)
+	}
+	if r, err := targeted.Wait(ctx); err != nil || r.Status != connection.ReceiptDelivered {
+		t.Error("targeted result must carry receipt", r, err)
+	}
+	if s := l.Stats(); s != (Stats{Queued: 2, Sent: 2}) {
+		t.Errorf("stats error %+v", s)
+	}
+	if err := l.Close(); err != nil {
+		t.Error("close error", err)
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+
+	l := New(client.NewPool(func() (client.Conn, error) {
+		return &failConn{fake{fn: func(v ...interface{}) {}}}, nil
+	}, 1))
+
+	res := l.FireEventAsync(context.Background(), &client.Event{Name: "a.b"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := l.Flush(ctx); err != context.DeadlineExceeded {
+		t.Error("expect flush deadline exceeded, but", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := l.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Error("expect close deadline exceeded, but", err)
+	}
+	if _, err := res.Wait(context.Background()); err != ErrDropped {
+		t.Error("expect dropped, but", err)
+	}
+	if s := l.Stats(); s.Queued != 1 || s.Sent != 0 || s.Dropped != 1 || s.Retried < 1 {
+		t.Errorf("stats error %+v", s)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dial := func() (client.Conn, error) { return &fake{fn: func(v ...interface{}) {}}, nil }
+	withOutbox, err := NewWithOutbox(client.NewPool(dial, 1), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []Launcher{New(client.NewPool(dial, 1)), withOutbox} {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Close 之後排入不會 panic
+		if err := l.Fire("a.b", nil); err != ErrClosed {
+			t.Error("fire after close expect ErrClosed, but", err)
+		}
+		if _, err := l.FireToWait("x", "a.b", nil); err != ErrClosed {
+			t.Error("wait after close expect ErrClosed, but", err)
+		}
+		res := l.FireEventAsync(context.Background(), &client.Event{Name: "a.b"})
+		if _, err := res.Wait(context.Background()); err != ErrClosed {
+			t.Error("async after close expect ErrClosed, but", err)
+		}
+	}
+}
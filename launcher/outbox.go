@@ -0,0 +1,348 @@
+package launcher
+
+import (
+	"bufio"
+	"container/list"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/colindev/events/client"
+	"github.com/colindev/events/event"
+)
+
+// OutboxFile outbox 目錄下的檔案名稱
+const OutboxFile = "outbox.log"
+
+// 累計 ack 超過此數量時重寫檔案, 只保留未送出的事件
+const compactAfter = 1000
+
+// record outbox 檔案中的一行 (JSON), Ack 為 true 時表示 Seq 已送出
+type record struct {
+	Seq   int64
+	At    time.Time     `json:",omitempty"`
+	Event *client.Event `json:",omitempty"`
+	Ack   bool          `json:",omitempty"`
+	// 本次啟動時排入的事件才有
+	res *Result
+	// 從檔案讀回失敗
+	err error
+}
+
+// entry 未 ack 的事件在檔案中的位置, 事件內容送出前才從檔案讀回
+type entry struct {
+	seq int64
+	off int64
+	n   int
+	res *Result
+}
+
+// outbox 事件送出前先附加到檔案, 送出後再附加 ack 紀錄
+// 記憶體只保留未 ack 事件的位置, 重新開啟時依序取回沒有 ack 的事件
+type outbox struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	// 檔案長度, 即下一筆紀錄的位置
+	end int64
+	// push 後是否 fsync
+	sync bool
+	// 測試時替換
+	fsync func(*os.File) error
+	seq   int64
+	// 未 ack 的事件 (*entry), 依寫入順序
+	pending *list.List
+	index   map[int64]*list.Element
+	// 下一筆要送出的事件, nil 表示都已取出
+	cursor *list.Element
+	acked  int
+	notify chan struct{}
+	closed bool
+}
+
+func openOutbox(dir string) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	o := &outbox{
+		path:    filepath.Join(dir, OutboxFile),
+		sync:    true,
+		fsync:   (*os.File).Sync,
+		pending: list.New(),
+		index:   map[int64]*list.Element{},
+		notify:  make(chan struct{}, 1),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	// 啟動時先整理一次, 順便去除寫到一半的紀錄
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	o.cursor = o.pending.Front()
+
+	return o, nil
+}
+
+func (o *outbox) load() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var off int64
+	for {
+		line, err := r.ReadBytes('\n')
+		// 無法解析的紀錄 (ex: 當機時寫到一半) 略過
+		var rec record
+		if n := len(line); n > 0 && line[n-1] == '\n' && event.Unmarshal(line, &rec) == nil && rec.Seq > 0 {
+			if rec.Seq > o.seq {
+				o.seq = rec.Seq
+			}
+			if rec.Ack {
+				if el, ok := o.index[rec.Seq]; ok {
+					o.pending.Remove(el)
+					delete(o.index, rec.Seq)
+				}
+			} else if rec.Event != nil {
+				o.index[rec.Seq] = o.pending.PushBack(&entry{seq: rec.Seq, off: off, n: n})
+			}
+		}
+		off += int64(len(line))
+		if err != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+// compact 以未 ack 的事件重寫檔案, 需在 o.mu 內呼叫
+func (o *outbox) compact() error {
+	src := o.f
+	if src == nil && o.pending.Len() > 0 {
+		f, err := os.Open(o.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+
+	tmp := o.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	// 寫入成功才更新位置
+	offs := make([]int64, 0, o.pending.Len())
+	var end int64
+	w := bufio.NewWriter(f)
+	for el := o.pending.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*entry)
+		p := make([]byte, e.n)
+		if _, err = src.ReadAt(p, e.off); err != nil {
+			break
+		}
+		if _, err = w.Write(p); err != nil {
+			break
+		}
+		offs = append(offs, end)
+		end += int64(e.n)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+
+	i := 0
+	for el := o.pending.Front(); el != nil; el = el.Next() {
+		el.Value.(*entry).off = offs[i]
+		i++
+	}
+	if o.f != nil {
+		o.f.Close()
+	}
+	o.f, err = os.OpenFile(o.path, os.O_RDWR|os.O_APPEND, 0644)
+	o.end = end
+	o.acked = 0
+	return err
+}
+
+func encodeRecord(rec *record) ([]byte, error) {
+	p, err := event.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return append(p, '\n'), nil
+}
+
+// write 附加一筆紀錄, 回傳寫入的位置與長度, 需在 o.mu 內呼叫
+func (o *outbox) write(rec *record) (int64, int, error) {
+	if o.closed {
+		return 0, 0, ErrClosed
+	}
+	p, err := encodeRecord(rec)
+	if err != nil {
+		return 0, 0, err
+	}
+	off := o.end
+	if _, err := o.f.Write(p); err != nil {
+		// 可能寫入一部份, 捨棄以免與下一筆紀錄接在同一行
+		o.truncate(off)
+		return 0, 0, err
+	}
+	o.end += int64(len(p))
+	return off, len(p), nil
+}
+
+// truncate 捨棄 off 之後的紀錄, 需在 o.mu 內呼叫
+// 失敗時紀錄仍在檔案中, 重新啟動後可能送出
+func (o *outbox) truncate(off int64) {
+	if err := o.f.Truncate(off); err != nil {
+		if end, e := o.f.Seek(0, io.SeekEnd); e == nil {
+			o.end = end
+		}
+		return
+	}
+	o.end = off
+}
+
+// read 從檔案讀回事件, 需在 o.mu 內呼叫
+func (o *outbox) read(e *entry) *record {
+	rec := &record{}
+	p := make([]byte, e.n)
+	if o.closed {
+		rec.err = ErrClosed
+	} else if _, err := o.f.ReadAt(p, e.off); err != nil {
+		rec.err = err
+	} else if err := event.Unmarshal(p, rec); err != nil {
+		rec.err = err
+	}
+	rec.Seq, rec.res = e.seq, e.res
+	return rec
+}
+
+// push 寫入檔案 (預設 fsync) 後才排入待送
+func (o *outbox) push(e *client.Event, res *Result) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	seq := o.seq + 1
+	off, n, err := o.write(&record{Seq: seq, At: time.Now(), Event: e})
+	if err != nil {
+		return err
+	}
+	if o.sync {
+		if err := o.fsync(o.f); err != nil {
+			// 回報失敗的事件不留在檔案中, 避免重新啟動後送出
+			o.truncate(off)
+			return err
+		}
+	}
+	o.seq = seq
+	el := o.pending.PushBack(&entry{seq: seq, off: off, n: n, res: res})
+	o.index[seq] = el
+	if o.cursor == nil {
+		o.cursor = el
+	}
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// setSync 設定 push 後是否 fsync
+func (o *outbox) setSync(b bool) {
+	o.mu.Lock()
+	o.sync = b
+	o.mu.Unlock()
+}
+
+// next 依序從檔案讀回下一筆待送的事件, quit 關閉後取完剩下的才回傳 false
+// 讀回失敗時 rec.err 不為 nil
+func (o *outbox) next(quit <-chan struct{}) (*record, bool) {
+	for {
+		o.mu.Lock()
+		if el := o.cursor; el != nil {
+			o.cursor = el.Next()
+			rec := o.read(el.Value.(*entry))
+			o.mu.Unlock()
+			return rec, true
+		}
+		o.mu.Unlock()
+
+		select {
+		case <-o.notify:
+		case <-quit:
+			o.mu.Lock()
+			empty := o.cursor == nil
+			o.mu.Unlock()
+			if empty {
+				return nil, false
+			}
+		}
+	}
+}
+
+// ack 事件已送出, 從待送中移除
+// ack 紀錄不 fsync, 當機時可能重送已送出的事件
+func (o *outbox) ack(seq int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	el, ok := o.index[seq]
+	if !ok {
+		return nil
+	}
+	if _, _, err := o.write(&record{Seq: seq, Ack: true}); err != nil {
+		return err
+	}
+	o.pending.Remove(el)
+	delete(o.index, seq)
+
+	if o.acked++; o.acked >= compactAfter {
+		return o.compact()
+	}
+	return nil
+}
+
+// size 未 ack 的事件數
+func (o *outbox) size() int {
+	o.mu.Lock()
+	n := o.pending.Len()
+	o.mu.Unlock()
+	return n
+}
+
+// close 之後 push/ack 回傳 ErrClosed
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.f.Close()
+}
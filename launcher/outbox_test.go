@@ -0,0 +1,305 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/colindev/events/client"
+	"github.com/colindev/events/event"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := o.push(&client.Event{Name: event.Event(name), Data: event.RawData(name)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quit := make(chan struct{})
+	rec, _ := o.next(quit)
+	o.ack(rec.Seq)
+	o.next(quit)
+	o.close()
+
+	// 模擬當機時寫到一半的紀錄
+	f, _ := os.OpenFile(filepath.Join(dir, OutboxFile), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"Seq":4,"Eve`)
+	f.Close()
+
+	o, err = openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	if n := o.size(); n != 2 {
+		t.Fatal("expect 2 pending events, but", n)
+	}
+	o.push(&client.Event{Name: "d"}, nil)
+
+	close(quit)
+	list := []string{}
+	for {
+		rec, ok := o.next(quit)
+		if !ok {
+			break
+		}
+		list = append(list, fmt.Sprintf("%d:%s", rec.Seq, rec.Event.Name))
+	}
+	// 已取出但沒有 ack 的事件重新開啟後要再送一次
+	if fmt.Sprint(list) != "[2:b 3:c 4:d]" {
+		t.Error("replay order error", list)
+	}
+}
+
+func TestOutbox_syncFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.push(&client.Event{Name: "a"}, nil)
+	o.fsync = func(*os.File) error { return errors.New("fsync fail") }
+	if err := o.push(&client.Event{Name: "b"}, nil); err == nil {
+		t.Fatal("push must fail")
+	}
+	o.fsync = (*os.File).Sync
+	o.push(&client.Event{Name: "c"}, nil)
+	o.close()
+
+	// 回報失敗的事件不留在檔案中
+	o, err = openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	quit := make(chan struct{})
+	close(quit)
+	list := []string{}
+	for {
+		rec, ok := o.next(quit)
+		if !ok {
+			break
+		}
+		list = append(list, fmt.Sprintf("%d:%s", rec.Seq, rec.Event.Name))
+	}
+	if fmt.Sprint(list) != "[1:a 2:c]" {
+		t.Error("failed push must be discarded", list)
+	}
+}
+
+func TestOutbox_compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.setSync(false)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		o.push(&client.Event{Name: event.Event(name), Data: event.RawData(name)}, nil)
+	}
+	quit := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		rec, _ := o.next(quit)
+		o.ack(rec.Seq)
+	}
+	// 重寫檔案後依新的位置讀回
+	o.mu.Lock()
+	err = o.compact()
+	o.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.push(&client.Event{Name: "f"}, nil)
+
+	close(quit)
+	list := []string{}
+	for {
+		rec, ok := o.next(quit)
+		if !ok {
+			break
+		}
+		if rec.err != nil {
+			t.Fatal(rec.err)
+		}
+		list = append(list, fmt.Sprintf("%d:%s:%s", rec.Seq, rec.Event.Name, rec.Event.Data))
+	}
+	o.close()
+	if fmt.Sprint(list) != "[3:c:c 4:d:d 5:e:e 6:f:]" {
+		t.Error("read after compact error", list)
+	}
+}
+
+func TestNewWithOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 上次結束前沒送出的事件, 過期的不送
+	o, err := openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.push(&client.Event{Name: "old.a"}, nil)
+	o.push(&client.Event{Name: "old.expired", TTL: time.Nanosecond}, nil)
+	o.push(&client.Event{Name: "old.b"}, nil)
+	o.close()
+	time.Sleep(time.Millisecond)
+
+	var (
+		mu    sync.Mutex
+		fired []string
+	)
+	l, err := NewWithOutbox(client.NewPool(func() (client.Conn, error) {
+		return &fake{fn: func(v ...interface{}) {
+			if v[0] == "Fire" {
+				mu.Lock()
+				fired = append(fired, string(v[1].(event.Event)))
+				mu.Unlock()
+			}
+		}}, nil
+	}, 1), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Fire("new.c", nil)
+	if err := l.Close(); err != nil {
+		t.Error("close error", err)
+	}
+
+	if fmt.Sprint(fired) != "[old.a old.b new.c]" {
+		t.Error("outbox replay error", fired)
+	}
+	o, err = openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	if n := o.size(); n != 0 {
+		t.Error("sent events must be removed from outbox, but", n)
+	}
+}
+
+// flakyConn 第一次送出 name 時失敗
+type flakyConn struct {
+	fake
+	name string
+	fail *int32
+	tag  int64
+}
+
+func (m *flakyConn) FireEvent(e *client.Event) error {
+	if string(e.Name) == m.name && atomic.CompareAndSwapInt32(m.fail, 0, 1) {
+		return errors.New("fake fire error")
+	}
+	return m.fake.FireEvent(e)
+}
+func (m *flakyConn) Err() error { return nil }
+
+// 放回連線池時的 reset 回應同樣的編號
+func (m *flakyConn) Do(tag int64, cmd byte, arg string) error {
+	m.tag = tag
+	return nil
+}
+func (m *flakyConn) ReceiveContext(context.Context) (client.Response, error) {
+	return &client.Tagged{Tag: m.tag, Response: &client.Reply{}}, nil
+}
+
+func TestNewWithOutbox_reconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		mu    sync.Mutex
+		fired []string
+		fail  int32
+	)
+	l, err := NewWithOutbox(client.NewPool(func() (client.Conn, error) {
+		return &flakyConn{fake: fake{fn: func(v ...interface{}) {
+			if v[0] == "Fire" {
+				mu.Lock()
+				fired = append(fired, string(v[1].(event.Event)))
+				mu.Unlock()
+			}
+		}}, name: "b", fail: &fail}, nil
+	}, 1), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Fire("a", nil)
+	l.Fire("b", nil)
+
+	// 有 outbox 時重連後不等待, 也不重送斷線前的事件
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := l.CloseContext(ctx); err != nil {
+		t.Error("close error", err)
+	}
+	if fmt.Sprint(fired) != "[a b]" {
+		t.Error("reconnect with outbox must not resend cache", fired)
+	}
+}
+
+func TestNewWithOutbox_closeTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewWithOutbox(client.NewPool(func() (client.Conn, error) {
+		return &failConn{fake{fn: func(v ...interface{}) {}}}, nil
+	}, 1), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Fire("a.b", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := l.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Error("expect close deadline exceeded, but", err)
+	}
+	l.Flush(context.Background())
+
+	// 逾時放棄的事件留在 outbox, 下次啟動再送
+	o, err := openOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	if n := o.size(); n != 1 {
+		t.Error("dropped event must be kept in outbox, but", n)
+	}
+}
@@ -1,10 +1,13 @@
 package listener
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,10 +21,13 @@ type (
 	Listener interface {
 		On(event.Event, ...event.Handler) Listener
 		Recover(int64, int64) error
+		RecoverWait(int64, int64) (int, error)
 		Trigger(event.Event, event.RawData)
 		TriggerRecover(func(interface{}))
 		Run(channels ...interface{}) error
+		RunContext(context.Context, ...interface{}) error
 		RunForever(chan os.Signal, time.Duration, ...interface{}) Listener
+		RunForeverContext(context.Context, time.Duration, ...interface{}) Listener
 		WaitHandler() error
 		Ping(string) error
 		Info() error
@@ -32,10 +38,13 @@ type (
 		*sync.RWMutex
 		conn           client.Conn
 		chs            []string
-		dial           func() (client.Conn, error)
+		dial           func(context.Context) (client.Conn, error)
 		running        bool
 		events         map[event.Event][]event.Handler
 		triggerRecover func(interface{})
+		// 等待回應的 RecoverWait, 以請求編號對應
+		recoverTag   int64
+		recoverWaits map[int64]chan client.Response
 	}
 )
 
@@ -48,6 +57,13 @@ var (
 
 // New return Listener instansce
 func New(dial func() (client.Conn, error)) Listener {
+	return NewContext(func(context.Context) (client.Conn, error) {
+		return dial()
+	})
+}
+
+// NewContext 同 New, dial 會收到 RunContext 的 ctx (ex: client.DialContext)
+func NewContext(dial func(context.Context) (client.Conn, error)) Listener {
 	return &listener{
 		wg:      &sync.WaitGroup{},
 		RWMutex: &sync.RWMutex{},
@@ -75,13 +91,18 @@ func (l *listener) setConn(conn client.Conn) {
 }
 
 func (l *listener) Run(channels ...interface{}) error {
+	return l.RunContext(context.Background(), channels...)
+}
+
+// RunContext 同 Run, ctx 結束時關閉連線並回傳 ctx.Err()
+func (l *listener) RunContext(ctx context.Context, channels ...interface{}) error {
 
 	var (
 		err  error
-		dial func() (client.Conn, error)
+		dial func(context.Context) (client.Conn, error)
 	)
 
-	dial, err = func() (func() (client.Conn, error), error) {
+	dial, err = func() (func(context.Context) (client.Conn, error), error) {
 		l.Lock()
 		defer l.Unlock()
 		if l.running {
@@ -94,7 +115,13 @@ func (l *listener) Run(channels ...interface{}) error {
 
 	defer func() {
 		// 斷線的話就重新設定 running = false
+		l.Lock()
 		l.running = false
+		for _, ch := range l.recoverWaits {
+			close(ch)
+		}
+		l.recoverWaits = nil
+		l.Unlock()
 		var rd event.RawData
 		if err != nil {
 			rd = event.RawData(err.Error())
@@ -108,13 +135,24 @@ func (l *listener) Run(channels ...interface{}) error {
 
 	// 建立連線
 	l.Trigger(event.Connecting, nil)
-	conn, err := dial()
+	conn, err := dial(ctx)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 	l.setConn(conn)
 
+	// ctx 結束時關閉連線, 中斷阻塞中的 Receive
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
 	// 登入名稱
 	if err := conn.Auth(connection.Readable); err != nil {
 		return err
@@ -140,21 +178,33 @@ func (l *listener) Run(channels ...interface{}) error {
 	}
 	l.chs = convChans
 
-	padding := len(l.chs)
+	// 每個頻道的訂閱回應都收到後觸發 Ready
+	// server 回應的頻道名稱已去除前後空白, 比對前同樣處理
+	pending := map[string]bool{}
+	for _, ch := range l.chs {
+		pending[strings.TrimSpace(ch)] = true
+	}
 	for {
-		var m interface{}
+		var m client.Response
 		m, err = conn.Receive()
 		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
 			return err
 		}
 
 		switch m := m.(type) {
 		case *client.Event:
 			go l.Trigger(m.Name, m.Data)
+		case *client.Tagged:
+			if !l.recoverDone(m) {
+				log.Printf("[event] unexpect tagged %d %#v\n", m.Tag, m.Response)
+			}
 		case *client.Reply:
-			if padding > 0 {
-				padding--
-				if padding == 0 {
+			if args := m.Args(); len(pending) > 0 && m.Command() == "subscribe" && len(args) > 0 && pending[args[0]] {
+				delete(pending, args[0])
+				if len(pending) == 0 {
 					go l.Trigger(event.Ready, nil)
 				}
 			}
@@ -180,35 +230,97 @@ func (l *listener) WaitHandler() error {
 
 func (l *listener) RunForever(quit chan os.Signal, reconnDuration time.Duration, chs ...interface{}) Listener {
 
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		s := <-quit
-		l.RLock()
-		conn := l.conn
-		l.RUnlock()
-		if conn != nil {
-			conn.Close()
-		}
-		quit <- s
+		<-quit
+		cancel()
 	}()
 
-	for {
+	return l.RunForeverContext(ctx, reconnDuration, chs...)
+}
+
+// RunForeverContext 斷線後間隔 reconnDuration 重新連線, 直到 ctx 結束
+// 不改用 client.NewResilient: 每次重連都要重新觸發 Connecting / Connected / Disconnected,
+// 由 handler 決定 recover 的起點 (ex: RecoverWait), 在同一個 Receive 中續讀會略過這些事件
+func (l *listener) RunForeverContext(ctx context.Context, reconnDuration time.Duration, chs ...interface{}) Listener {
+
+	for ctx.Err() == nil {
+		l.RunContext(ctx, chs...)
 		select {
-		case <-quit:
-			return l
-		default:
-			l.Run(chs...)
-			time.Sleep(reconnDuration)
+		case <-ctx.Done():
+		case <-time.After(reconnDuration):
 		}
 	}
+
+	return l
 }
 
-// Recover 包裝 conn Recover / RecoverSince
-// i 小於等於 0 時, 調用 conn.Recover() 讓 server 處理還原時間點
-// i 大於 0 時, 調用 onn.RecoverSince(timestamp) 由 client 決定還原時間點
+// Recover 包裝 conn Recover, since/until 為 unix nano
+// since 等於 0 時, 讓 server 以上次斷線時間點還原
+// until 小於等於 0 時, 還原到當下
 func (l *listener) Recover(since, until int64) error {
 	return l.conn.Recover(since, until)
 }
 
+// RecoverWait 同 Recover, 等到 server 送出 recover.end 後回傳重送的事件數 (含收件匣)
+// 以帶編號的請求送出, 依回應 recover OK {n} 的編號對應, 同時多個 RecoverWait 也不會錯置
+// 需在 Run 執行中呼叫, 斷線時回傳 ErrListenerNotRunning
+func (l *listener) RecoverWait(since, until int64) (int, error) {
+	ch := make(chan client.Response, 1)
+	l.Lock()
+	conn := l.conn
+	if !l.running || conn == nil {
+		l.Unlock()
+		return 0, ErrListenerNotRunning
+	}
+	l.recoverTag++
+	tag := l.recoverTag
+	if l.recoverWaits == nil {
+		l.recoverWaits = map[int64]chan client.Response{}
+	}
+	l.recoverWaits[tag] = ch
+	l.Unlock()
+
+	arg := connection.FormatTimestamp(since) + ":" + connection.FormatTimestamp(until)
+	if err := conn.Do(tag, connection.CRecover, arg); err != nil {
+		l.removeRecoverWait(tag)
+		return 0, err
+	}
+
+	res, ok := <-ch
+	if !ok {
+		return 0, ErrListenerNotRunning
+	}
+	switch res := res.(type) {
+	case *connection.Error:
+		return 0, res
+	case *client.Reply:
+		if args := res.Args(); res.Command() == "recover" && len(args) == 2 && args[0] == "OK" {
+			return strconv.Atoi(args[1])
+		}
+	}
+	return 0, fmt.Errorf("[events] unexpect recover response %v", res)
+}
+
+// recoverDone 把帶編號的回應交給對應的 RecoverWait, 沒有對應時回傳 false
+func (l *listener) recoverDone(m *client.Tagged) bool {
+	l.Lock()
+	defer l.Unlock()
+	ch, ok := l.recoverWaits[m.Tag]
+	if !ok {
+		return false
+	}
+	delete(l.recoverWaits, m.Tag)
+	ch <- m.Response
+	return true
+}
+
+func (l *listener) removeRecoverWait(tag int64) {
+	l.Lock()
+	delete(l.recoverWaits, tag)
+	l.Unlock()
+}
+
 func (l *listener) Trigger(ev event.Event, rd event.RawData) {
 
 	l.RLock()
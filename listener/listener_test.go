@@ -2,6 +2,8 @@ package listener
 
 import (
 	"bufio"
+	"context"
+	"io"
 	"math/rand"
 	"net"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"github.com/colindev/events/client"
+	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
 )
 
@@ -19,8 +22,9 @@ type fConn struct {
 	r *bufio.Reader
 }
 
-func (f *fConn) Receive() (interface{}, error) {
-	return f.r.ReadSlice('\n')
+func (f *fConn) Receive() (client.Response, error) {
+	line, err := f.r.ReadSlice('\n')
+	return &client.Unknown{Line: line}, err
 }
 func (f *fConn) Close() error                                    { return nil }
 func (f *fConn) Recover(int64, int64) error                      { return nil }
@@ -29,10 +33,27 @@ func (f *fConn) Subscribe(...string) error                       { return nil }
 func (f *fConn) Unsubscribe(...string) error                     { return nil }
 func (f *fConn) Fire(event.Event, event.RawData) error           { return nil }
 func (f *fConn) FireTo(string, event.Event, event.RawData) error { return nil }
-func (f *fConn) Ping(string) error                               { return nil }
-func (f *fConn) Info() error                                     { return nil }
-func (f *fConn) Conn() net.Conn                                  { return nil }
-func (f *fConn) Err() error                                      { return nil }
+func (f *fConn) FireEvent(*client.Event) error                   { return nil }
+func (f *fConn) FireEventWait(*client.Event) (*client.Receipt, error) {
+	return nil, nil
+}
+func (f *fConn) Ping(string) error                                     { return nil }
+func (f *fConn) Info() error                                           { return nil }
+func (f *fConn) Kick(string) error                                     { return nil }
+func (f *fConn) Do(int64, byte, string) error                          { return nil }
+func (f *fConn) Conn() net.Conn                                        { return nil }
+func (f *fConn) Err() error                                            { return nil }
+func (f *fConn) FireEventContext(context.Context, *client.Event) error { return nil }
+func (f *fConn) SubscribeContext(context.Context, ...string) error     { return nil }
+func (f *fConn) ReceiveContext(context.Context) (client.Response, error) {
+	return f.Receive()
+}
+func (f *fConn) InfoWait() (*connection.Info, error) {
+	return nil, nil
+}
+func (f *fConn) Query(connection.Query) (*client.Result, error) {
+	return nil, nil
+}
 
 func TestListener(t *testing.T) {
 	l := New(func() (client.Conn, error) { return nil, nil })
@@ -87,3 +108,166 @@ func TestListener_RunForever(t *testing.T) {
 		t.Error("reconn:", trigged)
 	}
 }
+
+// recoverConn 收到帶編號的 recover 時回傳 recover.end 與 recover OK
+// reqs 不為 nil 時改由測試決定回應
+type recoverConn struct {
+	fConn
+	ch   chan client.Response
+	reqs chan *client.Tagged
+	once sync.Once
+}
+
+func (f *recoverConn) Close() error {
+	f.once.Do(func() { close(f.ch) })
+	return nil
+}
+
+func (f *recoverConn) Receive() (client.Response, error) {
+	v, ok := <-f.ch
+	if !ok {
+		return nil, io.EOF
+	}
+	return v, nil
+}
+func (f *recoverConn) Do(tag int64, cmd byte, arg string) error {
+	if cmd != connection.CRecover {
+		return nil
+	}
+	if f.reqs != nil {
+		f.reqs <- &client.Tagged{Tag: tag, Response: client.NewReply(arg)}
+		return nil
+	}
+	rd, _ := event.Marshal(connection.RecoverReport{Count: 3, Inbox: 1})
+	f.ch <- &client.Event{Name: event.RecoverEnd, Data: rd}
+	f.ch <- &client.Tagged{Tag: tag, Response: client.NewReply("recover OK 4")}
+	return nil
+}
+
+func TestListener_RecoverWait(t *testing.T) {
+	fc := &recoverConn{ch: make(chan client.Response, 2)}
+	l := New(func() (client.Conn, error) { return fc, nil })
+
+	if _, err := l.RecoverWait(1, 2); err != ErrListenerNotRunning {
+		t.Error("expect ErrListenerNotRunning, but", err)
+	}
+
+	ended := make(chan event.RawData, 1)
+	l.On(event.RecoverEnd, func(ev event.Event, rd event.RawData) {
+		ended <- rd
+	})
+	ready := make(chan struct{})
+	l.On(event.Ready, func(event.Event, event.RawData) {
+		close(ready)
+	})
+	done := make(chan error)
+	go func() { done <- l.Run("a") }()
+	fc.ch <- client.NewReply("subscribe b OK")
+	fc.ch <- client.NewReply("subscribe a OK")
+	<-ready
+
+	if n, err := l.RecoverWait(1, 2); n != 4 || err != nil {
+		t.Error("RecoverWait error", n, err)
+	}
+	if rd := <-ended; !strings.Contains(rd.String(), `"Count":3`) {
+		t.Error("recover.end event error", rd.String())
+	}
+
+	fc.Close()
+	<-done
+	l.WaitHandler()
+}
+
+func TestListener_ReadyTrimSpace(t *testing.T) {
+	fc := &recoverConn{ch: make(chan client.Response, 1)}
+	l := New(func() (client.Conn, error) { return fc, nil })
+
+	ready := make(chan struct{})
+	l.On(event.Ready, func(event.Event, event.RawData) {
+		close(ready)
+	})
+	done := make(chan error)
+	go func() { done <- l.Run(" a ") }()
+	// server 回應的頻道已去除空白
+	fc.ch <- client.NewReply("subscribe a OK")
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Error("ready must be triggered")
+	}
+
+	fc.Close()
+	<-done
+	l.WaitHandler()
+}
+
+func TestListener_RecoverWaitTagged(t *testing.T) {
+	fc := &recoverConn{ch: make(chan client.Response), reqs: make(chan *client.Tagged)}
+	l := New(func() (client.Conn, error) { return fc, nil })
+
+	ready := make(chan struct{})
+	l.On(event.Ready, func(event.Event, event.RawData) {
+		close(ready)
+	})
+	done := make(chan error)
+	go func() { done <- l.Run("a") }()
+	fc.ch <- client.NewReply("subscribe a OK")
+	<-ready
+
+	type result struct {
+		n   int
+		err error
+	}
+	results := map[int64]chan result{}
+	reqs := map[string]int64{}
+	for _, since := range []int64{1, 2, 3} {
+		ch := make(chan result, 1)
+		results[since] = ch
+		go func(since int64) {
+			n, err := l.RecoverWait(since*int64(time.Second), 0)
+			ch <- result{n, err}
+		}(since)
+		req := <-fc.reqs
+		reqs[req.Response.(*client.Reply).String()] = req.Tag
+	}
+
+	// 回應順序與請求不同, 依編號對應
+	fc.ch <- &client.Tagged{Tag: reqs["3:0"], Response: client.NewReply("recover OK 30")}
+	fc.ch <- &client.Tagged{Tag: reqs["2:0"], Response: connection.NewError("", "recover failed")}
+	fc.ch <- &client.Tagged{Tag: reqs["1:0"], Response: client.NewReply("recover OK 10")}
+
+	if r := <-results[1]; r.n != 10 || r.err != nil {
+		t.Error("RecoverWait(1) error", r)
+	}
+	if r := <-results[2]; r.n != 0 || r.err == nil || !strings.Contains(r.err.Error(), "recover failed") {
+		t.Error("RecoverWait(2) must return error", r)
+	}
+	if r := <-results[3]; r.n != 30 || r.err != nil {
+		t.Error("RecoverWait(3) error", r)
+	}
+
+	fc.Close()
+	<-done
+}
+
+func TestListener_RunContext(t *testing.T) {
+	fc := &recoverConn{ch: make(chan client.Response)}
+	l := New(func() (client.Conn, error) { return fc, nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.RunContext(ctx, "a") }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Error("RunContext expect canceled, but", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunContext must return after cancel")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	l.RunForeverContext(ctx, time.Millisecond*10, "a")
+}
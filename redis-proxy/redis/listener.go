@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"log"
 	"os"
@@ -43,6 +44,10 @@ func (l *Listener) Recover(int64, int64) error {
 	return errors.New("not support")
 }
 
+func (l *Listener) RecoverWait(int64, int64) (int, error) {
+	return 0, errors.New("not support")
+}
+
 func (l *Listener) On(ev event.Event, hs ...event.Handler) eventsListener.Listener {
 	l.Lock()
 	defer l.Unlock()
@@ -56,6 +61,11 @@ func (l *Listener) On(ev event.Event, hs ...event.Handler) eventsListener.Listen
 }
 
 func (l *Listener) Run(channels ...interface{}) (err error) {
+	return l.RunContext(context.Background(), channels...)
+}
+
+// RunContext 同 Run, ctx 結束時關閉連線並回傳 ctx.Err()
+func (l *Listener) RunContext(ctx context.Context, channels ...interface{}) (err error) {
 
 	err = func() error {
 		l.Lock()
@@ -78,6 +88,16 @@ func (l *Listener) Run(channels ...interface{}) (err error) {
 	conn := l.pool.Get()
 	defer conn.Close()
 	l.psc.Conn = conn
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
 	err = l.psc.PSubscribe(channels...)
 	if err != nil {
 		return
@@ -95,6 +115,9 @@ func (l *Listener) Run(channels ...interface{}) (err error) {
 		case x.Subscription:
 			log.Println("[events]", m)
 		case error:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return m
 		}
 	}
@@ -120,6 +143,20 @@ func (l *Listener) RunForever(quit chan os.Signal, reconn time.Duration, chs ...
 	return l
 }
 
+// RunForeverContext 斷線後間隔 reconn 重新連線, 直到 ctx 結束
+func (l *Listener) RunForeverContext(ctx context.Context, reconn time.Duration, chs ...interface{}) eventsListener.Listener {
+
+	for ctx.Err() == nil {
+		l.RunContext(ctx, chs...)
+		select {
+		case <-ctx.Done():
+		case <-time.After(reconn):
+		}
+	}
+
+	return l
+}
+
 func (l *Listener) Trigger(ev event.Event, rd event.RawData) {
 
 	l.RLock()
@@ -3,12 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"fmt"
-	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/colindev/events/connection"
@@ -18,6 +17,7 @@ import (
 
 // Conn 包裝 net.Conn (TCP) 連線
 type Conn interface {
+	ID() int64
 	SetName(string)
 	GetName() string
 	HasName() bool
@@ -42,20 +42,84 @@ type Conn interface {
 	Close(error) error
 	SendError(error)
 	SendReply(string)
+	SendReceipt(int64, int, string)
 	SendPong([]byte)
+	SendRow(int64, *store.Event)
+	SendQueryEnd(int64, int, connection.Position)
 	SendEvent(e string)
+	PublishEvent(*store.Event)
+	BeginRecover(time.Time)
+	ReplayEvent(*store.Event)
+	EndRecover() int
+	Reset(time.Time)
 }
 
-// ConnStatus contain conn status
-type ConnStatus struct {
-	Channel  []event.Event
-	Name     string
-	LastAuth store.Auth `json:",omitempty"`
-	Flag     int
+// ConnStatus contain conn status, 同 info 事件的連線資料
+type ConnStatus = connection.ConnInfo
+
+// 最後配發的連線 ID
+var lastConnID int64
+
+// 事件從產生到送給連線的最大延遲, recover 去重時往前多記錄這段時間
+const recoverDedupeWindow = time.Second * 10
+
+// 記錄最近即時送出的事件數, recover 時略過已送過的
+const liveDedupeSize = 1024
+
+// recover 期間暫存即時事件的上限, 超過時送出錯誤並中斷連線, 由 client 重新連線後 recover
+var recoverPendingSize = 10000
+
+// 關閉連線時排隊中的資料最多再送的時間, 也是被 kick 的連線等待錯誤訊息送出的時間
+var closeTimeout = time.Second
+
+// liveEvent 暫存的即時事件, seq 為 0 表示不在事件流中 (ex: join/leave)
+type liveEvent struct {
+	raw string
+	seq int64
+	// 事件流中的事件, 送給 Meta 連線時附帶 header
+	e *store.Event
+}
+
+// recoverBuffer recover 期間暫存即時事件, 重送完再依序送出沒重送過的
+type recoverBuffer struct {
+	// 開始 recover 的時間 (unix nano)
+	start   int64
+	pending []liveEvent
+	// 接近 start 之後重送過的事件 seq
+	replayed map[int64]bool
+	// 暫存超過上限, 連線關閉中
+	overflow bool
+}
+
+// seqRing 保留最近 n 個 seq
+type seqRing struct {
+	list []int64
+	next int
+	set  map[int64]bool
+}
+
+func newSeqRing(n int) *seqRing {
+	return &seqRing{list: make([]int64, n), set: map[int64]bool{}}
+}
+
+func (r *seqRing) add(seq int64) {
+	delete(r.set, r.list[r.next])
+	r.list[r.next] = seq
+	r.set[seq] = true
+	r.next = (r.next + 1) % len(r.list)
+}
+
+func (r *seqRing) has(seq int64) bool {
+	return r.set[seq]
 }
 
 type conn struct {
+	// 收到 / 送出的事件數
+	received int64
+	sent     int64
 	sync.RWMutex
+	// server 啟動後配發, 不重複
+	id     int64
 	conn   net.Conn
 	w      *bufio.Writer
 	r      *bufio.Reader
@@ -71,19 +135,33 @@ type conn struct {
 	sync.WaitGroup
 	closed  bool
 	streams chan *bytes.Buffer
+	// Close 時關閉, 通知 send/reduce 不再等待 streams
+	doneOnce sync.Once
+	done     chan struct{}
+
+	// 保護 recovering/live, 並讓暫存與送出的順序一致
+	rmu        sync.Mutex
+	recovering *recoverBuffer
+	live       *seqRing
 }
 
 func newConn(c net.Conn, t time.Time) Conn {
 	return &conn{
+		id:          atomic.AddInt64(&lastConnID, 1),
 		conn:        c,
 		w:           bufio.NewWriter(c),
 		r:           bufio.NewReader(c),
 		chs:         map[event.Event]bool{},
-		connectedAt: t.Unix(),
+		connectedAt: t.UnixNano(),
 		streams:     make(chan *bytes.Buffer, 20),
 	}
 }
 
+// ID 連線 ID, 匿名連線也有
+func (c *conn) ID() int64 {
+	return c.id
+}
+
 // SetLastAuth 注入上一次登入紀錄
 func (c *conn) SetLastAuth(a *store.Auth) {
 	c.Lock()
@@ -127,13 +205,9 @@ func (c *conn) SetFlags(flags int) {
 	c.Lock()
 	defer c.Unlock()
 
-	// 如果 client 不指定讀取權限
-	// 就轉導 write buffer 到 ioutil.Discard
-	if flags&connection.Readable > 0 {
-		c.w = bufio.NewWriter(c.conn)
-	} else {
-		c.w = bufio.NewWriter(ioutil.Discard)
-	}
+	// 沒有讀取權限但帶 Reply 的 client 仍會收到回覆/錯誤/指定傳送結果, 事件由 SendEvent 略過
+	// 都沒有的唯寫連線 (舊版 client 不讀取) 由 send 略過所有資料
+	c.w = bufio.NewWriter(c.conn)
 
 	c.flags = flags
 	// writeable 僅略過處理 event 資料
@@ -157,6 +231,13 @@ func (c *conn) Readable() bool {
 	return (c.GetFlags() & connection.Readable) != 0
 }
 
+// muted 登入後沒有讀取權限也沒有 Reply 旗標, 不寫出任何資料
+func (c *conn) muted() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.authed && c.flags&(connection.Readable|connection.Reply) == 0
+}
+
 func (c *conn) SetAuthed(t bool) {
 	c.Lock()
 	c.authed = t
@@ -172,13 +253,36 @@ func (c *conn) IsAuthed() bool {
 
 // GetAuth 回傳當前連線的登入紀錄
 func (c *conn) GetAuth() *store.Auth {
+	c.RLock()
+	name, connectedAt := c.name, c.connectedAt
+	c.RUnlock()
 	return &store.Auth{
-		Name:        c.name,
+		Name:        name,
 		IP:          c.RemoteAddr(),
-		ConnectedAt: c.connectedAt,
+		ConnectedAt: connectedAt,
 	}
 }
 
+// Reset 清除訂閱/權限/名稱與統計, 回到未登入狀態, 之後視為 t 時建立的新連線
+func (c *conn) Reset(t time.Time) {
+	c.Lock()
+	c.chs = map[event.Event]bool{}
+	c.flags = 0
+	c.authed = false
+	c.name = ""
+	c.lastAuth = store.Auth{}
+	c.connectedAt = t.UnixNano()
+	c.Unlock()
+
+	atomic.StoreInt64(&c.received, 0)
+	atomic.StoreInt64(&c.sent, 0)
+
+	c.rmu.Lock()
+	c.recovering = nil
+	c.live = nil
+	c.rmu.Unlock()
+}
+
 func (c *conn) Receive() (msg Message) {
 
 	line, err := connection.ReadLine(c.r)
@@ -191,6 +295,15 @@ func (c *conn) Receive() (msg Message) {
 		return
 	}
 
+	if line[0] == connection.CTag {
+		tag, p, err := connection.ParseTag(line[1:])
+		if err != nil {
+			msg.Error = connection.NewError(connection.ErrCodeProtocol, "%v", err)
+			return
+		}
+		msg.Tag, line = tag, p
+	}
+
 	msg.Action = line[0]
 	switch line[0] {
 	case connection.CAuth:
@@ -201,7 +314,7 @@ func (c *conn) Receive() (msg Message) {
 		// 設定讀寫權限
 		s := strings.SplitN(strings.TrimSpace(string(line[1:])), ":", 2)
 		if len(s) != 2 {
-			msg.Error = fmt.Errorf("auth data schema error: %s", line[1:])
+			msg.Error = connection.NewError(connection.ErrCodeProtocol, "auth data schema error: %s", line[1:])
 			break
 		}
 
@@ -242,9 +355,31 @@ func (c *conn) Receive() (msg Message) {
 	case connection.CInfo:
 		msg.Value = MessageInfo{}
 
+	case connection.CReset:
+		msg.Value = MessageReset{}
+
+	case connection.CQuery:
+		q, err := connection.ParseQuery(line[1:])
+		if err != nil {
+			msg.Error = err
+			break
+		}
+		msg.Value = MessageQuery{q}
+
+	case connection.CKick:
+		var v MessageKick
+		v.Target = strings.TrimSpace(string(line[1:]))
+		msg.Value = v
+
 	case connection.CTarget:
 		var v MessageEvent
-		name, p, err := connection.ReadTargetAndLen(c.r, line[1:])
+		head, h, err := connection.ParseHeader(line[1:])
+		if err != nil {
+			msg.Error = err
+			break
+		}
+		v.Header = h
+		name, p, err := connection.ReadTargetAndLen(c.r, head)
 		if err != nil {
 			msg.Error = err
 			break
@@ -260,7 +395,13 @@ func (c *conn) Receive() (msg Message) {
 
 	case connection.CEvent:
 		var v MessageEvent
-		p, err := connection.ReadLen(c.r, line[1:])
+		head, h, err := connection.ParseHeader(line[1:])
+		if err != nil {
+			msg.Error = err
+			break
+		}
+		v.Header = h
+		p, err := connection.ReadLen(c.r, head)
 		if err != nil {
 			msg.Error = err
 			break
@@ -274,7 +415,11 @@ func (c *conn) Receive() (msg Message) {
 		msg.Value = v
 
 	default:
-		msg.Error = fmt.Errorf("unknown protocol [%c]", line[0])
+		msg.Error = connection.NewError(connection.ErrCodeProtocol, "unknown protocol [%c]", line[0])
+	}
+
+	if _, ok := msg.Value.(MessageEvent); ok {
+		atomic.AddInt64(&c.received, 1)
 	}
 
 	return
@@ -360,24 +505,48 @@ NEXT:
 }
 
 func (c *conn) Err() error {
+	c.RLock()
+	defer c.RUnlock()
 	return c.err
 }
 
+// Close 不持有鎖等待, 排隊中的資料最多再送 closeTimeout, 之後關閉 net.Conn 讓卡住的寫入返回
 func (c *conn) Close(err error) error {
 	c.Lock()
-	defer c.Unlock()
 	if c.closed {
+		c.Unlock()
 		return err
 	}
 	c.closed = true
-
-	close(c.streams)
-	c.Wait()
+	timeout := closeTimeout
 	if c.err == nil {
 		c.err = err
+	}
+	err = c.err
+	close(c.doneChan())
+	c.Unlock()
+
+	reduced := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(reduced)
+	}()
+	select {
+	case <-reduced:
+	case <-time.After(timeout):
+	}
+	if c.conn != nil {
 		c.conn.Close()
 	}
-	return c.err
+	<-reduced
+	return err
+}
+
+func (c *conn) doneChan() chan struct{} {
+	c.doneOnce.Do(func() {
+		c.done = make(chan struct{})
+	})
+	return c.done
 }
 
 func (c *conn) flush(p []byte) error {
@@ -389,62 +558,240 @@ func (c *conn) flush(p []byte) error {
 	return nil
 }
 
+// reduce 依序寫入 streams, 呼叫前需先 c.Add(1), 讓 Close 一定等得到
 func (c *conn) reduce() {
-	c.Add(1)
-	for buf := range c.streams {
-		if err := c.flush(buf.Bytes()); err != nil {
-			break
+	defer c.Done()
+	done := c.doneChan()
+	var err error
+	for {
+		select {
+		case buf := <-c.streams:
+			// 寫入失敗後持續清空, 避免送出端卡住
+			if err == nil {
+				err = c.flush(buf.Bytes())
+			}
+		case <-done:
+			// 送出還在排隊的資料, 寫入卡住時由 Close 逾時關閉連線解除
+			for {
+				select {
+				case buf := <-c.streams:
+					if err == nil {
+						err = c.flush(buf.Bytes())
+					}
+				default:
+					return
+				}
+			}
 		}
 	}
-	c.Done()
 }
 
-func (c *conn) status(ignoreWriteOnly bool) *ConnStatus {
+// send 連線關閉後 (ex: 被 kick) 忽略, 等待 streams 時不持有鎖, 關閉後立即返回
+func (c *conn) send(buf *bytes.Buffer) {
+	if c.muted() {
+		return
+	}
+	buf.Write(connection.EOL)
+	done := c.doneChan()
+	select {
+	case <-done:
+		return
+	default:
+	}
+	select {
+	case c.streams <- buf:
+	case <-done:
+	}
+}
+
+func (c *conn) status() *ConnStatus {
 	c.RLock()
 	name := c.name
 	flags := c.flags
 	lastAuth := c.lastAuth
+	connectedAt := c.connectedAt
 	c.RUnlock()
 
-	// NOTE ignore write only (launcher conn)
-	if ignoreWriteOnly && flags == connection.Writable {
-		return nil
-	}
-
 	chs := []event.Event{}
 	c.EachChannels(func(ev event.Event) event.Event {
 		chs = append(chs, ev)
 		return ev
 	})
 
-	return &ConnStatus{
-		Channel:  chs,
-		Name:     name,
-		LastAuth: lastAuth,
-		Flag:     flags,
+	status := &ConnStatus{
+		ID:          c.id,
+		Channel:     chs,
+		Name:        name,
+		Flag:        flags,
+		ConnectedAt: connectedAt,
+		Received:    atomic.LoadInt64(&c.received),
+		Sent:        atomic.LoadInt64(&c.sent),
+		Pending:     len(c.streams),
 	}
+	if lastAuth.ConnectedAt != 0 {
+		status.LastAuth = &lastAuth
+	}
+	return status
 }
 
 func (c *conn) SendError(err error) {
-	buf := makeError(err)
-	buf.Write(connection.EOL)
-	c.streams <- buf
+	c.send(makeError(err))
 }
 
 func (c *conn) SendReply(m string) {
-	buf := makeReply(m)
-	buf.Write(connection.EOL)
-	c.streams <- buf
+	c.send(makeReply(m))
 }
 
 func (c *conn) SendPong(ping []byte) {
-	buf := makePong(ping)
-	buf.Write(connection.EOL)
-	c.streams <- buf
+	c.send(makePong(ping))
+}
+
+func (c *conn) SendReceipt(id int64, n int, status string) {
+	c.send(makeReceipt(id, n, status))
+}
+
+// SendRow 查詢結果不受讀取權限限制
+func (c *conn) SendRow(id int64, e *store.Event) {
+	c.send(makeRow(id, connection.Position{At: e.ReceivedAt, Seq: e.Seq}, e.Raw))
+}
+
+func (c *conn) SendQueryEnd(id int64, n int, next connection.Position) {
+	c.send(makeQueryEnd(id, n, next))
 }
 
 func (c *conn) SendEvent(e string) {
-	buf := makeEvent(e)
-	buf.Write(connection.EOL)
-	c.streams <- buf
+	c.sendLive(liveEvent{raw: e})
+}
+
+// PublishEvent 送出事件流中的事件, recover 時以 Seq 去重
+func (c *conn) PublishEvent(e *store.Event) {
+	c.sendLive(liveEvent{raw: e.Raw, seq: e.Seq, e: e})
+}
+
+func (c *conn) sendLive(e liveEvent) {
+	// 沒有讀取權限不送事件
+	if !c.Readable() {
+		return
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if rb := c.recovering; rb != nil {
+		if rb.overflow {
+			return
+		}
+		if len(rb.pending) >= recoverPendingSize {
+			rb.overflow = true
+			rb.pending = nil
+			go closeWithError(c, errOverflow)
+			return
+		}
+		rb.pending = append(rb.pending, e)
+		return
+	}
+	c.markLive(e.seq)
+	c.sendEvent(e.raw, e.e)
+}
+
+// markLive 記錄即時送出的事件, 需在 c.rmu 內呼叫
+func (c *conn) markLive(seq int64) {
+	if seq == 0 {
+		return
+	}
+	if c.live == nil {
+		c.live = newSeqRing(liveDedupeSize)
+	}
+	c.live.add(seq)
+}
+
+// sendEvent e 不為 nil 且連線帶 Meta 時附帶 header
+func (c *conn) sendEvent(raw string, e *store.Event) {
+	atomic.AddInt64(&c.sent, 1)
+	if e != nil && c.GetFlags()&connection.Meta != 0 {
+		c.send(makeEventWithHeader(connection.MakeHeader(e), raw))
+		return
+	}
+	c.send(makeEvent(raw))
+}
+
+// taggedConn 回覆帶編號的請求, 回應前加上同樣的編號
+type taggedConn struct {
+	*conn
+	tag int64
+}
+
+// responder 帶編號的請求改以 taggedConn 回覆
+func responder(c Conn, tag int64) Conn {
+	if cc, ok := c.(*conn); ok && tag > 0 {
+		return &taggedConn{conn: cc, tag: tag}
+	}
+	return c
+}
+
+func (c *taggedConn) SendError(err error) {
+	c.send(makeTagged(c.tag, makeError(err)))
+}
+
+func (c *taggedConn) SendReply(m string) {
+	c.send(makeTagged(c.tag, makeReply(m)))
+}
+
+func (c *taggedConn) SendPong(ping []byte) {
+	c.send(makeTagged(c.tag, makePong(ping)))
+}
+
+// SendEvent 請求的回應 (ex: info), 不受讀取權限與 recover 暫存影響
+func (c *taggedConn) SendEvent(e string) {
+	c.send(makeTagged(c.tag, makeEvent(e)))
+}
+
+// BeginRecover 開始暫存即時事件, 直到 EndRecover
+func (c *conn) BeginRecover(t time.Time) {
+	c.rmu.Lock()
+	c.recovering = &recoverBuffer{
+		start:    t.UnixNano(),
+		replayed: map[int64]bool{},
+	}
+	c.rmu.Unlock()
+}
+
+// ReplayEvent 送出 recover 的事件, 不經過暫存, 已即時送出過的略過
+func (c *conn) ReplayEvent(e *store.Event) {
+	if !c.Readable() {
+		return
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if e.Seq > 0 && c.live != nil && c.live.has(e.Seq) {
+		return
+	}
+	// 暫存超過上限, 連線關閉中
+	if rb := c.recovering; rb != nil && rb.overflow {
+		return
+	}
+	if rb := c.recovering; rb != nil && e.Seq > 0 && e.ReceivedAt >= rb.start-int64(recoverDedupeWindow) {
+		rb.replayed[e.Seq] = true
+	}
+	c.sendEvent(e.Raw, e)
+}
+
+// EndRecover 依序送出暫存中沒有重送過的事件並切回即時模式, 回傳送出筆數
+func (c *conn) EndRecover() int {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	rb := c.recovering
+	c.recovering = nil
+	if rb == nil {
+		return 0
+	}
+
+	n := 0
+	for _, e := range rb.pending {
+		if e.seq > 0 && rb.replayed[e.seq] {
+			continue
+		}
+		c.markLive(e.seq)
+		c.sendEvent(e.raw, e.e)
+		n++
+	}
+	return n
 }
@@ -3,25 +3,34 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
 	"github.com/colindev/events/server/fake"
+	"github.com/colindev/events/store"
 )
 
 func TestNewConnAndGetAuth(t *testing.T) {
 	now := time.Now()
 	c := newConn(nil, now)
 
-	if auth := c.GetAuth(); auth.ConnectedAt != now.Unix() {
+	if auth := c.GetAuth(); auth.ConnectedAt != now.UnixNano() {
 		t.Error("conn auth connected_at error", auth)
 	}
+	// 沒有上一次登入紀錄時不輸出 LastAuth
+	if p, _ := event.Marshal(c.(*conn).status()); strings.Contains(string(p), "LastAuth") {
+		t.Error("empty last auth must be omitted", string(p))
+	}
+	c.SetLastAuth(&store.Auth{Name: "a", ConnectedAt: 1})
+	if last := c.(*conn).status().LastAuth; last == nil || last.Name != "a" {
+		t.Error("last auth error", last)
+	}
 }
 
 func TestConnName(t *testing.T) {
@@ -43,20 +52,35 @@ func TestConn_SetFlags(t *testing.T) {
 
 	// no flags
 	c.SetFlags(0)
-	c.conn.(*fake.NetConn).W = func([]byte) (int, error) { return 0, errors.New("替換 write buffer 到 ioutil discard 失敗") }
 	if c.Writable() {
 		t.Error("this conn can't write")
 	}
-	c.w.WriteString("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
-	if err := c.w.Flush(); err != nil {
-		t.Error(err)
+	if c.Readable() {
+		t.Error("this conn can't read")
 	}
 
-	// write only client/conn 應該被替換成 ioutil.Discard / Conn.Writable 應該是true 表示接收 Conn.Receive 傳來的 stream
+	// 舊版 write only client 不讀取, 登入後不寫出任何資料
 	c.SetFlags(connection.Writable)
+	c.SetAuthed(true)
+	c.streams = make(chan *bytes.Buffer, 2)
+	c.SendReply("x")
+	if len(c.streams) != 0 {
+		t.Error("write only conn without reply flag must be muted")
+	}
+
+	// write only client/conn 帶 Reply 不送事件, 但回覆/錯誤/指定傳送結果照常寫出 / Conn.Writable 應該是true 表示接收 Conn.Receive 傳來的 stream
+	c.SetFlags(connection.Writable | connection.Reply)
 	if !c.Writable() {
 		t.Error("this conn is writable")
 	}
+	c.SendEvent("a.b:c")
+	c.SendReceipt(1, 1, connection.ReceiptDelivered)
+	if len(c.streams) != 1 {
+		t.Errorf("write only conn must drop events but keep receipts, got %d streams", len(c.streams))
+	} else if buf := <-c.streams; buf.String() != "^1:1:delivered\r\n" {
+		t.Errorf("receipt error %q", buf)
+	}
+	c.conn.(*fake.NetConn).W = func(p []byte) (int, error) { return len(p), nil }
 	c.w.WriteString("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
 	if err := c.w.Flush(); err != nil {
 		t.Error(err)
@@ -219,6 +243,9 @@ func TestConn_Receive(t *testing.T) {
 		connection.WriteEventTo(c.w, "hello", connection.MakeEventStream("test.2", event.RawData("xxxxx")))
 		c.flush(connection.EOL)
 
+		connection.WriteEventWithHeader(c.w, connection.Header{Key: "u 1"}, connection.MakeEventStream("test.3", event.RawData("xxxxx")))
+		c.flush(connection.EOL)
+
 	}()
 
 	// auth
@@ -305,6 +332,16 @@ func TestConn_Receive(t *testing.T) {
 		t.Errorf("event to error %#v", v)
 	}
 
+	// event with header
+	m = c.Receive()
+	if m.Error != nil {
+		t.Error(m.Error)
+	} else if v, ok := m.Value.(MessageEvent); !ok {
+		t.Errorf("event with header read fail %#v", m.Value)
+	} else if v.Name != "test.3" || v.Header.Key != "u 1" {
+		t.Errorf("event with header error %#v", v)
+	}
+
 }
 
 func TestConn_Close(t *testing.T) {
@@ -320,3 +357,167 @@ func TestConn_Close(t *testing.T) {
 	c.Close(nil)
 
 }
+
+func TestConn_CloseStuckWriter(t *testing.T) {
+	defer func(d time.Duration) { closeTimeout = d }(closeTimeout)
+	closeTimeout = time.Millisecond * 50
+
+	// 對方沒在讀取, 寫入卡到連線關閉
+	closed := make(chan struct{})
+	c := newConn(&fake.NetConn{
+		W: func(p []byte) (int, error) {
+			<-closed
+			return 0, io.ErrClosedPipe
+		},
+		CloseFunc: func() error {
+			close(closed)
+			return nil
+		},
+	}, time.Now()).(*conn)
+	c.Add(1)
+	go c.reduce()
+
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(c.streams)+2; i++ {
+			c.SendReply("x")
+		}
+		close(sent)
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	start := time.Now()
+	if err := c.Close(errKicked); err != errKicked {
+		t.Error("close error", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("close must not wait stuck writer", d)
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send must return after close")
+	}
+	// 關閉後直接返回
+	c.SendReply("y")
+}
+
+func TestConn_tagged(t *testing.T) {
+	c := &conn{
+		r:       bufio.NewReader(strings.NewReader(":7+a.*\r\n:x+b\r\n:8/\r\n")),
+		streams: make(chan *bytes.Buffer, 10),
+	}
+
+	m := c.Receive()
+	if v, ok := m.Value.(MessageSubscribe); m.Tag != 7 || !ok || v.Channel != "a.*" {
+		t.Errorf("tagged subscribe error %+v", m)
+	}
+	if m := c.Receive(); connection.ErrorCode(m.Error) != connection.ErrCodeProtocol {
+		t.Error("expect tag format error, but", m.Error)
+	}
+	if m := c.Receive(); m.Tag != 8 || m.Value != (MessageReset{}) {
+		t.Errorf("tagged reset error %+v", m)
+	}
+
+	// 沒有讀取權限時 info 回應照常送出
+	rc := responder(c, m.Tag)
+	rc.SendReply("subscribe a.* OK")
+	rc.SendError(errNeedAuth)
+	rc.SendEvent("info:x")
+	responder(c, 0).SendReply("untagged")
+	for _, expect := range []string{
+		":7*subscribe a.* OK\r\n",
+		":7!16\r\nNOAUTH need auth\r\n",
+		":7=6\r\ninfo:x\r\n",
+		"*untagged\r\n",
+	} {
+		if s := (<-c.streams).String(); s != expect {
+			t.Errorf("expect %q, but %q", expect, s)
+		}
+	}
+}
+
+func TestConn_recover(t *testing.T) {
+	c := &conn{flags: connection.Readable, streams: make(chan *bytes.Buffer, 10)}
+	now := time.Now()
+	old := connection.MakeEvent("job.old", event.RawData("0"), now.Add(-time.Hour))
+	a := connection.MakeEvent("job.a", event.RawData("1"), now)
+	b := connection.MakeEvent("job.b", event.RawData("2"), now)
+	// 內容相同但是不同的事件
+	again := connection.MakeEvent("job.a", event.RawData("1"), now)
+	old.Seq, a.Seq, b.Seq, again.Seq = 1, 2, 3, 4
+
+	c.BeginRecover(now)
+	// 重送期間的即時事件先暫存
+	c.PublishEvent(a)
+	if n := len(c.streams); n != 0 {
+		t.Fatal("live event must be buffered while recovering", n)
+	}
+	c.ReplayEvent(old)
+	c.ReplayEvent(a)
+	c.PublishEvent(b)
+	c.PublishEvent(again)
+	if n := c.EndRecover(); n != 2 {
+		t.Error("EndRecover expect 2 live events, but", n)
+	}
+	// 已即時送出的事件不再重送
+	c.ReplayEvent(b)
+	c.SendEvent(old.Raw)
+
+	list := []string{}
+	for len(c.streams) > 0 {
+		s := (<-c.streams).String()
+		list = append(list, s[strings.Index(s, "\n")+1:strings.Index(s, ":")])
+	}
+	// 已重送過的 job.a 不重複, 即時模式後照常送出
+	if fmt.Sprint(list) != "[job.old job.a job.b job.a job.old]" {
+		t.Error("recover stream error", list)
+	}
+	if n := c.EndRecover(); n != 0 {
+		t.Error("EndRecover without BeginRecover must be 0, but", n)
+	}
+}
+
+func TestConn_recoverOverflow(t *testing.T) {
+	defer func(n int) { recoverPendingSize = n }(recoverPendingSize)
+	recoverPendingSize = 2
+
+	var (
+		mu  sync.Mutex
+		out bytes.Buffer
+	)
+	c := newConn(&fake.NetConn{
+		W: func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return out.Write(p)
+		},
+	}, time.Now()).(*conn)
+	c.SetFlags(connection.Readable)
+	c.Add(1)
+	go c.reduce()
+
+	now := time.Now()
+	c.BeginRecover(now)
+	for i := 1; i <= 3; i++ {
+		e := connection.MakeEvent("job.a", event.RawData(fmt.Sprint(i)), now)
+		e.Seq = int64(i)
+		c.PublishEvent(e)
+	}
+
+	// 暫存超過上限時送出錯誤並中斷連線
+	for i := 0; i < 100 && c.Err() == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := c.Err(); err != errOverflow {
+		t.Fatal("expect overflow error, but", err)
+	}
+	if n := c.EndRecover(); n != 0 {
+		t.Error("overflow buffer must be dropped, but sent", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if s := out.String(); !strings.Contains(s, "OVERFLOW") || strings.Contains(s, "job.a") {
+		t.Errorf("overflow output error %q", s)
+	}
+}
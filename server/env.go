@@ -8,7 +8,7 @@ type Env struct {
 	path    string `env:"-"`
 	// 除錯模式
 	Debug bool `env:"DEBUG"`
-	// 跟隨其他 events server
+	// 跟隨其他 events server, 多個位址以逗號分隔或 srv://{name}
 	Follow string `env:"FOLLOW"`
 	// 存放登入連線 sqlite資料庫
 	AuthDSN string `env:"AUTH_DSN"`
@@ -18,6 +18,22 @@ type Env struct {
 	Addr string `env:"ADDR"`
 	// 資料保留時數
 	GCDuration string `env:"GC_DURATION"`
+	// 依事件名稱設定保留規則 ex: audit.*=2160h;telemetry.*=1h,rows=100000,bytes=64MB
+	Retention string `env:"RETENTION"`
+	// 定期 GC 間隔, 未設定時取 GC_DURATION / INBOX_TTL / 各規則保留時間中最短的
+	GCInterval string `env:"GC_INTERVAL"`
+	// 定期 VACUUM 間隔
+	VacuumDuration string `env:"VACUUM_DURATION"`
+	// 依 key 壓縮事件 ex: user.profile.*=1h;config.*=10m
+	Compaction string `env:"COMPACTION"`
+	// 指定傳送目標離線時的收件匣筆數上限
+	InboxSize int `env:"INBOX_SIZE"`
+	// 收件匣保留時間, 未設定時同 GC_DURATION
+	InboxTTL string `env:"INBOX_TTL"`
+	// 可使用管理指令 (kick) 的 app, 逗號分隔
+	Admin string `env:"ADMIN"`
+	// 保留在記憶體的最近事件數, 短時間斷線的 recover 不查資料庫, 0 不啟用
+	RingSize int `env:"RING_SIZE"`
 }
 
 func (env *Env) String() string {
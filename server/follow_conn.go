@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/colindev/events/client"
@@ -12,12 +13,24 @@ import (
 
 type followConn struct {
 	Conn
-	hub  *Hub
-	addr string
+	hub    *Hub
+	dialer client.Dialer
 }
 
 // 遮蔽方法
-func (f *followConn) SendEvent(e string) {}
+func (f *followConn) SendEvent(e string)          {}
+func (f *followConn) PublishEvent(e *store.Event) {}
+
+// Receive 複寫, 主機送來的內容由 ReadLine 處理, 不交給 hub.handle
+// 只回傳讀取錯誤, hub.handle 收到後結束這條連線
+func (f *followConn) Receive() (msg Message) {
+	for {
+		if _, err := f.ReadLine(); err != nil {
+			msg.Error = err
+			return
+		}
+	}
+}
 
 // 複寫
 func (f *followConn) ReadLine() (line []byte, err error) {
@@ -28,7 +41,7 @@ func (f *followConn) ReadLine() (line []byte, err error) {
 		t := time.Now()
 		// run forever
 		for {
-			if err := Follow(f.hub, f.addr, t.Unix()); err == nil {
+			if err := Follow(f.hub, f.dialer, t.UnixNano()); err == nil {
 				break
 			}
 			time.Sleep(time.Second * 3)
@@ -41,7 +54,13 @@ func (f *followConn) ReadLine() (line []byte, err error) {
 
 	switch line[0] {
 	case connection.CEvent:
-		p, e := f.ReadLen(line[1:])
+		// 以 Meta 登入, 事件附帶原本的 header
+		head, h, e := connection.ParseHeader(line[1:])
+		if e != nil {
+			err = fmt.Errorf("error from ParseHeader %v", e)
+			break
+		}
+		p, e := f.ReadLen(head)
 		if e != nil {
 			err = fmt.Errorf("error from ReadLen %v", e)
 			break
@@ -69,10 +88,22 @@ func (f *followConn) ReadLine() (line []byte, err error) {
 				err = fmt.Errorf("error from Unmarshal Leave %v", err)
 			}
 			f.hub.store.UpdateAuth(&auth)
-		case event.Connected: // ignore
+		case event.Connected, event.RecoverBegin, event.RecoverEnd: // ignore
 		default:
-			storeEvent := connection.MakeEvent(eventName, compressedData, time.Now())
-			f.hub.store.Events <- storeEvent
+			atomic.AddInt64(&f.hub.received, 1)
+			// 保留原本的收到時間/過期時間/key/retain, 舊版 server 沒有 header 時以收到的時間代替
+			at := f.hub.clock.Now()
+			if h.ReceivedAt > 0 {
+				at = time.Unix(0, h.ReceivedAt)
+			}
+			storeEvent := connection.MakeEvent(eventName, compressedData, at)
+			storeEvent.Key = h.Key
+			storeEvent.ExpiresAt = h.ExpiresAt
+			storeEvent.Retain = h.Retain
+			f.hub.save(storeEvent)
+			if h.Retain {
+				f.hub.retain(storeEvent)
+			}
 			f.hub.publish(storeEvent)
 		}
 	}
@@ -81,13 +112,14 @@ func (f *followConn) ReadLine() (line []byte, err error) {
 	return nil, err
 }
 
-// Follow return Conn of server
-func Follow(hub *Hub, addr string, since int64) error {
-	cc, err := client.Dial("", addr)
+// Follow return Conn of server, since 為 unix nano
+// 斷線後以同一個 dialer 重連, 主機斷線時可切換到其他位址
+func Follow(hub *Hub, dialer client.Dialer, since int64) error {
+	cc, err := dialer.Dial()
 	if err != nil {
 		return fmt.Errorf("follow dial error: %v", err)
 	}
-	if err := cc.Auth(connection.Readable); err != nil {
+	if err := cc.Auth(connection.Readable | connection.Meta); err != nil {
 		return fmt.Errorf("follow auth error: %v", err)
 	}
 	if err := cc.Subscribe("*"); err != nil {
@@ -102,9 +134,9 @@ func Follow(hub *Hub, addr string, since int64) error {
 	sc.SetAuthed(true)
 
 	go hub.handle(&followConn{
-		Conn: sc,
-		hub:  hub,
-		addr: addr,
+		Conn:   sc,
+		hub:    hub,
+		dialer: dialer,
 	})
 
 	cc.Recover(since, 0)
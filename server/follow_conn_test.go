@@ -1,6 +1,17 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/colindev/events/client"
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/event"
+	"github.com/colindev/events/store"
+)
 
 func TestFollowConn(t *testing.T) {
 
@@ -11,3 +22,67 @@ func TestFollowConn(t *testing.T) {
 		t.Error("fail")
 	}
 }
+
+func TestFollow_header(t *testing.T) {
+	newHub := func(dsn string) *Hub {
+		hub, err := NewHub(&Env{
+			AuthDSN:    "file:" + dsn + "?mode=memory&cache=shared",
+			EventDSN:   "file:" + dsn + "?mode=memory&cache=shared",
+			GCDuration: "1h",
+		}, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hub
+	}
+	leader, follower := newHub("follow_leader"), newHub("follow_follower")
+	ln := serveTCP(t, leader)
+	defer ln.Close()
+
+	at := time.Now().Add(-time.Minute)
+	leader.dispatch(MessageEvent{
+		Name:    "config.a",
+		RawData: event.RawData("1"),
+		Header:  connection.Header{Key: "k", Retain: true, TTL: time.Hour},
+	}, at)
+
+	if err := Follow(follower, client.NewDialer("", ln.Addr().String()), at.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保留事件訂閱時補送, 帶原本的收到時間/過期時間/key
+	var e *store.Event
+	for i := 0; i < 300 && e == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		follower.rmu.Lock()
+		e = follower.retained["config.a"]
+		follower.rmu.Unlock()
+	}
+	if e == nil {
+		t.Fatal("retained event must be followed")
+	}
+	if e.ReceivedAt != at.UnixNano() || e.ExpiresAt != at.Add(time.Hour).UnixNano() || e.Key != "k" {
+		t.Errorf("follow header error %+v", e)
+	}
+
+	// 即時事件
+	leader.dispatch(MessageEvent{
+		Name:    "job.a",
+		RawData: event.RawData("2"),
+		Header:  connection.Header{Key: "j"},
+	}, at.Add(time.Second))
+	var found *store.Event
+	for i := 0; i < 300 && found == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		follower.store.Each(context.Background(), store.Query{Names: []string{"job.*"}}, func(e *store.Event) error {
+			found = e
+			return nil
+		})
+	}
+	if found == nil {
+		t.Fatal("live event must be followed")
+	}
+	if found.ReceivedAt != at.Add(time.Second).UnixNano() || found.Key != "j" {
+		t.Errorf("follow header error %+v", found)
+	}
+}
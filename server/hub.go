@@ -1,13 +1,16 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/colindev/events/client"
@@ -18,45 +21,128 @@ import (
 
 // Hub 負責管理連線
 type Hub struct {
+	// 收到 / 存入 store 的事件數
+	received int64
+	saved    int64
 	// 連線鎖
 	sync.RWMutex
 	// 需作歷程管理
 	m map[string]Conn
 	// 不須作歷程管理
 	g map[Conn]bool
+	// 已離線連線送出的事件數, 與連線鎖一起使用
+	delivered int64
+	startedAt time.Time
 	// 等待連線全部退出用
 	sync.WaitGroup
 
 	store *store.Store
+	// 排程用時間來源
+	clock Clock
+	// 有新排程時喚醒排程器
+	wake chan struct{}
+	// 每個事件名稱最後一筆保留事件, 訂閱時補送
+	rmu      sync.RWMutex
+	retained map[string]*store.Event
+	// 可使用管理指令 (kick) 的 app
+	admin map[string]bool
+	// 最近的事件, nil 表示不啟用
+	ring *ring
+	// 最短的壓縮 horizon, 超過的範圍 recover 需套用壓縮規則所以改查 store
+	compactHorizon time.Duration
+	// server 關閉時中斷進行中的 recover
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// log verbose
 	verbose bool
 	*log.Logger
 }
 
+const (
+	// 查詢未指定筆數時的預設值
+	defaultQueryLimit = 100
+	// 單次查詢筆數上限
+	maxQueryLimit = 1000
+)
+
 var (
-	errNeedAuth = errors.New("need auth")
+	errNeedAuth = connection.NewError(connection.ErrCodeNeedAuth, "need auth")
+	errNotAdmin = connection.NewError(connection.ErrCodeDenied, "permission denied")
+	errKicked   = connection.NewError(connection.ErrCodeKicked, "kicked")
+	errOverflow = connection.NewError(connection.ErrCodeOverflow, "too many live events during recover")
 )
 
 // NewHub create and return a Hub instance
 func NewHub(env *Env, logger *log.Logger) (*Hub, error) {
 
+	retention, err := store.ParseRetention(env.Retention)
+	if err != nil {
+		return nil, err
+	}
+	compaction, err := store.ParseCompaction(env.Compaction)
+	if err != nil {
+		return nil, err
+	}
+
 	sto, err := store.New(store.Config{
-		Debug:      env.Debug,
-		AuthDSN:    env.AuthDSN,
-		EventDSN:   env.EventDSN,
-		GCDuration: env.GCDuration,
+		Debug:          env.Debug,
+		AuthDSN:        env.AuthDSN,
+		EventDSN:       env.EventDSN,
+		GCDuration:     env.GCDuration,
+		GCInterval:     env.GCInterval,
+		Retention:      retention,
+		Compaction:     compaction,
+		InboxSize:      env.InboxSize,
+		InboxTTL:       env.InboxTTL,
+		VacuumDuration: env.VacuumDuration,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	retained := map[string]*store.Event{}
+	if err := sto.EachRetained(func(e *store.Event) error {
+		retained[e.Name] = e
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	admin := map[string]bool{}
+	for _, name := range connection.ParseTargets(env.Admin) {
+		admin[name] = true
+	}
+
+	var compactHorizon time.Duration
+	for _, c := range compaction {
+		if compactHorizon == 0 || c.Horizon < compactHorizon {
+			compactHorizon = c.Horizon
+		}
+	}
+
+	var r *ring
+	if env.RingSize > 0 {
+		r = newRing(env.RingSize, time.Now())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Hub{
-		m:       map[string]Conn{},
-		g:       map[Conn]bool{},
-		store:   sto,
-		Logger:  logger,
-		verbose: env.Debug,
+		m:              map[string]Conn{},
+		g:              map[Conn]bool{},
+		store:          sto,
+		clock:          realClock{},
+		wake:           make(chan struct{}, 1),
+		retained:       retained,
+		admin:          admin,
+		ring:           r,
+		compactHorizon: compactHorizon,
+		ctx:            ctx,
+		cancel:         cancel,
+		startedAt:      time.Now(),
+		Logger:         logger,
+		verbose:        env.Debug,
 	}, nil
 }
 
@@ -77,7 +163,7 @@ func (h *Hub) auth(c Conn, msgAuth MessageAuth) error {
 	}
 
 	if c, exists := h.m[msgAuth.Name]; exists {
-		return fmt.Errorf("hub: duplicate auth %s(%+v)", c.RemoteAddr(), msgAuth)
+		return connection.NewError(connection.ErrCodeDupAuth, "hub: duplicate auth %s(%+v)", c.RemoteAddr(), msgAuth)
 	}
 
 	c.SetName(msgAuth.Name)
@@ -111,14 +197,34 @@ func (h *Hub) quit(c Conn, t time.Time) (auth *store.Auth) {
 		c.Close(err)
 	}()
 	defer h.Unlock()
+	return h.leave(c, t)
+}
+
+// reset 連線回到未登入狀態, 同 quit 記錄離線但不中斷連線
+func (h *Hub) reset(c Conn, t time.Time) *store.Auth {
+	h.Lock()
+	defer h.Unlock()
+	auth := h.leave(c, t)
+	c.Reset(t)
+	return auth
+}
+
+// leave 移除連線並記錄離線時間, 需在 h 鎖內呼叫
+func (h *Hub) leave(c Conn, t time.Time) (auth *store.Auth) {
 	auth = c.GetAuth()
-	auth.DisconnectedAt = t.Unix()
+	auth.DisconnectedAt = t.UnixNano()
 
 	if !c.HasName() {
+		if h.g[c] {
+			h.addDelivered(c)
+		}
 		delete(h.g, c)
 		return
 	}
 
+	if h.m[c.GetName()] == c {
+		h.addDelivered(c)
+	}
 	delete(h.m, c.GetName())
 	if err := h.store.UpdateAuth(auth); err != nil {
 		h.Println(err)
@@ -126,6 +232,13 @@ func (h *Hub) quit(c Conn, t time.Time) (auth *store.Auth) {
 	return
 }
 
+// addDelivered 離線前累計連線送出的事件數, 需在連線鎖內呼叫
+func (h *Hub) addDelivered(c Conn) {
+	if c, ok := c.(*conn); ok {
+		h.delivered += atomic.LoadInt64(&c.sent)
+	}
+}
+
 func (h *Hub) quitAll(t time.Time) {
 	m := map[Conn]bool{}
 	h.RLock()
@@ -172,35 +285,269 @@ func (h *Hub) publish(e *store.Event, ignore ...Conn) int {
 	for _, c := range conns {
 		cnt++
 		h.Printf("send to: %s(%s)", c.RemoteAddr(), c.GetName())
-		c.SendEvent(e.Raw)
+		c.PublishEvent(e)
 	}
 
 	return cnt
 }
 
-func (h *Hub) sendEventTo(app string, e *store.Event) {
+// sendEventTo 指定傳送, target 可為逗號分隔的多個 app, 名稱 pattern (ex: app1,worker-*) 或連線 ID (ex: #12)
+// pattern 只比對目前連線中的 app, 回傳收到 (含存入收件匣) 的 app 數量與結果 (connection.ReceiptXXX)
+func (h *Hub) sendEventTo(target string, e *store.Event) (int, string) {
+	if e.Expired(h.clock.Now()) {
+		return 0, connection.ReceiptExpired
+	}
+
+	apps := []string{}
+	ghosts := []Conn{}
+	statuses := []string{}
+	seen := map[string]bool{}
+	addApp := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			apps = append(apps, name)
+		}
+	}
+	for _, t := range connection.ParseTargets(target) {
+		if id, ok := connection.ParseConnID(t); ok {
+			switch c := h.connByID(id); {
+			case c == nil:
+				statuses = append(statuses, connection.ReceiptNoTarget)
+			case c.HasName():
+				addApp(c.GetName())
+			default:
+				ghosts = append(ghosts, c)
+			}
+			continue
+		}
+
+		if !strings.Contains(t, "*") {
+			addApp(t)
+			continue
+		}
+
+		for _, name := range h.matchNames(t) {
+			addApp(name)
+		}
+	}
+
+	for _, app := range apps {
+		statuses = append(statuses, h.sendEventToApp(app, e))
+	}
+	for _, c := range ghosts {
+		// 匿名連線沒有收件匣, 未訂閱時直接略過
+		if c.IsListening(e.Name) {
+			c.SendEvent(e.Raw)
+			statuses = append(statuses, connection.ReceiptDelivered)
+		} else {
+			statuses = append(statuses, connection.ReceiptNoTarget)
+		}
+	}
+
+	n := 0
+	status := connection.ReceiptNoTarget
+	for _, s := range statuses {
+		switch s {
+		case connection.ReceiptDelivered:
+			n++
+			status = s
+		case connection.ReceiptQueued:
+			n++
+			if status != connection.ReceiptDelivered {
+				status = s
+			}
+		default:
+			if n == 0 {
+				status = s
+			}
+		}
+	}
+
+	return n, status
+}
+
+// matchNames 回傳目前連線中符合 pattern 的 app 名稱 (已排序)
+func (h *Hub) matchNames(pattern string) []string {
+	matched := []string{}
+	h.RLock()
+	for name := range h.m {
+		if event.Event(pattern).Match(event.Event(name)) {
+			matched = append(matched, name)
+		}
+	}
+	h.RUnlock()
+	sort.Strings(matched)
+	return matched
+}
+
+// connByID 依連線 ID 找出連線中的 conn (含匿名)
+func (h *Hub) connByID(id int64) Conn {
+	h.RLock()
+	defer h.RUnlock()
+	for _, c := range h.m {
+		if c.ID() == id {
+			return c
+		}
+	}
+	for c := range h.g {
+		if c.ID() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// kick 中斷 target 指定的連線, target 格式同 sendEventTo, 回傳中斷數量
+// 只關閉連線, 退出紀錄與 Leave 廣播由該連線的 handle 處理
+func (h *Hub) kick(target string) int {
+	conns := []Conn{}
+	seen := map[Conn]bool{}
+	add := func(c Conn) {
+		if c != nil && !seen[c] {
+			seen[c] = true
+			conns = append(conns, c)
+		}
+	}
+	for _, t := range connection.ParseTargets(target) {
+		if id, ok := connection.ParseConnID(t); ok {
+			add(h.connByID(id))
+			continue
+		}
+
+		names := []string{t}
+		if strings.Contains(t, "*") {
+			names = h.matchNames(t)
+		}
+		for _, name := range names {
+			h.RLock()
+			c := h.m[name]
+			h.RUnlock()
+			add(c)
+		}
+	}
+
+	for _, c := range conns {
+		h.Printf("kick %s app(%s) #%d\n", c.RemoteAddr(), c.GetName(), c.ID())
+		go closeWithError(c, errKicked)
+	}
+
+	return len(conns)
+}
+
+// closeWithError 送出錯誤後關閉, 對方沒在讀取導致送不出時逾時直接關閉
+func closeWithError(c Conn, err error) {
+	t := time.AfterFunc(closeTimeout, func() { c.Close(err) })
+	c.SendError(err)
+	t.Stop()
+	c.Close(err)
+}
+
+func (h *Hub) sendEventToApp(app string, e *store.Event) string {
 	h.RLock()
 	c := h.m[app]
 	h.RUnlock()
 
-	if c != nil && c.IsListening(e.Name) {
+	// 沒有讀取權限的連線收不到事件, 同離線處理
+	if c != nil && c.Readable() && c.IsListening(e.Name) {
 		c.SendEvent(e.Raw)
+		return connection.ReceiptDelivered
+	}
+
+	if c == nil {
+		// 沒登入過的視為打錯名稱, 不存入收件匣
+		if known, err := h.store.HasAuth(app); err != nil {
+			h.Printf("inbox %s %s error: %v\n", app, e.Name, err)
+			return connection.ReceiptError
+		} else if !known {
+			return connection.ReceiptNoTarget
+		}
+	}
+
+	// 目標離線或尚未訂閱時存入收件匣, 下次訂閱/recover 時送達
+	if err := h.store.AddInbox(app, e); err != nil {
+		h.Printf("inbox %s %s error: %v\n", app, e.Name, err)
+		return connection.ReceiptError
 	}
+	return connection.ReceiptQueued
 }
 
-func (h *Hub) recover(c Conn, since, until int64) error {
+// deliverInbox 送出收件匣中目前有訂閱的事件, 沒有讀取權限時留在收件匣
+func (h *Hub) deliverInbox(c Conn) (int, error) {
+	if !c.HasName() || !c.Readable() {
+		return 0, nil
+	}
+
+	list, err := h.store.GetInbox(c.GetName(), h.clock.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []int64{}
+	for _, in := range list {
+		if c.IsListening(in.Name) {
+			c.SendEvent(in.Raw)
+			ids = append(ids, in.ID)
+		}
+	}
+
+	return len(ids), h.store.DeleteInbox(ids...)
+}
+
+// retain 保留事件名稱最後一筆
+func (h *Hub) retain(e *store.Event) {
+	h.rmu.Lock()
+	h.retained[e.Name] = e
+	h.rmu.Unlock()
+
+	if err := h.store.SetRetained(e); err != nil {
+		h.Printf("retain %s error: %v\n", e.Name, err)
+	}
+}
+
+// sendRetained 補送符合頻道的保留事件
+func (h *Hub) sendRetained(c Conn, ch string) int {
+	list := []*store.Event{}
+	now := h.clock.Now()
+	h.rmu.Lock()
+	for name, e := range h.retained {
+		if e.Expired(now) {
+			// store 的部份交給 GC 清除
+			delete(h.retained, name)
+			continue
+		}
+		if event.Event(ch).Match(event.Event(name)) {
+			list = append(list, e)
+		}
+	}
+	h.rmu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	for _, e := range list {
+		c.PublishEvent(e)
+	}
+
+	return len(list)
+}
+
+func (h *Hub) recover(c Conn, since, until int64) (*connection.RecoverReport, error) {
 
 	if since == 0 {
 		// NOTE 沒上一次的登入紀錄時不重送全部訊息
 		lastAuth := c.GetLastAuth()
 		if lastAuth.DisconnectedAt == 0 {
-			return nil
+			report := &connection.RecoverReport{}
+			h.sendRecoverReport(c, event.RecoverBegin, report)
+			h.sendRecoverReport(c, event.RecoverEnd, report)
+			return report, nil
 		}
 		since = lastAuth.DisconnectedAt
 	}
 
-	if until <= 0 {
-		until = time.Now().Unix()
+	// 暫存從 start 開始, 重送範圍不超過 start, 之後的事件由暫存送出
+	start := h.clock.Now()
+	now := start.UnixNano()
+	if until <= 0 || until > now {
+		until = now
 	}
 
 	prefix := []string{}
@@ -219,23 +566,170 @@ func (h *Hub) recover(c Conn, since, until int64) error {
 
 	h.Printf("recover: %s(%s) since=%d until=%d channels=%v\n", c.RemoteAddr(), c.GetName(), since, until, chs)
 
-	err := h.store.EachEvents(func(e *store.Event) error {
+	report := &connection.RecoverReport{Since: since, Until: until}
+	h.sendRecoverReport(c, event.RecoverBegin, report)
+
+	// 重送期間的即時事件先暫存, 重送完再送出沒重送過的, 確保順序且不重複
+	// begin 之前已即時送出的事件由 Seq 略過
+	c.BeginRecover(start)
+
+	replay := func(e *store.Event) error {
 		if c.IsListening(e.Name) {
 			// 先不浪費I/O了
 			// h.Printf("resend %s: %+v\n", c.GetName(), e)
-			c.SendEvent(e.Raw)
+			c.ReplayEvent(e)
+			report.Count++
 		}
 		return nil
-	}, prefix, since, until)
+	}
+
+	var err error
+	if list, ok := h.recentEvents(since, until, now); ok {
+		h.Printf("recover: %s(%s) from ring %d events\n", c.RemoteAddr(), c.GetName(), len(list))
+		for _, e := range list {
+			replay(e)
+		}
+	} else {
+		// 壓縮規則內的事件超過 horizon 只重送同 key 最新一筆, 之後接著完整的近期事件
+		err = h.store.Each(h.ctx, store.Query{
+			Prefix:    prefix,
+			Since:     since,
+			Until:     until,
+			Compact:   true,
+			Unexpired: now,
+			Now:       now,
+		}, replay)
+	}
+	report.Live = c.EndRecover()
+
+	if err == nil {
+		report.Inbox, err = h.deliverInbox(c)
+	}
 
 	if err == nil && c.GetName() != "" {
 		auth := c.GetAuth()
 		auth.RecoverSince = since
 		auth.RecoverUntil = until
-		return h.store.UpdateAuth(auth)
+		err = h.store.UpdateAuth(auth)
 	}
 
-	return err
+	if err != nil {
+		report.Error = err.Error()
+	}
+	h.sendRecoverReport(c, event.RecoverEnd, report)
+
+	return report, err
+}
+
+// replyRecover 處理 recover 請求, 帶編號的請求在 recover.end 之後回應 recover OK {重送數}
+func (h *Hub) replyRecover(c Conn, tag int64, v MessageRecover) {
+	rc := responder(c, tag)
+	report, err := h.recover(c, v.Since, v.Until)
+	if err != nil {
+		h.Printf("recover %+v error: %v\n", v, err)
+		rc.SendError(err)
+		return
+	}
+	if tag > 0 {
+		rc.SendReply(fmt.Sprintf("recover OK %d", report.Count+report.Inbox))
+	}
+}
+
+// save 存入 store, 同時放進 ring
+func (h *Hub) save(e *store.Event) {
+	atomic.AddInt64(&h.saved, 1)
+	if e.Seq == 0 {
+		e.Seq = h.store.NextSeq()
+	}
+	h.store.Events <- e
+	if h.ring != nil {
+		h.ring.add(e)
+	}
+}
+
+// recentEvents ring 涵蓋 since 之後的事件, 且範圍在壓縮 horizon 內時回傳 ring 中未過期的事件
+func (h *Hub) recentEvents(since, until, now int64) ([]*store.Event, bool) {
+	if h.ring == nil {
+		return nil, false
+	}
+	if h.compactHorizon > 0 && since < now-int64(h.compactHorizon) {
+		return nil, false
+	}
+
+	list, ok := h.ring.events(since, until)
+	if !ok {
+		return nil, false
+	}
+	t := time.Unix(0, now)
+	ret := list[:0]
+	for _, e := range list {
+		if !e.Expired(t) {
+			ret = append(ret, e)
+		}
+	}
+	return ret, true
+}
+
+// sendRecoverReport 不論是否訂閱都會送出, 讓 client 知道重送的範圍與結束時間點
+func (h *Hub) sendRecoverReport(c Conn, ev event.Event, report *connection.RecoverReport) {
+	rd, err := event.Marshal(report)
+	if err == nil {
+		rd, err = event.Compress(rd)
+	}
+	if err != nil {
+		h.Println(err)
+		return
+	}
+	c.SendEvent(string(connection.MakeEventStream(ev, rd)))
+}
+
+// query 依條件送出歷史事件, 與訂閱的事件流分開 (&{id} 逐筆, %{id} 結束)
+// 還有下一頁時結束訊息帶最後一筆的位置, client 放進 After 接續查詢
+func (h *Hub) query(c Conn, q connection.Query) (int, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	var (
+		n    int
+		more bool
+		last connection.Position
+	)
+	// 多取一筆判斷是否還有下一頁
+	cur := h.store.Cursor(h.ctx, store.Query{
+		Names:     q.Names,
+		Since:     q.Since,
+		Until:     q.Until,
+		After:     store.Position{ReceivedAt: q.After.At, Seq: q.After.Seq},
+		PageSize:  limit + 1,
+		Unexpired: h.clock.Now().UnixNano(),
+	})
+	for cur.Next() {
+		if n == limit {
+			more = true
+			break
+		}
+		e := cur.Event()
+		c.SendRow(q.ID, e)
+		last = connection.Position{At: e.ReceivedAt, Seq: e.Seq}
+		n++
+	}
+	err := cur.Err()
+
+	var next connection.Position
+	if err != nil {
+		// 錯誤在結束訊息之前送出, client 收到結束時即可回傳
+		c.SendError(err)
+	} else if more {
+		next = last
+	}
+	c.SendQueryEnd(q.ID, n, next)
+
+	return n, err
 }
 
 func (h *Hub) handle(c Conn) {
@@ -254,45 +748,14 @@ func (h *Hub) handle(c Conn) {
 	}()
 
 	if c, ok := c.(*conn); ok {
+		c.Add(1)
 		go c.reduce()
 	}
 
-	if !c.IsAuthed() {
-		// 登入的第一個訊息一定是登入訊息
-		msg := c.Receive()
-		if msg.Error != nil {
-			h.Println(msg.Error)
-			c.SendError(msg.Error)
-			return
-		}
-
-		value, ok := msg.Value.(MessageAuth)
-		if !ok {
-			h.Println(err)
-			c.SendError(errNeedAuth)
-			return
-		}
-
-		if err := h.auth(c, value); err != nil {
-			h.Println(err)
-			c.SendError(err)
-			return
-		}
+	if !c.IsAuthed() && !h.login(c) {
+		return
 	}
-
-	h.Printf("%s app(%s) connected\n", c.RemoteAddr(), c.GetName())
-
-	// 發送連線事件
-	c.SendEvent(string(connection.MakeEventStream(event.Connected, connection.OK)))
-
-	// 廣播具名客端 Join 事件
-	go func() {
-		// NOTE join event 可能會快過 subscribe
-		time.Sleep(time.Second * 3)
-		if pub, err := h.publishJoin(c); pub {
-			h.Printf("broadcast join: %s app(%s) %v\n", c.RemoteAddr(), c.GetName(), err)
-		}
-	}()
+	h.connected(c)
 
 	for {
 		msg := c.Receive()
@@ -303,39 +766,71 @@ func (h *Hub) handle(c Conn) {
 			return
 		}
 
+		// 帶編號的請求, 直接的回應 (reply/error/pong/info) 帶回編號
+		rc := responder(c, msg.Tag)
 		v := msg.Value
 		switch v := v.(type) {
 		// case MessageAuth: 只做單次登入
 		case MessageRecover:
-			if err := h.recover(c, v.Since, v.Until); err != nil {
-				h.Printf("recover %+v error: %v\n", v, err)
-				c.SendError(err)
-			}
+			h.replyRecover(c, msg.Tag, v)
 
 		case MessageSubscribe:
 			ch := c.Subscribe(v.Channel)
 			h.Printf("app(%s) subscribe [%s]\n", c.GetName(), ch)
-			c.SendReply("subscribe " + ch + " OK")
+			rc.SendReply("subscribe " + ch + " OK")
+			h.sendRetained(c, ch)
+			if _, err := h.deliverInbox(c); err != nil {
+				h.Printf("app(%s) inbox error: %v\n", c.GetName(), err)
+			}
 
 		case MessageUnsubscribe:
 			ch := c.Unsubscribe(v.Channel)
 			h.Printf("app(%s) unsubscribe [%s]\n", c.GetName(), ch)
-			c.SendReply("unsubscribe " + ch + " OK")
+			rc.SendReply("unsubscribe " + ch + " OK")
 
 		case MessagePing:
-			c.SendPong(v.Payload)
+			rc.SendPong(v.Payload)
+
+		case MessageReset:
+			auth := h.reset(c, time.Now())
+			if pub, err := h.publishQuit(c, auth); pub {
+				h.Printf("broadcast leave: %s app(%s) %v\n", c.RemoteAddr(), auth.Name, err)
+			}
+			h.Printf("%s app(%s) reset\n", c.RemoteAddr(), auth.Name)
+			rc.SendReply("reset OK")
+			if !h.login(c) {
+				return
+			}
+			h.connected(c)
 
 		case MessageInfo:
 			rd, err := event.Compress(event.RawData(h.info(true)))
 			if err != nil {
-				c.SendError(err)
+				rc.SendError(err)
 			} else {
-				c.SendEvent(string(connection.MakeEventStream(event.Info, rd)))
+				rc.SendEvent(string(connection.MakeEventStream(event.Info, rd)))
 			}
 
+		case MessageQuery:
+			if _, err := h.query(c, v.Query); err != nil {
+				h.Printf("query %+v error: %v\n", v.Query, err)
+			}
+
+		case MessageKick:
+			if !c.HasName() || !h.admin[c.GetName()] {
+				rc.SendError(errNotAdmin)
+				continue
+			}
+			n := h.kick(v.Target)
+			rc.SendReply(fmt.Sprintf("kick %s %d", v.Target, n))
+
 		case MessageEvent:
+			atomic.AddInt64(&h.received, 1)
 			if !c.Writable() {
 				h.Printf("this (%p)%#v has no writable flag, event droped\n", c.(*conn), c)
+				if v.Header.Receipt > 0 {
+					c.SendReceipt(v.Header.Receipt, 0, connection.ReceiptDenied)
+				}
 				if h.verbose {
 					s, _ := event.Uncompress(v.RawData)
 					h.Printf("\n--- payload %s %s\n%s\n---", v.To, v.Name, s)
@@ -344,21 +839,82 @@ func (h *Hub) handle(c Conn) {
 			}
 
 			s, _ := event.Uncompress(v.RawData)
-			storeEvent := connection.MakeEvent(v.Name, v.RawData, time.Now())
+			if dueAt := h.dueAt(v.Header); dueAt > 0 {
+				h.Printf("from %s schedule at %s: %s %s\n", c.RemoteAddr(), connection.FormatTimestamp(dueAt), v.Name, s)
+				if err := h.schedule(v, dueAt); err != nil {
+					rc.SendError(err)
+				} else if v.Header.Receipt > 0 {
+					c.SendReceipt(v.Header.Receipt, 0, connection.ReceiptQueued)
+				}
+				continue
+			}
 			if v.To != "" {
 				h.Printf("from %s to %s: %s %s %v\n", c.RemoteAddr(), v.To, v.Name, s, err)
-				// 指定傳送不儲存
-				h.sendEventTo(v.To, storeEvent)
 			} else {
 				h.Printf("from %s broadcast: %s %s %v\n", c.RemoteAddr(), v.Name, s, err)
-				h.store.Events <- storeEvent
-				h.publish(storeEvent)
 			}
+			n, status := h.dispatch(v, h.clock.Now())
+			if v.Header.Receipt > 0 {
+				c.SendReceipt(v.Header.Receipt, n, status)
+			}
+
+		}
+	}
+}
+
+// login 登入的第一個訊息一定是登入訊息, 失敗時回傳 false
+func (h *Hub) login(c Conn) bool {
+	for {
+		msg := c.Receive()
+		rc := responder(c, msg.Tag)
+		if msg.Error != nil {
+			h.Println(msg.Error)
+			rc.SendError(msg.Error)
+			return false
+		}
+
+		switch v := msg.Value.(type) {
+		case MessageAuth:
+			if err := h.auth(c, v); err != nil {
+				h.Println(err)
+				rc.SendError(err)
+				return false
+			}
+			return true
 
+		// 登入前也回應 ping / reset (ex: 連線池檢查或放回已 reset 的閒置連線)
+		case MessagePing:
+			rc.SendPong(v.Payload)
+		case MessageReset:
+			rc.SendReply("reset OK")
+
+		default:
+			h.Println(errNeedAuth)
+			rc.SendError(errNeedAuth)
+			return false
 		}
 	}
 }
 
+// connected 登入後送出連線事件並廣播 Join
+func (h *Hub) connected(c Conn) {
+	h.Printf("%s app(%s) connected\n", c.RemoteAddr(), c.GetName())
+
+	// 發送連線事件, 附帶連線 ID
+	if err := h.sendConnected(c); err != nil {
+		h.Println(err)
+	}
+
+	// 廣播具名客端 Join 事件
+	go func() {
+		// NOTE join event 可能會快過 subscribe
+		time.Sleep(time.Second * 3)
+		if pub, err := h.publishJoin(c); pub {
+			h.Printf("broadcast join: %s app(%s) %v\n", c.RemoteAddr(), c.GetName(), err)
+		}
+	}()
+}
+
 // ListenAndServe listen address and serve conn
 func (h *Hub) ListenAndServe(quit <-chan os.Signal, addr string, others ...Conn) error {
 
@@ -375,6 +931,12 @@ func (h *Hub) ListenAndServe(quit <-chan os.Signal, addr string, others ...Conn)
 		return err
 	}
 
+	h.Add(1)
+	go func() {
+		defer h.Done()
+		h.runScheduler()
+	}()
+
 	for _, c := range others {
 		go h.handle(c)
 	}
@@ -391,6 +953,7 @@ func (h *Hub) ListenAndServe(quit <-chan os.Signal, addr string, others ...Conn)
 
 	s := <-quit
 	h.Printf("Receive os.Signal %s\n", s)
+	h.cancel()
 	h.quitAll(time.Now())
 	h.Println("h.quitAll")
 	err = listener.Close()
@@ -402,6 +965,23 @@ func (h *Hub) ListenAndServe(quit <-chan os.Signal, addr string, others ...Conn)
 	return err
 }
 
+// sendConnected 送出連線事件, 資料為 {"ID":12,"Name":"app"}
+func (h *Hub) sendConnected(c Conn) error {
+	rd, err := event.Marshal(struct {
+		ID   int64
+		Name string
+	}{c.ID(), c.GetName()})
+	if err != nil {
+		return err
+	}
+	rdCompressed, err := event.Compress(rd)
+	if err != nil {
+		return err
+	}
+	c.SendEvent(string(connection.MakeEventStream(event.Connected, rdCompressed)))
+	return nil
+}
+
 func (h *Hub) publishJoin(c Conn) (pub bool, err error) {
 
 	if !c.HasName() {
@@ -416,14 +996,15 @@ func (h *Hub) publishJoin(c Conn) (pub bool, err error) {
 	if err != nil {
 		return
 	}
-	storeEvent := connection.MakeEvent(event.Join, rdCompressed, time.Unix(connAuth.ConnectedAt, 0))
+	storeEvent := connection.MakeEvent(event.Join, rdCompressed, time.Unix(0, connAuth.ConnectedAt))
 	h.publish(storeEvent, c)
 
 	return true, err
 }
 
 func (h *Hub) publishQuit(c Conn, auth *store.Auth) (pub bool, err error) {
-	if !c.HasName() {
+	// reset 後連線已沒有名稱, 以離線紀錄判斷
+	if auth.Name == "" {
 		return
 	}
 	rd, err := event.Marshal(auth)
@@ -434,7 +1015,7 @@ func (h *Hub) publishQuit(c Conn, auth *store.Auth) (pub bool, err error) {
 	if err != nil {
 		return
 	}
-	storeEvent := connection.MakeEvent(event.Leave, rdCompressed, time.Unix(auth.DisconnectedAt, 0))
+	storeEvent := connection.MakeEvent(event.Leave, rdCompressed, time.Unix(0, auth.DisconnectedAt))
 	h.publish(storeEvent, c)
 
 	return true, err
@@ -445,24 +1026,37 @@ func (h *Hub) info(ignoreWriteOnly bool) string {
 	h.RLock()
 	defer h.RUnlock()
 
-	ghost := []*ConnStatus{}
+	now := time.Now()
+	info := connection.Info{
+		StartedAt: h.startedAt.UnixNano(),
+		Uptime:    now.Sub(h.startedAt),
+		Events: connection.EventCounts{
+			Received:  atomic.LoadInt64(&h.received),
+			Saved:     atomic.LoadInt64(&h.saved),
+			Delivered: h.delivered,
+		},
+		StoreBacklog: h.store.Backlog(),
+		Auth:         map[string]*ConnStatus{},
+		Ghost:        []*ConnStatus{},
+	}
+
+	// NOTE ignore write only (launcher conn), 但送出的事件數照算
 	for c := range h.g {
-		if st := c.(*conn).status(ignoreWriteOnly); st != nil {
-			ghost = append(ghost, st)
+		st := c.(*conn).status()
+		info.Events.Delivered += st.Sent
+		if !ignoreWriteOnly || st.Flag != connection.Writable {
+			info.Ghost = append(info.Ghost, st)
 		}
 	}
-
-	auth := map[string]*ConnStatus{}
 	for name, c := range h.m {
-		if st := c.(*conn).status(ignoreWriteOnly); st != nil {
-			auth[name] = st
+		st := c.(*conn).status()
+		info.Events.Delivered += st.Sent
+		if !ignoreWriteOnly || st.Flag != connection.Writable {
+			info.Auth[name] = st
 		}
 	}
 
-	b, _ := event.Marshal(struct {
-		Auth  map[string]*ConnStatus
-		Ghost []*ConnStatus
-	}{auth, ghost})
+	b, _ := event.Marshal(info)
 
 	return string(b)
 }
@@ -3,16 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/colindev/events/client"
 	"github.com/colindev/events/connection"
 	"github.com/colindev/events/event"
 	"github.com/colindev/events/server/fake"
+	"github.com/colindev/events/store"
 )
 
 func createHub(t *testing.T) *Hub {
@@ -78,7 +83,7 @@ func TestHub_quit(t *testing.T) {
 
 	auth := hub.quit(c, now)
 
-	if auth.DisconnectedAt != now.Unix() {
+	if auth.DisconnectedAt != now.UnixNano() {
 		t.Errorf("hub.quit must set disconnected_at to conn %+v", auth)
 	}
 }
@@ -112,6 +117,182 @@ func TestHub_quitAll(t *testing.T) {
 	}
 }
 
+func TestHub_retained(t *testing.T) {
+	env := &Env{
+		AuthDSN:    "file:retained?mode=memory&cache=shared",
+		EventDSN:   "file:retained?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}
+	hub, err := NewHub(env, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	hub.retain(connection.MakeEvent("config.a", event.RawData("1"), now))
+	hub.retain(connection.MakeEvent("config.a", event.RawData("2"), now))
+	hub.retain(connection.MakeEvent("config.b", event.RawData("3"), now))
+	hub.retain(connection.MakeEvent("status.x", event.RawData("4"), now))
+	expired := connection.MakeEvent("config.z", event.RawData("5"), now)
+	expired.ExpiresAt = now.Add(-time.Second).UnixNano()
+	hub.retain(expired)
+
+	c := &conn{flags: connection.Readable, streams: make(chan *bytes.Buffer, 10)}
+	if n := hub.sendRetained(c, "config.*"); n != 2 {
+		t.Errorf("send retained expect 2, but %d", n)
+	}
+	for _, expect := range []string{"config.a:2", "config.b:3"} {
+		if buf := <-c.streams; !bytes.Contains(buf.Bytes(), []byte(expect)) {
+			t.Errorf("retained expect %s, but %q", expect, buf)
+		}
+	}
+
+	// 重新啟動後從 store 載入
+	hub2, err := NewHub(env, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hub2.retained) != 4 {
+		t.Errorf("reload retained error: %v", hub2.retained)
+	} else if e := hub2.retained["config.a"]; e.Raw != "config.a:2" {
+		t.Errorf("reload retained error: %+v", e)
+	}
+	if _, exists := hub.retained["config.z"]; exists {
+		t.Error("expired retained event must be dropped")
+	}
+}
+
+func TestHub_clock(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:hub_clock?mode=memory&cache=shared",
+		EventDSN:   "file:hub_clock?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	hub.clock = &fakeClock{now: past}
+
+	// 以 hub 的 clock 判斷是否過期, 不使用本地時鐘
+	e := connection.MakeEvent("config.a", event.RawData("1"), past)
+	e.ExpiresAt = past.Add(time.Minute).UnixNano()
+	if _, s := hub.sendEventTo("nobody", e); s != connection.ReceiptNoTarget {
+		t.Error("event must not be expired by hub clock, but", s)
+	}
+
+	hub.retain(e)
+	c := &conn{flags: connection.Readable, streams: make(chan *bytes.Buffer, 10)}
+	if n := hub.sendRetained(c, "config.*"); n != 1 {
+		t.Errorf("send retained expect 1, but %d", n)
+	}
+}
+
+func TestHub_inbox(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:inbox?mode=memory&cache=shared",
+		EventDSN:   "file:inbox?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if _, s := hub.sendEventTo("worker", connection.MakeEvent("job.done", event.RawData("0"), now)); s != connection.ReceiptNoTarget {
+		t.Errorf("unknown app expect [%s], but [%s]", connection.ReceiptNoTarget, s)
+	}
+
+	// 登入過的 app 離線時存入收件匣
+	hub.store.NewAuth(&store.Auth{Name: "worker", ConnectedAt: now.Add(-time.Hour).UnixNano(), DisconnectedAt: now.Add(-time.Minute).UnixNano()})
+	for i, name := range []event.Event{"job.done", "job.fail"} {
+		if _, s := hub.sendEventTo("worker", connection.MakeEvent(name, event.RawData(fmt.Sprint(i+1)), now)); s != connection.ReceiptQueued {
+			t.Errorf("offline app expect [%s], but [%s]", connection.ReceiptQueued, s)
+		}
+	}
+
+	// 沒有讀取權限時留在收件匣
+	w := &conn{chs: map[event.Event]bool{}, streams: make(chan *bytes.Buffer, 10)}
+	if err := hub.auth(w, MessageAuth{Name: "worker", Flags: connection.Writable}); err != nil {
+		t.Fatal(err)
+	}
+	w.Subscribe("job.*")
+	if n, err := hub.deliverInbox(w); err != nil || n != 0 || len(w.streams) != 0 {
+		t.Errorf("writable only conn must not take inbox %d %v", n, err)
+	}
+	if _, s := hub.sendEventTo("worker", connection.MakeEvent("job.wait", event.RawData("w"), now)); s != connection.ReceiptQueued {
+		t.Errorf("writable only app expect [%s], but [%s]", connection.ReceiptQueued, s)
+	}
+	hub.quit(w, time.Now())
+
+	c := &conn{chs: map[event.Event]bool{}, streams: make(chan *bytes.Buffer, 10)}
+	if err := hub.auth(c, MessageAuth{Name: "worker", Flags: 3}); err != nil {
+		t.Fatal(err)
+	}
+	c.Subscribe("job.done")
+	if n, err := hub.deliverInbox(c); err != nil || n != 1 {
+		t.Errorf("deliver inbox expect 1, but %d %v", n, err)
+	}
+	if buf := <-c.streams; !bytes.Contains(buf.Bytes(), []byte("job.done:1")) {
+		t.Errorf("inbox event error %q", buf)
+	}
+
+	// 還沒訂閱的留在收件匣
+	if _, s := hub.sendEventTo("worker", connection.MakeEvent("job.retry", event.RawData("3"), now)); s != connection.ReceiptQueued {
+		t.Errorf("not subscribed expect [%s], but [%s]", connection.ReceiptQueued, s)
+	}
+	if _, s := hub.sendEventTo("worker", connection.MakeEvent("job.done", event.RawData("4"), now)); s != connection.ReceiptDelivered {
+		t.Errorf("online app expect [%s], but [%s]", connection.ReceiptDelivered, s)
+	}
+	<-c.streams
+	c.Subscribe("job.*")
+	if n, _ := hub.deliverInbox(c); n != 3 {
+		t.Errorf("deliver inbox expect 3, but %d", n)
+	}
+	if n, _ := hub.deliverInbox(c); n != 0 {
+		t.Errorf("delivered events must be removed, but %d", n)
+	}
+}
+
+func TestHub_sendEventTo(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:multicast?mode=memory&cache=shared",
+		EventDSN:   "file:multicast?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := map[string]*conn{}
+	for _, name := range []string{"worker-1", "worker-2", "web-1"} {
+		c := &conn{chs: map[event.Event]bool{}, streams: make(chan *bytes.Buffer, 10)}
+		if err := hub.auth(c, MessageAuth{Name: name, Flags: 3}); err != nil {
+			t.Fatal(err)
+		}
+		c.Subscribe("job.*")
+		conns[name] = c
+	}
+
+	e := connection.MakeEvent("job.run", event.RawData("x"), time.Now())
+	if n, s := hub.sendEventTo("worker-*", e); n != 2 || s != connection.ReceiptDelivered {
+		t.Errorf("pattern target error %d %s", n, s)
+	}
+	// 重複的目標只送一次
+	if n, s := hub.sendEventTo("web-1, worker-1,worker-*,ghost", e); n != 3 || s != connection.ReceiptDelivered {
+		t.Errorf("list target error %d %s", n, s)
+	}
+	if n, s := hub.sendEventTo("ghost,db-*", e); n != 0 || s != connection.ReceiptNoTarget {
+		t.Errorf("no target error %d %s", n, s)
+	}
+
+	for name, cnt := range map[string]int{"worker-1": 2, "worker-2": 2, "web-1": 1} {
+		if n := len(conns[name].streams); n != cnt {
+			t.Errorf("%s expect %d events, but %d", name, cnt, n)
+		}
+	}
+}
+
 func BenchmarkHub_handle(b *testing.B) {
 
 	N := 10
@@ -212,3 +393,419 @@ func BenchmarkHub_handle(b *testing.B) {
 	}
 
 }
+
+func TestHub_connID(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:connid?mode=memory&cache=shared",
+		EventDSN:   "file:connid?mode=memory&cache=shared",
+		GCDuration: "1h",
+		Admin:      "admin",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestConn := func(name string) *conn {
+		c := newConn(&fake.NetConn{}, time.Now()).(*conn)
+		if err := hub.auth(c, MessageAuth{Name: name, Flags: 3}); err != nil {
+			t.Fatal(err)
+		}
+		c.Subscribe("job.*")
+		return c
+	}
+	anon1, anon2, worker := newTestConn(""), newTestConn(""), newTestConn("worker")
+	if anon1.ID() == 0 || anon1.ID() == anon2.ID() || anon2.ID() == worker.ID() {
+		t.Fatal("conn id must be unique", anon1.ID(), anon2.ID(), worker.ID())
+	}
+	if !hub.admin["admin"] || hub.admin["worker"] {
+		t.Error("admin list error", hub.admin)
+	}
+
+	if err := hub.sendConnected(anon1); err != nil {
+		t.Fatal(err)
+	}
+	if name, rd := readEvent(<-anon1.streams); name != event.Connected || string(rd) != fmt.Sprintf(`{"ID":%d,"Name":""}`, anon1.ID()) {
+		t.Errorf("connected event error %s %s", name, rd)
+	}
+
+	e := connection.MakeEvent("job.run", event.RawData("x"), time.Now())
+	target := connection.JoinTargets(connection.FormatConnID(anon1.ID()), connection.FormatConnID(worker.ID()), "worker")
+	if n, s := hub.sendEventTo(target, e); n != 2 || s != connection.ReceiptDelivered {
+		t.Errorf("conn id target error %d %s", n, s)
+	}
+	if n := len(anon1.streams) + len(anon2.streams) + len(worker.streams); n != 2 {
+		t.Errorf("expect 2 events, but %d", n)
+	}
+	if n, s := hub.sendEventTo("#99999", e); n != 0 || s != connection.ReceiptNoTarget {
+		t.Errorf("unknown conn id error %d %s", n, s)
+	}
+
+	// 對方沒在讀取 (streams 已滿) 也不阻塞 kick
+	defer func(d time.Duration) { closeTimeout = d }(closeTimeout)
+	closeTimeout = time.Millisecond * 50
+	for len(worker.streams) < cap(worker.streams) {
+		worker.SendEvent(e.Raw)
+	}
+	if n := hub.kick(connection.JoinTargets(connection.FormatConnID(anon2.ID()), "work*", "worker")); n != 2 {
+		t.Errorf("kick expect 2, but %d", n)
+	}
+	if buf := <-anon2.streams; !bytes.Contains(buf.Bytes(), []byte("kicked")) {
+		t.Errorf("kicked error must be sent %q", buf)
+	}
+	for i := 0; i < 20 && (anon2.Err() == nil || worker.Err() == nil); i++ {
+		time.Sleep(closeTimeout)
+	}
+	if anon2.Err() != errKicked || worker.Err() != errKicked || anon1.Err() != nil {
+		t.Error("kick error", anon1.Err(), anon2.Err(), worker.Err())
+	}
+	// 被 kick 的連線不再寫入
+	worker.SendEvent(e.Raw)
+}
+
+func TestHub_info(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:info?mode=memory&cache=shared",
+		EventDSN:   "file:info?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker := newConn(&fake.NetConn{}, time.Now()).(*conn)
+	launcher := newConn(&fake.NetConn{}, time.Now()).(*conn)
+	hub.auth(worker, MessageAuth{Name: "worker", Flags: 3})
+	hub.auth(launcher, MessageAuth{Flags: connection.Writable})
+
+	e := connection.MakeEvent("job.run", event.RawData("x"), time.Now())
+	hub.save(e)
+	worker.SendEvent(e.Raw)
+
+	readInfo := func() connection.Info {
+		var info connection.Info
+		if err := event.Unmarshal(event.RawData(hub.info(true)), &info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	info := readInfo()
+	if info.Uptime <= 0 || info.StartedAt != hub.startedAt.UnixNano() {
+		t.Error("uptime error", info.StartedAt, info.Uptime)
+	}
+	if info.Events.Saved != 1 || info.Events.Delivered != 1 {
+		t.Errorf("event counts error %+v", info.Events)
+	}
+	if st := info.Auth["worker"]; st == nil || st.Sent != 1 || st.Pending != 1 || st.ID != worker.ID() {
+		t.Errorf("worker status error %+v", st)
+	}
+	// 寫入專用連線不列出
+	if len(info.Ghost) != 0 {
+		t.Errorf("write only conn must be ignored %+v", info.Ghost)
+	}
+
+	// 離線後送出的事件數保留在總數, 重複離線不重複累計
+	hub.quit(worker, time.Now())
+	hub.quit(worker, time.Now())
+	if info := readInfo(); info.Events.Delivered != 1 || len(info.Auth) != 0 {
+		t.Errorf("delivered after quit error %+v", info)
+	}
+}
+
+func TestHub_query(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:query?mode=memory&cache=shared",
+		EventDSN:   "file:query?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i, name := range []string{"job.a", "job.b", "user.login", "job.c"} {
+		e := connection.MakeEvent(event.Event(name), event.RawData(name), now.Add(time.Duration(i)))
+		hub.store.Events <- e
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	c := &conn{streams: make(chan *bytes.Buffer, 10)}
+	names := func() []string {
+		list := []string{}
+		for len(c.streams) > 0 {
+			list = append(list, (<-c.streams).String())
+		}
+		return list
+	}
+
+	q := connection.Query{ID: 7, Names: []string{"job.*"}, Limit: 2}
+	if n, err := hub.query(c, q); n != 2 || err != nil {
+		t.Fatal("query error", n, err)
+	}
+	list := names()
+	if len(list) != 3 || !strings.Contains(list[0], "job.a") || !strings.Contains(list[1], "job.b") || !strings.HasPrefix(list[2], "%7:2:") {
+		t.Fatal("query first page error", list)
+	}
+
+	_, _, q.After, _ = connection.ParseQueryEnd([]byte(strings.TrimSpace(list[2][1:])))
+	if n, err := hub.query(c, q); n != 1 || err != nil {
+		t.Fatal("query next page error", n, err)
+	}
+	list = names()
+	if len(list) != 2 || !strings.Contains(list[0], "job.c") || list[1] != "%7:1:\r\n" {
+		t.Error("query last page error", list)
+	}
+}
+
+// readEvent 拆開 SendEvent 寫出的事件並解壓縮
+func readEvent(buf *bytes.Buffer) (event.Event, event.RawData) {
+	br := bufio.NewReader(buf)
+	line, _ := connection.ReadLine(br)
+	p, _ := connection.ReadLen(br, line[1:])
+	name, rd, _ := connection.ParseEvent(p)
+	rd, _ = event.Uncompress(rd)
+	return name, rd
+}
+
+func TestHub_recoverReport(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:recoverreport?mode=memory&cache=shared",
+		EventDSN:   "file:recoverreport?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i, name := range []string{"job.a", "user.login", "job.b"} {
+		hub.store.Events <- connection.MakeEvent(event.Event(name), event.RawData(name), now.Add(time.Duration(i)))
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	c := &conn{flags: connection.Readable, chs: map[event.Event]bool{}, streams: make(chan *bytes.Buffer, 10)}
+	c.Subscribe("job.*")
+	since, until := now.Add(-time.Second).UnixNano(), now.Add(time.Second).UnixNano()
+	if _, err := hub.recover(c, since, until); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []event.Event{}
+	var begin, end connection.RecoverReport
+	for len(c.streams) > 0 {
+		name, rd := readEvent(<-c.streams)
+		names = append(names, name)
+		switch name {
+		case event.RecoverBegin:
+			event.Unmarshal(rd, &begin)
+		case event.RecoverEnd:
+			event.Unmarshal(rd, &end)
+		}
+	}
+	if fmt.Sprint(names) != "[recover.begin job.a job.b recover.end]" {
+		t.Error("recover stream error", names)
+	}
+	// until 不超過開始 recover 的時間
+	if begin.Since != since || begin.Until >= until || begin.Until < now.UnixNano() || end.Count != 2 || end.Error != "" {
+		t.Errorf("recover report error %+v %+v", begin, end)
+	}
+
+	// 沒有上次登入紀錄也要送出結束事件
+	if _, err := hub.recover(c, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.streams) != 2 {
+		t.Error("recover without last auth must send begin/end", len(c.streams))
+	}
+
+	// 帶編號的 recover 在 recover.end 之後回應
+	for len(c.streams) > 0 {
+		<-c.streams
+	}
+	hub.replyRecover(c, 9, MessageRecover{Since: since, Until: until})
+	var last string
+	for len(c.streams) > 0 {
+		last = (<-c.streams).String()
+	}
+	if last != ":9*recover OK 2\r\n" {
+		t.Errorf("tagged recover reply error %q", last)
+	}
+}
+
+func TestHub_recoverFromRing(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:ring?mode=memory&cache=shared",
+		EventDSN:   "file:ring?mode=memory&cache=shared",
+		GCDuration: "1h",
+		RingSize:   10,
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只放進 ring, 不寫入 store
+	now := time.Now()
+	for i, name := range []string{"job.a", "user.login", "job.b"} {
+		hub.ring.add(connection.MakeEvent(event.Event(name), event.RawData(name), now.Add(time.Duration(i))))
+	}
+	expired := connection.MakeEvent("job.expired", event.RawData("x"), now)
+	expired.ExpiresAt = now.UnixNano()
+	hub.ring.add(expired)
+
+	c := &conn{flags: connection.Readable, chs: map[event.Event]bool{}, streams: make(chan *bytes.Buffer, 10)}
+	c.Subscribe("job.*")
+	if _, err := hub.recover(c, now.UnixNano(), 0); err != nil {
+		t.Fatal(err)
+	}
+	names := []event.Event{}
+	for len(c.streams) > 0 {
+		name, _ := readEvent(<-c.streams)
+		names = append(names, name)
+	}
+	if fmt.Sprint(names) != "[recover.begin job.a job.b recover.end]" {
+		t.Error("recover from ring error", names)
+	}
+
+	// ring 啟動前的範圍改查 store
+	if _, ok := hub.recentEvents(now.Add(-time.Hour).UnixNano(), 0, now.UnixNano()); ok {
+		t.Error("range before ring start must fall back to store")
+	}
+}
+
+func TestHub_reset(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:reset?mode=memory&cache=shared",
+		EventDSN:   "file:reset?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newConn(&fake.NetConn{}, time.Now()).(*conn)
+	hub.auth(c, MessageAuth{Name: "worker", Flags: 3})
+	c.Subscribe("job.*")
+	c.SendEvent(connection.MakeEvent("job.run", event.RawData("x"), time.Now()).Raw)
+
+	now := time.Now()
+	auth := hub.reset(c, now)
+	if auth.Name != "worker" || auth.DisconnectedAt != now.UnixNano() {
+		t.Errorf("reset must return leave auth %+v", auth)
+	}
+	if c.IsAuthed() || c.HasName() || c.GetFlags() != 0 || c.IsListening("job.run") {
+		t.Errorf("conn state must be cleared %+v", c.status())
+	}
+	if _, exists := hub.m["worker"]; exists || c.Err() != nil {
+		t.Error("reset must remove conn from hub but keep it open", hub.m, c.Err())
+	}
+	if info := hub.info(false); !strings.Contains(info, `"Delivered":1`) {
+		t.Error("delivered must be kept after reset", info)
+	}
+
+	// 同一條連線可用其他身份重新登入
+	if err := hub.auth(c, MessageAuth{Name: "worker", Flags: connection.Writable}); err != nil {
+		t.Error("auth after reset error", err)
+	}
+	if !c.Writable() || c.Readable() || c.GetAuth().ConnectedAt != now.UnixNano() {
+		t.Errorf("re-auth error %+v", c.status())
+	}
+}
+
+func TestHub_recoverAfterLive(t *testing.T) {
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:recoverlive?mode=memory&cache=shared",
+		EventDSN:   "file:recoverlive?mode=memory&cache=shared",
+		GCDuration: "1h",
+		RingSize:   10,
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newConn(&fake.NetConn{}, time.Now()).(*conn)
+	hub.auth(c, MessageAuth{Flags: connection.Readable})
+	now := time.Now()
+	hub.save(connection.MakeEvent("job.a", event.RawData("a"), now))
+
+	// subscribe 後先收到即時事件才 Recover
+	c.Subscribe("job.*")
+	live := connection.MakeEvent("job.b", event.RawData("b"), now.Add(time.Millisecond))
+	hub.save(live)
+	hub.publish(live)
+	if _, err := hub.recover(c, now.UnixNano(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []event.Event{}
+	for len(c.streams) > 0 {
+		name, _ := readEvent(<-c.streams)
+		names = append(names, name)
+	}
+	if fmt.Sprint(names) != "[job.b recover.begin job.a recover.end]" {
+		t.Error("live event must not be replayed", names)
+	}
+}
+
+// serveTCP 以本機隨機 port 提供 hub 服務
+func serveTCP(t *testing.T, hub *Hub) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go hub.handle(newConn(c, time.Now()))
+		}
+	}()
+	return ln
+}
+
+func TestHub_poolPingCheck(t *testing.T) {
+
+	hub, err := NewHub(&Env{
+		AuthDSN:    "file:pool_ping?mode=memory&cache=shared",
+		EventDSN:   "file:pool_ping?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln := serveTCP(t, hub)
+	defer ln.Close()
+
+	dialed := 0
+	p := client.NewPool(func() (client.Conn, error) {
+		dialed++
+		return client.Dial("worker", ln.Addr().String())
+	}, 1)
+	// 放回時已 reset, 借出時在登入前 ping
+	p.TestOnBorrow(client.PingCheck(0, time.Second))
+
+	for i := 0; i < 3; i++ {
+		c := p.Get()
+		if err := c.Err(); err != nil {
+			t.Fatal(i, err)
+		}
+		// 第二次借出不登入直接放回
+		if i != 1 {
+			if err := c.Auth(connection.Readable | connection.Writable); err != nil {
+				t.Fatal(i, err)
+			}
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	if dialed != 1 {
+		t.Error("idle conn must be reused, dialed:", dialed)
+	}
+	if s := p.Stats(); s.Idle != 1 {
+		t.Error("expect 1 idle conn", s)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/colindev/events/client"
 	"github.com/colindev/osenv"
 	"github.com/joho/godotenv"
 )
@@ -58,7 +59,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
 
 	if env.Follow != "" {
-		Follow(hub, env.Follow, 0)
+		Follow(hub, client.NewDialer("", env.Follow), 0)
 	}
 
 	if err := hub.ListenAndServe(quit, env.Addr); err != nil {
@@ -1,9 +1,14 @@
 package main
 
-import "github.com/colindev/events/event"
+import (
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/event"
+)
 
 // Message contain all data
 type Message struct {
+	// 請求編號, 回應時帶回, 0 為沒有編號
+	Tag    int64
 	Action byte
 	Value  interface{}
 	Error  error
@@ -39,9 +44,23 @@ type MessagePing struct {
 // MessageInfo contain info request data
 type MessageInfo struct{}
 
+// MessageReset contain reset request data
+type MessageReset struct{}
+
+// MessageQuery contain history query request data
+type MessageQuery struct {
+	connection.Query
+}
+
+// MessageKick contain kick request data
+type MessageKick struct {
+	Target string
+}
+
 // MessageEvent contain event request data
 type MessageEvent struct {
 	To      string
 	Name    event.Event
 	RawData event.RawData
+	Header  connection.Header
 }
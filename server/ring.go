@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/colindev/events/store"
+)
+
+// ring 保留最近的事件, 短時間斷線的 recover 不用查資料庫
+// 同 store 以 Hash 去重 (內容相同的事件只保留第一筆), 讓 recover 不論從 ring 或 store 取出的結果一致
+// 例外: 相同內容的舊事件已移出 ring 但仍在 store 時, ring 會保留新的這筆, store 不會
+type ring struct {
+	sync.RWMutex
+	buf  []*store.Event
+	next int
+	full bool
+	// 此時間 (unix nano) 之後的事件都在 ring 內
+	from int64
+	// ring 內的事件 Hash
+	hashes map[string]bool
+}
+
+func newRing(size int, t time.Time) *ring {
+	return &ring{
+		buf:    make([]*store.Event, size),
+		from:   t.UnixNano(),
+		hashes: map[string]bool{},
+	}
+}
+
+func (r *ring) add(e *store.Event) {
+	r.Lock()
+	defer r.Unlock()
+	if r.hashes[e.Hash] {
+		return
+	}
+	if old := r.buf[r.next]; old != nil {
+		if old.ReceivedAt > r.from {
+			r.from = old.ReceivedAt
+		}
+		delete(r.hashes, old.Hash)
+	}
+	r.hashes[e.Hash] = true
+	r.buf[r.next] = e
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// events 依寫入順序回傳 since ~ until 的事件, ring 沒有涵蓋 since 時回傳 false
+func (r *ring) events(since, until int64) ([]*store.Event, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if since <= r.from {
+		return nil, false
+	}
+
+	list := []*store.Event{}
+	start, n := 0, r.next
+	if r.full {
+		start, n = r.next, len(r.buf)
+	}
+	for i := 0; i < n; i++ {
+		e := r.buf[(start+i)%len(r.buf)]
+		if e.ReceivedAt >= since && (until <= 0 || e.ReceivedAt <= until) {
+			list = append(list, e)
+		}
+	}
+
+	return list, true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/event"
+)
+
+func TestRing(t *testing.T) {
+	start := time.Unix(100, 0)
+	r := newRing(3, start)
+
+	if _, ok := r.events(start.UnixNano(), 0); ok {
+		t.Error("ring must not cover events before start")
+	}
+
+	for i := 1; i <= 4; i++ {
+		r.add(connection.MakeEvent(event.Event(fmt.Sprintf("e.%d", i)), event.RawData("x"), start.Add(time.Duration(i))))
+	}
+
+	// e.1 已被擠出, 只涵蓋 e.1 之後
+	if _, ok := r.events(start.Add(1).UnixNano(), 0); ok {
+		t.Error("evicted range must fall back to store")
+	}
+	list, ok := r.events(start.Add(2).UnixNano(), start.Add(3).UnixNano())
+	names := []string{}
+	for _, e := range list {
+		names = append(names, e.Name)
+	}
+	if !ok || fmt.Sprint(names) != "[e.2 e.3]" {
+		t.Error("ring events error", ok, names)
+	}
+}
+
+func TestRing_dedupe(t *testing.T) {
+	start := time.Unix(100, 0)
+	r := newRing(3, start)
+
+	// 同 store, 內容相同的事件只保留第一筆
+	r.add(connection.MakeEvent("e.a", event.RawData("x"), start.Add(1)))
+	r.add(connection.MakeEvent("e.a", event.RawData("x"), start.Add(2)))
+	r.add(connection.MakeEvent("e.b", event.RawData("x"), start.Add(3)))
+
+	list, ok := r.events(start.Add(1).UnixNano(), 0)
+	got := []string{}
+	for _, e := range list {
+		got = append(got, fmt.Sprintf("%s@%d", e.Name, e.ReceivedAt-start.UnixNano()))
+	}
+	if !ok || fmt.Sprint(got) != "[e.a@1 e.b@3]" {
+		t.Error("ring dedupe error", ok, got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"time"
+
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/store"
+)
+
+// Clock 排程用時間來源, 測試時可替換
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// 沒有排程時最久多久檢查一次
+const maxSchedulerWait = time.Minute
+
+// dispatch 立即處理事件: 指定傳送或儲存後廣播, 回傳收到的數量與傳送結果
+func (h *Hub) dispatch(v MessageEvent, now time.Time) (int, string) {
+	storeEvent := connection.MakeEvent(v.Name, v.RawData, now)
+	storeEvent.Key = v.Header.Key
+	if v.Header.TTL > 0 {
+		storeEvent.ExpiresAt = now.Add(v.Header.TTL).UnixNano()
+	}
+
+	if v.To != "" {
+		// 指定傳送不進事件流, 目標離線時存入收件匣
+		return h.sendEventTo(v.To, storeEvent)
+	}
+
+	storeEvent.Retain = v.Header.Retain
+	h.save(storeEvent)
+	if v.Header.Retain {
+		h.retain(storeEvent)
+	}
+	return h.publish(storeEvent), connection.ReceiptDelivered
+}
+
+// dueAt 計算排程時間, 不需要排程時回傳 0
+func (h *Hub) dueAt(head connection.Header) int64 {
+	now := h.clock.Now()
+	switch {
+	case head.At > now.UnixNano():
+		return head.At
+	case head.Delay > 0:
+		return now.Add(head.Delay).UnixNano()
+	}
+	return 0
+}
+
+// schedule 將事件存入 store 等到期後送出
+func (h *Hub) schedule(v MessageEvent, dueAt int64) error {
+	err := h.store.AddScheduled(&store.Scheduled{
+		DueAt:     dueAt,
+		Target:    v.To,
+		Name:      v.Name.String(),
+		Raw:       string(connection.MakeEventStream(v.Name, v.RawData)),
+		Key:       v.Header.Key,
+		Retain:    v.Header.Retain,
+		TTL:       int64(v.Header.TTL),
+		CreatedAt: h.clock.Now().UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// runScheduled 送出 now 之前到期的排程事件, 回傳送出數量
+func (h *Hub) runScheduled(now time.Time) (int, error) {
+	list, err := h.store.DueScheduled(now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	for i, sc := range list {
+		name, rd, err := connection.ParseEvent([]byte(sc.Raw))
+		if err != nil {
+			h.Printf("scheduled(%d) %s broken: %v\n", sc.ID, sc.Name, err)
+		} else {
+			h.Printf("scheduled(%d) due: %s to(%s)\n", sc.ID, sc.Name, sc.Target)
+			h.dispatch(MessageEvent{
+				To:      sc.Target,
+				Name:    name,
+				RawData: rd,
+				Header: connection.Header{
+					Key:    sc.Key,
+					Retain: sc.Retain,
+					TTL:    time.Duration(sc.TTL),
+				},
+			}, now)
+		}
+		// 先送出再刪除, 中途關閉時寧可重送也不遺失
+		if err := h.store.DeleteScheduled(sc.ID); err != nil {
+			return i + 1, err
+		}
+	}
+
+	return len(list), nil
+}
+
+// runScheduler 等待最近一筆排程到期, 直到 server 關閉
+func (h *Hub) runScheduler() {
+	for {
+		if _, err := h.runScheduled(h.clock.Now()); err != nil {
+			h.Println("scheduler:", err)
+		}
+
+		wait := maxSchedulerWait
+		next, err := h.store.NextScheduled()
+		if err != nil {
+			h.Println("scheduler:", err)
+		} else if next > 0 {
+			if d := time.Duration(next - h.clock.Now().UnixNano()); d < wait {
+				wait = d
+			}
+		}
+
+		select {
+		case <-h.clock.After(wait):
+		case <-h.wake:
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/colindev/events/connection"
+	"github.com/colindev/events/event"
+)
+
+type fakeClock struct {
+	sync.Mutex
+	now   time.Time
+	after chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+func (c *fakeClock) After(time.Duration) <-chan time.Time { return c.after }
+func (c *fakeClock) Set(t time.Time) {
+	c.Lock()
+	c.now = t
+	c.Unlock()
+}
+
+func TestHub_schedule(t *testing.T) {
+	env := &Env{
+		AuthDSN:    "file:scheduled?mode=memory&cache=shared",
+		EventDSN:   "file:scheduled?mode=memory&cache=shared",
+		GCDuration: "1h",
+	}
+	hub, err := NewHub(env, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1484027821, 0)
+	clk := &fakeClock{now: now, after: make(chan time.Time)}
+	hub.clock = clk
+
+	c := &conn{chs: map[event.Event]bool{}, streams: make(chan *bytes.Buffer, 10)}
+	hub.auth(c, MessageAuth{Flags: 3})
+	c.Subscribe("reminder.*")
+
+	if at := hub.dueAt(connection.Header{Delay: time.Minute}); at != now.Add(time.Minute).UnixNano() {
+		t.Errorf("delay due at error: %d", at)
+	}
+	if at := hub.dueAt(connection.Header{At: now.Add(-time.Second).UnixNano()}); at != 0 {
+		t.Errorf("past at must not be scheduled: %d", at)
+	}
+
+	v := MessageEvent{Name: "reminder.a", RawData: event.RawData("x")}
+	if err := hub.schedule(v, now.Add(time.Minute).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := hub.runScheduled(now); err != nil || n != 0 {
+		t.Errorf("not due yet, but sent %d %v", n, err)
+	}
+
+	// 重新啟動後仍然保留
+	hub2, err := NewHub(env, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub2.clock = clk
+	hub2.auth(c, MessageAuth{Flags: 3})
+
+	done := make(chan struct{})
+	go func() {
+		hub2.runScheduler()
+		close(done)
+	}()
+	clk.Set(now.Add(time.Minute))
+	clk.after <- clk.Now()
+
+	select {
+	case buf := <-c.streams:
+		if !bytes.Contains(buf.Bytes(), []byte("reminder.a:x")) {
+			t.Errorf("scheduled event error %q", buf)
+		}
+	case <-time.After(time.Second):
+		t.Error("scheduled event not published")
+	}
+
+	if next, _ := hub2.store.NextScheduled(); next != 0 {
+		t.Error("sent scheduled event must be deleted")
+	}
+
+	// 新排程會喚醒排程器
+	if err := hub2.schedule(MessageEvent{Name: "reminder.b", RawData: event.RawData("y")}, now.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case buf := <-c.streams:
+		if !bytes.Contains(buf.Bytes(), []byte("reminder.b:y")) {
+			t.Errorf("scheduled event error %q", buf)
+		}
+	case <-time.After(time.Second):
+		t.Error("wake scheduler fail")
+	}
+
+	hub2.cancel()
+	<-done
+}
@@ -44,9 +44,55 @@ func makeReply(m string) *bytes.Buffer {
 	return buf
 }
 
+func makeReceipt(id int64, n int, status string) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(connection.CReceipt)
+	buf.WriteString(strconv.FormatInt(id, 10))
+	buf.WriteByte(':')
+	buf.WriteString(strconv.Itoa(n))
+	buf.WriteByte(':')
+	buf.WriteString(status)
+	return buf
+}
+
+func makeRow(id int64, pos connection.Position, e string) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(connection.CRow)
+	buf.WriteString(strconv.FormatInt(id, 10))
+	buf.WriteByte(':')
+	buf.WriteString(pos.String())
+	buf.WriteByte(':')
+	buf.WriteString(strconv.Itoa(len(e)))
+	buf.Write(connection.EOL)
+	buf.WriteString(e)
+	return buf
+}
+
+func makeQueryEnd(id int64, n int, next connection.Position) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(connection.CQueryEnd)
+	buf.WriteString(strconv.FormatInt(id, 10))
+	buf.WriteByte(':')
+	buf.WriteString(strconv.Itoa(n))
+	buf.WriteByte(':')
+	buf.WriteString(next.String())
+	return buf
+}
+
+// makeTagged 在回應前加上請求編號
+func makeTagged(tag int64, resp *bytes.Buffer) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(connection.CTag)
+	buf.WriteString(strconv.FormatInt(tag, 10))
+	buf.Write(resp.Bytes())
+	return buf
+}
+
+// makeError 一律帶錯誤代碼, 未分類的錯誤為 ERR
 func makeError(err error) *bytes.Buffer {
-	buf := makeLen(connection.CErr, len(err.Error()))
-	buf.WriteString(err.Error())
+	s := connection.ToError(err).Error()
+	buf := makeLen(connection.CErr, len(s))
+	buf.WriteString(s)
 	return buf
 }
 
@@ -61,3 +107,18 @@ func makeEvent(e string) *bytes.Buffer {
 	buf.WriteString(e)
 	return buf
 }
+
+// makeEventWithHeader 長度之後附帶 header, 只送給 Meta 連線
+func makeEventWithHeader(h connection.Header, e string) *bytes.Buffer {
+	if h.IsZero() {
+		return makeEvent(e)
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(connection.CEvent)
+	buf.WriteString(strconv.Itoa(len(e)))
+	buf.WriteByte(' ')
+	buf.WriteString(h.String())
+	buf.Write(connection.EOL)
+	buf.WriteString(e)
+	return buf
+}
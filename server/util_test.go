@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+
+	"github.com/colindev/events/connection"
 )
 
 func Test_makeLen(t *testing.T) {
@@ -25,6 +27,19 @@ func Test_makeEvent(t *testing.T) {
 	}
 }
 
+func Test_makeEventWithHeader(t *testing.T) {
+	eventText := `a.b:1`
+	h := connection.Header{Key: "k", ReceivedAt: 1484027821000000000}
+	expect := "=5 key=k received=1484027821\r\n" + eventText
+
+	if buf := makeEventWithHeader(h, eventText); buf.String() != expect {
+		t.Errorf("expect %q. but %q", expect, buf.String())
+	}
+	if buf := makeEventWithHeader(connection.Header{}, eventText); buf.String() != makeEvent(eventText).String() {
+		t.Errorf("empty header expect plain event. but %q", buf.String())
+	}
+}
+
 func Test_makePong(t *testing.T) {
 	pingText := `111 222 333 444
 555 666`
@@ -46,12 +61,28 @@ func Test_makeReply(t *testing.T) {
 	}
 }
 
+func Test_makeReceipt(t *testing.T) {
+	expect := `^12:3:delivered`
+
+	buf := makeReceipt(12, 3, "delivered")
+	if buf.String() != expect {
+		t.Errorf("expect %s. but %s", expect, buf.String())
+	}
+}
+
 func Test_makeError(t *testing.T) {
 	err := errors.New("test error\r\n\t123\r\n\t456")
-	expect := fmt.Sprintf(`!%d%s%s`, len(err.Error()), "\r\n", err.Error())
+	s := "ERR " + err.Error()
+	expect := fmt.Sprintf(`!%d%s%s`, len(s), "\r\n", s)
 
 	buf := makeError(err)
 	if buf.String() != expect {
 		t.Errorf("expect %s. but %s", expect, buf.String())
 	}
+
+	s = "DENIED permission denied"
+	expect = fmt.Sprintf(`!%d%s%s`, len(s), "\r\n", s)
+	if buf := makeError(errNotAdmin); buf.String() != expect {
+		t.Errorf("expect %s. but %s", expect, buf.String())
+	}
 }
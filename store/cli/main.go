@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/colindev/events/connection"
@@ -36,21 +37,21 @@ func (chs Channels) String() string {
 // Date for flag.Value
 type Date time.Time
 
-// Set from flag
+// Set from flag, 接受 {秒}[.{小數}] 或 RFC3339Nano
 func (d *Date) Set(s string) (err error) {
-	i, err := strconv.ParseInt(s, 10, 64)
+	ns, err := connection.ParseTimestamp(s)
 	if err == nil {
-		*d = Date(time.Unix(i, 0))
+		*d = Date(time.Unix(0, ns))
 		return
 	}
 
-	t, err := time.Parse(time.RFC3339, s)
+	t, err := time.Parse(time.RFC3339Nano, s)
 	*d = Date(t)
 	return
 }
 
 func (d *Date) String() string {
-	return time.Time(*d).Format(time.RFC3339)
+	return time.Time(*d).Format(time.RFC3339Nano)
 }
 
 var (
@@ -115,39 +116,46 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\033[32msearch %v\033[m\n", channels)
 	}
 
-	s.EachEvents(func(e *store.Event) (end error) {
-
-		defer func() {
-			if limit == 0 {
-				end = io.EOF
-			}
-		}()
+	ctx, cancel := context.WithCancel(context.Background())
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	cur := s.Cursor(ctx, store.Query{
+		Prefix: eventPrefix,
+		Since:  time.Time(sinceDate).UnixNano(),
+		Until:  time.Time(untilDate).UnixNano(),
+	})
+	for limit != 0 && cur.Next() {
+		e := cur.Event()
 
 		ev, rd, err := connection.ParseEvent([]byte(e.Raw))
 		if err != nil {
 			log.Println(err)
-			return
+			continue
 		}
 
 		rd, err = event.Uncompress(rd)
 		if err != nil {
 			log.Println(err)
-			return
+			continue
 		}
 
 		for ch := range channels {
 			if event.Event(ch).Match(ev) {
 				limit--
 				if verbose {
-					fmt.Fprintf(os.Stderr, "\033[32m(\033[33m%d\033[32m) %s\033[m\n", e.ReceivedAt, time.Unix(e.ReceivedAt, 0).Format(time.RFC3339))
+					fmt.Fprintf(os.Stderr, "\033[32m(\033[33m%s\033[32m) %s\033[m\n", connection.FormatTimestamp(e.ReceivedAt), time.Unix(0, e.ReceivedAt).Format(time.RFC3339Nano))
 				}
 				fmt.Fprintf(os.Stdout, "%s %s\n", ev, rd)
-				time.Sleep(time.Millisecond * 500)
 				break
 			}
 		}
-
-		return
-	}, eventPrefix, time.Time(sinceDate).Unix(), time.Time(untilDate).Unix())
-
+	}
+	if err := cur.Err(); err != nil && err != context.Canceled {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Compaction 壓縮規則
+// 符合 Pattern 且帶 key 的事件, 超過 Horizon 後同一個 key 只保留最新一筆
+type Compaction struct {
+	Pattern string
+	Horizon time.Duration
+}
+
+func (c Compaction) String() string {
+	return c.Pattern + "=" + c.Horizon.String()
+}
+
+// ParseCompaction 解析壓縮規則
+// 格式 {pattern}={horizon};... ex: user.profile.*=1h;config.*=10m
+func ParseCompaction(s string) ([]Compaction, error) {
+
+	list := []Compaction{}
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("compaction schema error: %s", rule)
+		}
+
+		horizon, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("compaction %s: %v", rule, err)
+		}
+
+		list = append(list, Compaction{Pattern: kv[0], Horizon: horizon})
+	}
+
+	return list, nil
+}
+
+// CompactReport 單一壓縮規則的清除數量
+type CompactReport struct {
+	Pattern string
+	Deleted int64
+}
+
+// supersededWhere 組合已被同 key 較新事件取代的條件
+// until 大於 0 時, 只有 until 之前的事件可以取代舊事件
+func supersededWhere(c Compaction, horizon, until int64) (string, []interface{}) {
+	match, args := matchEvents(c.Pattern)
+
+	newer := `SELECT 1 FROM events AS newer WHERE ` + match + `
+		AND newer."key" = events."key"
+		AND (newer.received_at > events.received_at OR (newer.received_at = events.received_at AND newer.seq > events.seq))`
+	innerArgs := append([]interface{}{}, args...)
+	if until > 0 {
+		newer += " AND newer.received_at <= ?"
+		innerArgs = append(innerArgs, until)
+	}
+
+	where := "(" + match + ` AND events."key" != '' AND events.received_at < ? AND EXISTS (` + newer + "))"
+	args = append(append(args, horizon), innerArgs...)
+
+	return where, args
+}
+
+func (s *Store) compact(t time.Time, c Compaction) (CompactReport, error) {
+	where, args := supersededWhere(c, t.Add(-c.Horizon).UnixNano(), 0)
+	ret := s.events.Exec("DELETE FROM events WHERE "+where, args...)
+
+	return CompactReport{Pattern: c.Pattern, Deleted: ret.RowsAffected}, ret.Error
+}
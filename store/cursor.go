@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const defaultPageSize = 100
+
+// Position 事件排序位置, 以 (received_at, seq) 當作分頁鍵值
+type Position struct {
+	ReceivedAt int64
+	Seq        int64
+}
+
+// IsZero 表示還沒讀過任何事件
+func (p Position) IsZero() bool {
+	return p.ReceivedAt == 0 && p.Seq == 0
+}
+
+// Query 事件查詢條件
+type Query struct {
+	Prefix []string
+	// 事件名稱 pattern (語意同 event.Event.Match), 符合任一即可
+	Names []string
+	Since int64
+	// 小於等於 0 時不限制
+	Until int64
+	// 從此位置之後開始讀取 (不含)
+	After Position
+	// 每次向資料庫取回的筆數
+	PageSize int
+	// 套用壓縮規則: 超過 horizon 的事件同 key 只回傳最新一筆
+	Compact bool
+	// 大於 0 時排除在此時間 (unix nano) 已過期的事件
+	Unexpired int64
+	// 壓縮規則計算 horizon 的基準時間 (unix nano), 0 時使用目前時間
+	Now int64
+}
+
+// Cursor 依照 (received_at, seq) 逐頁讀取事件
+// 不使用 OFFSET, 所以每頁成本固定, GC 中途刪除資料也不會跳號或重複
+type Cursor struct {
+	ctx  context.Context
+	db   *gorm.DB
+	q    Query
+	pos  Position
+	page []*Event
+	i    int
+	ev   *Event
+	done bool
+	err  error
+}
+
+// Cursor 建立事件游標
+func (s *Store) Cursor(ctx context.Context, q Query) *Cursor {
+	if q.PageSize <= 0 {
+		q.PageSize = defaultPageSize
+	}
+
+	db := s.events.Where("received_at >= ?", q.Since)
+	if len(q.Prefix) > 0 {
+		db = db.Where("prefix IN (?)", q.Prefix)
+	}
+	if len(q.Names) > 0 {
+		where := []string{}
+		args := []interface{}{}
+		for _, name := range q.Names {
+			w, a := matchEvents(name)
+			where = append(where, w)
+			args = append(args, a...)
+		}
+		db = db.Where("("+strings.Join(where, " OR ")+")", args...)
+	}
+	if q.Until > 0 {
+		db = db.Where("received_at <= ?", q.Until)
+	}
+	if q.Unexpired > 0 {
+		db = db.Where("(expires_at = 0 OR expires_at > ?)", q.Unexpired)
+	}
+	if q.Compact {
+		now := time.Now()
+		if q.Now > 0 {
+			now = time.Unix(0, q.Now)
+		}
+		for _, c := range s.compaction {
+			where, args := supersededWhere(c, now.Add(-c.Horizon).UnixNano(), q.Until)
+			db = db.Where("NOT "+where, args...)
+		}
+	}
+
+	return &Cursor{
+		ctx: ctx,
+		db:  db,
+		q:   q,
+		pos: q.After,
+	}
+}
+
+// Next 移動到下一筆, 沒有資料/發生錯誤/ctx 結束時回傳 false
+func (c *Cursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	if err := c.ctx.Err(); err != nil {
+		c.err = err
+		return false
+	}
+
+	if c.i >= len(c.page) {
+		if c.done || !c.fetch() {
+			return false
+		}
+	}
+
+	c.ev = c.page[c.i]
+	c.i++
+	c.pos = Position{ReceivedAt: c.ev.ReceivedAt, Seq: c.ev.Seq}
+
+	return true
+}
+
+func (c *Cursor) fetch() bool {
+	db := c.db
+	if !c.pos.IsZero() {
+		db = db.Where("received_at > ? OR (received_at = ? AND seq > ?)", c.pos.ReceivedAt, c.pos.ReceivedAt, c.pos.Seq)
+	}
+
+	var list []*Event
+	if err := db.Order("received_at ASC, seq ASC").Limit(c.q.PageSize).Find(&list).Error; err != nil {
+		c.err = err
+		return false
+	}
+
+	c.page = list
+	c.i = 0
+	if len(list) < c.q.PageSize {
+		c.done = true
+	}
+
+	return len(list) > 0
+}
+
+// Event 目前游標所在的事件
+func (c *Cursor) Event() *Event {
+	return c.ev
+}
+
+// Position 目前游標位置, 可以放進 Query.After 接續讀取
+func (c *Cursor) Position() Position {
+	return c.pos
+}
+
+// Err 回傳中斷原因, 正常讀完時為 nil
+func (c *Cursor) Err() error {
+	return c.err
+}
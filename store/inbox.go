@@ -0,0 +1,62 @@
+package store
+
+import "time"
+
+const defaultInboxSize = 1000
+
+// Inbox 目標 app 離線時暫存的指定傳送事件
+type Inbox struct {
+	ID         int64  `gorm:"column:id;primary_key;AUTO_INCREMENT"`
+	App        string `gorm:"column:app;index;size:40"`
+	Name       string `gorm:"column:name;size:30"`
+	Raw        string `gorm:"column:raw;type:longtext"`
+	ReceivedAt int64  `gorm:"column:received_at"`
+	ExpiresAt  int64  `gorm:"column:expires_at;index"`
+}
+
+// TableName ...
+func (Inbox) TableName() string {
+	return "inbox"
+}
+
+// AddInbox 存入 app 的收件匣, 超過上限時刪除最舊的
+func (s *Store) AddInbox(app string, e *Event) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	expiresAt := time.Unix(0, e.ReceivedAt).Add(s.inboxTTL).UnixNano()
+	if e.ExpiresAt > 0 && e.ExpiresAt < expiresAt {
+		expiresAt = e.ExpiresAt
+	}
+
+	if err := s.inbox.Create(&Inbox{
+		App:        app,
+		Name:       e.Name,
+		Raw:        e.Raw,
+		ReceivedAt: e.ReceivedAt,
+		ExpiresAt:  expiresAt,
+	}).Error; err != nil {
+		return err
+	}
+
+	return s.inbox.Exec(`DELETE FROM inbox WHERE id IN (
+		SELECT id FROM inbox WHERE app = ? ORDER BY id DESC LIMIT -1 OFFSET ?)`, app, s.inboxSize).Error
+}
+
+// GetInbox 依收到順序取出 app 未過期的事件
+func (s *Store) GetInbox(app string, t time.Time) ([]*Inbox, error) {
+	var list []*Inbox
+	err := s.inbox.Where("app = ? AND expires_at > ?", app, t.UnixNano()).Order("id ASC").Find(&list).Error
+	return list, err
+}
+
+// DeleteInbox 移除已送達的事件
+func (s *Store) DeleteInbox(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+	return s.inbox.Where("id IN (?)", ids).Delete(Inbox{}).Error
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migration 紀錄已執行過的資料異動
+type migration struct {
+	Name      string `gorm:"column:name;primary_key;size:60"`
+	AppliedAt int64  `gorm:"column:applied_at"`
+}
+
+// TableName ...
+func (migration) TableName() string {
+	return "migrations"
+}
+
+// migrate 每個 name 只會在同一個資料庫執行一次
+// AutoMigrate 只會新增欄位, 既有資料的轉換都放在這裡
+func migrate(db *gorm.DB, name string, f func(*gorm.DB) error) error {
+
+	if err := db.AutoMigrate(migration{}).Error; err != nil {
+		return err
+	}
+
+	var cnt int
+	if err := db.Model(migration{}).Where("name = ?", name).Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return nil
+	}
+
+	tx := db.Begin()
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(&migration{Name: name, AppliedAt: time.Now().Unix()}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// migrateEvents 補齊舊資料的 seq, 讓分頁鍵值穩定
+// 並將秒轉成 unix nano
+func migrateEvents(db *gorm.DB) error {
+	if err := migrate(db, "events_seq", func(tx *gorm.DB) error {
+		return tx.Exec("UPDATE events SET seq = rowid WHERE seq IS NULL OR seq = 0").Error
+	}); err != nil {
+		return err
+	}
+
+	if err := migrate(db, "events_unix_nano", func(tx *gorm.DB) error {
+		return tx.Exec("UPDATE events SET received_at = received_at * ?", int64(time.Second)).Error
+	}); err != nil {
+		return err
+	}
+
+	// 保留規則以 prefix + 時間排序刪除
+	if err := migrate(db, "events_prefix_position_index", func(tx *gorm.DB) error {
+		return tx.Exec("CREATE INDEX IF NOT EXISTS idx_events_prefix_position ON events(prefix, received_at, seq)").Error
+	}); err != nil {
+		return err
+	}
+
+	// 壓縮時以 prefix + key 找較新的事件
+	if err := migrate(db, "events_prefix_key_index", func(tx *gorm.DB) error {
+		return tx.Exec(`CREATE INDEX IF NOT EXISTS idx_events_prefix_key ON events(prefix, "key", received_at)`).Error
+	}); err != nil {
+		return err
+	}
+
+	// 新增的過期欄位舊資料為 NULL, 統一成 0 (不過期)
+	return migrate(db, "events_expires_at", func(tx *gorm.DB) error {
+		if err := tx.Exec("UPDATE events SET expires_at = 0 WHERE expires_at IS NULL").Error; err != nil {
+			return err
+		}
+		return tx.Exec("UPDATE retained SET expires_at = 0 WHERE expires_at IS NULL").Error
+	})
+}
+
+// migrateAuth 將秒轉成 unix nano, 並把既有的登入名稱補進 apps
+func migrateAuth(db *gorm.DB) error {
+	if err := migrate(db, "auth_unix_nano", func(tx *gorm.DB) error {
+		return tx.Exec(`UPDATE auth SET
+			connected_at = connected_at * ?,
+			disconnected_at = disconnected_at * ?,
+			recover_since = recover_since * ?,
+			recover_until = recover_until * ?`,
+			int64(time.Second), int64(time.Second), int64(time.Second), int64(time.Second)).Error
+	}); err != nil {
+		return err
+	}
+	return migrate(db, "apps_from_auth", func(tx *gorm.DB) error {
+		return tx.Exec(`INSERT OR IGNORE INTO apps (name, first_auth_at)
+			SELECT name, MIN(connected_at) FROM auth WHERE name != '' GROUP BY name`).Error
+	})
+}
+
+func maxSeq(db *gorm.DB) (int64, error) {
+	var n sql.NullInt64
+	if err := db.Table(Event{}.TableName()).Select("MAX(seq)").Row().Scan(&n); err != nil {
+		return 0, err
+	}
+	return n.Int64, nil
+}
@@ -0,0 +1,56 @@
+package store
+
+// Retained 每個事件名稱最後一筆保留事件
+type Retained struct {
+	Name       string `gorm:"column:name;primary_key;size:30"`
+	Hash       string `gorm:"column:hash;size:40"`
+	Prefix     string `gorm:"column:prefix;size:15"`
+	Raw        string `gorm:"column:raw;type:longtext"`
+	ReceivedAt int64  `gorm:"column:received_at"`
+	ExpiresAt  int64  `gorm:"column:expires_at"`
+}
+
+// TableName ...
+func (Retained) TableName() string {
+	return "retained"
+}
+
+// SetRetained 以事件名稱覆蓋保留事件
+func (s *Store) SetRetained(e *Event) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	return s.retained.Save(&Retained{
+		Name:       e.Name,
+		Hash:       e.Hash,
+		Prefix:     e.Prefix,
+		Raw:        e.Raw,
+		ReceivedAt: e.ReceivedAt,
+		ExpiresAt:  e.ExpiresAt,
+	}).Error
+}
+
+// EachRetained 依名稱順序取出所有保留事件
+func (s *Store) EachRetained(f func(*Event) error) error {
+	var list []*Retained
+	if err := s.retained.Order("name ASC").Find(&list).Error; err != nil {
+		return err
+	}
+
+	for _, r := range list {
+		if err := f(&Event{
+			Hash:       r.Hash,
+			Name:       r.Name,
+			Prefix:     r.Prefix,
+			Length:     len(r.Raw),
+			Raw:        r.Raw,
+			ReceivedAt: r.ReceivedAt,
+			ExpiresAt:  r.ExpiresAt,
+			Retain:     true,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colindev/events/event"
+)
+
+// Retention 事件保留規則
+// 依序比對, 事件只套用第一個符合 Pattern 的規則
+// MaxAge 為 0 時沿用 GCDuration, 其他限制為 0 時不限制
+type Retention struct {
+	Pattern  string
+	MaxAge   time.Duration
+	MaxRows  int
+	MaxBytes int64
+}
+
+func (r Retention) String() string {
+	s := []string{}
+	if r.MaxAge > 0 {
+		s = append(s, r.MaxAge.String())
+	}
+	if r.MaxRows > 0 {
+		s = append(s, "rows="+strconv.Itoa(r.MaxRows))
+	}
+	if r.MaxBytes > 0 {
+		s = append(s, "bytes="+strconv.FormatInt(r.MaxBytes, 10))
+	}
+	return r.Pattern + "=" + strings.Join(s, ",")
+}
+
+// ParseRetention 解析保留規則
+// 格式 {pattern}={age}[,rows={n}][,bytes={n}[KB|MB|GB]];...
+// ex: audit.*=2160h;telemetry.*=1h,rows=100000,bytes=64MB
+func ParseRetention(s string) ([]Retention, error) {
+
+	list := []Retention{}
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("retention schema error: %s", rule)
+		}
+
+		r := Retention{Pattern: kv[0]}
+		for _, item := range strings.Split(kv[1], ",") {
+			var err error
+			item = strings.TrimSpace(item)
+			switch {
+			case item == "":
+			case strings.HasPrefix(item, "rows="):
+				r.MaxRows, err = strconv.Atoi(item[5:])
+			case strings.HasPrefix(item, "bytes="):
+				r.MaxBytes, err = parseBytes(item[6:])
+			case strings.HasPrefix(item, "age="):
+				r.MaxAge, err = time.ParseDuration(item[4:])
+			default:
+				r.MaxAge, err = time.ParseDuration(item)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("retention %s: %v", rule, err)
+			}
+		}
+
+		list = append(list, r)
+	}
+
+	return list, nil
+}
+
+func parseBytes(s string) (int64, error) {
+	unit := int64(1)
+	for suffix, n := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(strings.ToUpper(s), suffix) {
+			unit = n
+			s = s[:len(s)-len(suffix)]
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return n * unit, err
+}
+
+// RuleReport 單一規則的清除數量
+type RuleReport struct {
+	Pattern   string
+	Expired   int64
+	OverRows  int64
+	OverBytes int64
+}
+
+// GCReport 每次 GC 的清除結果
+type GCReport struct {
+	At        time.Time
+	Auth      int64
+	TTL       int64
+	Inbox     int64
+	Rules     []RuleReport
+	Compacted []CompactReport
+	Vacuumed  bool
+}
+
+func (r *GCReport) String() string {
+	s := []string{fmt.Sprintf("auth=%d", r.Auth), fmt.Sprintf("ttl=%d", r.TTL), fmt.Sprintf("inbox=%d", r.Inbox)}
+	for _, rr := range r.Rules {
+		s = append(s, fmt.Sprintf("%s(expired=%d rows=%d bytes=%d)", rr.Pattern, rr.Expired, rr.OverRows, rr.OverBytes))
+	}
+	for _, cr := range r.Compacted {
+		s = append(s, fmt.Sprintf("%s(compacted=%d)", cr.Pattern, cr.Deleted))
+	}
+	if r.Vacuumed {
+		s = append(s, "vacuum")
+	}
+	return r.At.Format(time.RFC3339Nano) + " " + strings.Join(s, " ")
+}
+
+// matchEvents 轉換 pattern 成 sql 條件, 語意同 event.Event.Match
+// 使用 GLOB 以保持大小寫敏感
+func matchEvents(pattern string) (string, []interface{}) {
+	glob := strings.NewReplacer("[", "[[]", "]", "[]]", "?", "[?]").Replace(pattern)
+	if prefix := event.Event(pattern).Type(); !strings.Contains(prefix, "*") {
+		return "(prefix = ? AND name GLOB ?)", []interface{}{prefix, glob}
+	}
+	return "name GLOB ?", []interface{}{glob}
+}
+
+// retentionWhere 組合第 i 條規則實際負責的事件範圍 (排除前面規則已涵蓋的)
+func retentionWhere(rules []Retention, i int) (string, []interface{}) {
+	where, args := matchEvents(rules[i].Pattern)
+	for _, r := range rules[:i] {
+		w, a := matchEvents(r.Pattern)
+		where += " AND NOT " + w
+		args = append(args, a...)
+	}
+	return where, args
+}
+
+func (s *Store) gcEvents(t time.Time, rules []Retention, i int) (rr RuleReport, err error) {
+	r := rules[i]
+	rr.Pattern = r.Pattern
+	where, args := retentionWhere(rules, i)
+
+	if r.MaxAge > 0 {
+		ret := s.events.Exec("DELETE FROM events WHERE "+where+" AND received_at < ?", append(args, t.Add(-r.MaxAge).UnixNano())...)
+		if ret.Error != nil {
+			return rr, ret.Error
+		}
+		rr.Expired = ret.RowsAffected
+	}
+
+	if r.MaxRows > 0 {
+		ret := s.events.Exec(`DELETE FROM events WHERE rowid IN (
+			SELECT rowid FROM events WHERE `+where+`
+			ORDER BY received_at DESC, seq DESC LIMIT -1 OFFSET ?)`, append(args, r.MaxRows)...)
+		if ret.Error != nil {
+			return rr, ret.Error
+		}
+		rr.OverRows = ret.RowsAffected
+	}
+
+	if r.MaxBytes > 0 {
+		ret := s.events.Exec(`DELETE FROM events WHERE rowid IN (
+			SELECT rowid FROM (
+				SELECT rowid, SUM(length) OVER (ORDER BY received_at DESC, seq DESC) AS total
+				FROM events WHERE `+where+`
+			) WHERE total > ?)`, append(args, r.MaxBytes)...)
+		if ret.Error != nil {
+			return rr, ret.Error
+		}
+		rr.OverBytes = ret.RowsAffected
+	}
+
+	return rr, nil
+}
+
+// GC 依保留規則清除資料
+func (s *Store) GC(t time.Time) (*GCReport, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	report := &GCReport{At: t}
+
+	ret := s.auth.Exec("DELETE FROM auth WHERE disconnected_at < ?", t.Add(-s.gcDuration).UnixNano())
+	if ret.Error != nil {
+		return report, ret.Error
+	}
+	report.Auth = ret.RowsAffected
+
+	// 已過期的事件直接刪除
+	ret = s.events.Exec("DELETE FROM events WHERE expires_at > 0 AND expires_at <= ?", t.UnixNano())
+	if ret.Error != nil {
+		return report, ret.Error
+	}
+	report.TTL = ret.RowsAffected
+	if err := s.retained.Exec("DELETE FROM retained WHERE expires_at > 0 AND expires_at <= ?", t.UnixNano()).Error; err != nil {
+		return report, err
+	}
+	ret = s.inbox.Exec("DELETE FROM inbox WHERE expires_at <= ?", t.UnixNano())
+	if ret.Error != nil {
+		return report, ret.Error
+	}
+	report.Inbox = ret.RowsAffected
+
+	for i := range s.retention {
+		rr, err := s.gcEvents(t, s.retention, i)
+		report.Rules = append(report.Rules, rr)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for _, c := range s.compaction {
+		cr, err := s.compact(t, c)
+		report.Compacted = append(report.Compacted, cr)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// Vacuum 釋放已刪除資料佔用的空間
+func (s *Store) Vacuum() error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	if err := s.auth.Exec("VACUUM").Error; err != nil {
+		return err
+	}
+	return s.events.Exec("VACUUM").Error
+}
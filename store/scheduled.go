@@ -0,0 +1,53 @@
+package store
+
+import "database/sql"
+
+// Scheduled 等待送出的排程事件
+type Scheduled struct {
+	ID    int64 `gorm:"column:id;primary_key;AUTO_INCREMENT"`
+	DueAt int64 `gorm:"column:due_at;index"`
+	// 空字串為廣播
+	Target string `gorm:"column:target;size:40"`
+	Name   string `gorm:"column:name;size:30"`
+	// name:data 同 Event.Raw
+	Raw       string `gorm:"column:raw;type:longtext"`
+	Key       string `gorm:"column:key;size:100"`
+	Retain    bool   `gorm:"column:retain"`
+	TTL       int64  `gorm:"column:ttl"`
+	CreatedAt int64  `gorm:"column:created_at"`
+}
+
+// TableName ...
+func (Scheduled) TableName() string {
+	return "scheduled"
+}
+
+// AddScheduled 新增排程事件
+func (s *Store) AddScheduled(sc *Scheduled) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	return s.scheduled.Create(sc).Error
+}
+
+// DueScheduled 取出 t (unix nano) 之前到期的排程事件
+func (s *Store) DueScheduled(t int64) ([]*Scheduled, error) {
+	var list []*Scheduled
+	err := s.scheduled.Where("due_at <= ?", t).Order("due_at ASC, id ASC").Find(&list).Error
+	return list, err
+}
+
+// NextScheduled 最近一筆排程的到期時間, 沒有排程時回傳 0
+func (s *Store) NextScheduled() (int64, error) {
+	var n sql.NullInt64
+	if err := s.scheduled.Select("MIN(due_at)").Row().Scan(&n); err != nil {
+		return 0, err
+	}
+	return n.Int64, nil
+}
+
+// DeleteScheduled 移除已送出的排程事件
+func (s *Store) DeleteScheduled(id int64) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	return s.scheduled.Where("id = ?", id).Delete(Scheduled{}).Error
+}
@@ -1,8 +1,11 @@
 package store
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -17,17 +20,43 @@ type Config struct {
 	MaxIdleConns int
 	MaxOpenConns int
 	Debug        bool
-	GCDuration   string
+	// 登入紀錄保留時間, 也是未符合 Retention 規則的事件保留時間
+	GCDuration string
+	// 依事件名稱各自設定的保留規則, 順序即優先順序
+	Retention []Retention
+	// 帶 key 事件的壓縮規則
+	Compaction []Compaction
+	// 離線收件匣每個 app 最多筆數, 0 使用預設值
+	InboxSize int
+	// 離線收件匣保留時間, 空字串沿用 GCDuration
+	InboxTTL string
+	// 定期 GC 間隔, 空字串取 GCDuration / InboxTTL / 各規則保留時間 / 壓縮範圍中最短的 (不小於 1 秒)
+	GCInterval string
+	// 定期 VACUUM 間隔, 空字串不執行
+	VacuumDuration string
+	// 每次 GC 完成後回報
+	OnGC func(*GCReport)
 }
 
 // Store 包含 登入者 跟 事件
 type Store struct {
-	wg     *sync.WaitGroup
-	tk     *time.Ticker
-	auth   *gorm.DB
-	events *gorm.DB
-	Events chan *Event
-	quit   chan struct{}
+	// 最後配發的事件序號
+	seq        int64
+	gcDuration time.Duration
+	retention  []Retention
+	compaction []Compaction
+	inboxSize  int
+	inboxTTL   time.Duration
+	wg         *sync.WaitGroup
+	tk         *time.Ticker
+	auth       *gorm.DB
+	apps       *gorm.DB
+	events     *gorm.DB
+	retained   *gorm.DB
+	scheduled  *gorm.DB
+	inbox      *gorm.DB
+	Events     chan *Event
+	quit       chan struct{}
 }
 
 // New return Store instance
@@ -38,6 +67,37 @@ func New(c Config) (*Store, error) {
 		return nil, err
 	}
 
+	inboxTTL := gcDuration
+	if c.InboxTTL != "" {
+		inboxTTL, err = time.ParseDuration(c.InboxTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	inboxSize := c.InboxSize
+	if inboxSize <= 0 {
+		inboxSize = defaultInboxSize
+	}
+
+	var gcInterval time.Duration
+	if c.GCInterval != "" {
+		gcInterval, err = time.ParseDuration(c.GCInterval)
+		if err != nil {
+			return nil, err
+		}
+		if gcInterval <= 0 {
+			return nil, fmt.Errorf("gc interval error: %s", c.GCInterval)
+		}
+	}
+
+	var vacuumDuration time.Duration
+	if c.VacuumDuration != "" {
+		vacuumDuration, err = time.ParseDuration(c.VacuumDuration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	auth, err := gorm.Open("sqlite3", c.AuthDSN)
 	if err != nil {
 		return nil, err
@@ -52,8 +112,18 @@ func New(c Config) (*Store, error) {
 		auth = auth.Debug()
 		events = events.Debug()
 	}
-	auth.AutoMigrate(Auth{})
-	events.AutoMigrate(Event{})
+	auth.AutoMigrate(Auth{}, App{})
+	events.AutoMigrate(Event{}, Retained{}, Scheduled{}, Inbox{})
+	if err := migrateAuth(auth); err != nil {
+		return nil, err
+	}
+	if err := migrateEvents(events); err != nil {
+		return nil, err
+	}
+	seq, err := maxSeq(events)
+	if err != nil {
+		return nil, err
+	}
 
 	if c.MaxIdleConns > 0 {
 		auth.DB().SetMaxIdleConns(c.MaxIdleConns)
@@ -64,14 +134,36 @@ func New(c Config) (*Store, error) {
 		events.DB().SetMaxOpenConns(c.MaxOpenConns)
 	}
 
+	// 沒有設定保留時間的規則, 以及沒有符合任何規則的事件依照 GCDuration 清除
+	retention := append(append([]Retention{}, c.Retention...), Retention{Pattern: "*"})
+	for i := range retention {
+		if retention[i].MaxAge <= 0 {
+			retention[i].MaxAge = gcDuration
+		}
+	}
+
+	if gcInterval == 0 {
+		gcInterval = minGCInterval(gcDuration, inboxTTL, retention, c.Compaction)
+	}
+
 	eventChan := make(chan *Event, 100)
 	store := &Store{
-		wg:     &sync.WaitGroup{},
-		auth:   auth.Model(Auth{}),
-		events: events.Model(Event{}),
-		Events: eventChan,
-		quit:   make(chan struct{}),
-		tk:     time.NewTicker(gcDuration),
+		seq:        seq,
+		gcDuration: gcDuration,
+		retention:  retention,
+		compaction: append([]Compaction{}, c.Compaction...),
+		inboxSize:  inboxSize,
+		inboxTTL:   inboxTTL,
+		wg:         &sync.WaitGroup{},
+		auth:       auth.Model(Auth{}),
+		apps:       auth.Model(App{}),
+		events:     events.Model(Event{}),
+		retained:   events.Model(Retained{}),
+		scheduled:  events.Model(Scheduled{}),
+		inbox:      events.Model(Inbox{}),
+		Events:     eventChan,
+		quit:       make(chan struct{}),
+		tk:         time.NewTicker(gcInterval),
 	}
 
 	store.wg.Add(2)
@@ -87,16 +179,24 @@ func New(c Config) (*Store, error) {
 	// GC
 	go func() {
 		defer store.wg.Done()
+		lastVacuum := time.Now()
 		for {
 			select {
 			case t := <-store.tk.C:
-				until := t.Add(-gcDuration)
-				timestamp := until.Unix()
-
-				log.Printf("[store]: run gc until %s (%d)\n", until, timestamp)
-
-				auth.Delete(Auth{}, "disconnected_at < ?", timestamp)
-				events.Delete(Event{}, "received_at < ?", timestamp)
+				report, err := store.GC(t)
+				if err == nil && vacuumDuration > 0 && t.Sub(lastVacuum) >= vacuumDuration {
+					lastVacuum = t
+					if err = store.Vacuum(); err == nil {
+						report.Vacuumed = true
+					}
+				}
+				if err != nil {
+					log.Println("[store]: gc fail:", err)
+				}
+				log.Printf("[store]: gc %s\n", report)
+				if c.OnGC != nil {
+					c.OnGC(report)
+				}
 			case <-store.quit:
 				return
 			}
@@ -106,6 +206,35 @@ func New(c Config) (*Store, error) {
 	return store, nil
 }
 
+// GC 間隔的下限, 避免過短的規則讓 GC 不停執行
+const gcIntervalFloor = time.Second
+
+// minGCInterval 取各項保留時間中最短的, 讓短的規則不必等到 GCDuration 才生效
+func minGCInterval(gcDuration, inboxTTL time.Duration, retention []Retention, compaction []Compaction) time.Duration {
+	d := gcDuration
+	min := func(v time.Duration) {
+		if v > 0 && v < d {
+			d = v
+		}
+	}
+	min(inboxTTL)
+	for _, r := range retention {
+		min(r.MaxAge)
+	}
+	for _, c := range compaction {
+		min(c.Horizon)
+	}
+	if d < gcIntervalFloor {
+		d = gcIntervalFloor
+	}
+	return d
+}
+
+// Backlog 等待寫入的事件數
+func (s *Store) Backlog() int {
+	return len(s.Events)
+}
+
 // Close db conn
 func (s *Store) Close() {
 	close(s.Events)
@@ -137,11 +266,24 @@ func (s *Store) GetLast(name string) (*Auth, error) {
 	return &auth, nil
 }
 
-// NewAuth insert auth record
+// HasAuth 是否曾經登入過, 以 apps 判斷, 登入紀錄被 GC 清除後仍然成立
+func (s *Store) HasAuth(name string) (bool, error) {
+	var cnt int
+	err := s.apps.Where("name = ?", name).Count(&cnt).Error
+	return cnt > 0, err
+}
+
+// NewAuth insert auth record, 有名稱時同時記錄到 apps
 func (s *Store) NewAuth(auth *Auth) error {
 	s.wg.Add(1)
 	defer s.wg.Done()
-	return s.auth.Create(auth).Error
+	if err := s.auth.Create(auth).Error; err != nil {
+		return err
+	}
+	if auth.Name == "" {
+		return nil
+	}
+	return s.apps.Exec("INSERT OR IGNORE INTO apps (name, first_auth_at) VALUES (?, ?)", auth.Name, auth.ConnectedAt).Error
 }
 
 // UpdateAuth record
@@ -178,24 +320,34 @@ func (s *Store) EachAuth(f func(*Auth) bool, name string) error {
 	}
 }
 
+// NextSeq 配發寫入順序, 存入前先配發可讓即時送出的事件帶有同樣的 Seq
+func (s *Store) NextSeq() int64 {
+	return atomic.AddInt64(&s.seq, 1)
+}
+
 func (s *Store) newEvent(ev *Event) error {
+	if ev.Seq == 0 {
+		ev.Seq = atomic.AddInt64(&s.seq, 1)
+	}
 	return s.events.Create(ev).Error
 }
 
 // EachEvents callback
 func (s *Store) EachEvents(f func(*Event) error, prefix []string, since, until int64) error {
+	return s.EachEventsContext(context.Background(), f, prefix, since, until)
+}
 
-	offset := 0
-	limit := 100
-
-	db := s.events.Where("received_at >= ?", since).Limit(limit).Order("received_at ASC")
-	if len(prefix) > 0 {
-		db = db.Where("prefix IN (?)", prefix)
-	}
+// EachEventsContext 同 EachEvents, ctx 結束時停止並回傳 ctx.Err()
+func (s *Store) EachEventsContext(ctx context.Context, f func(*Event) error, prefix []string, since, until int64) error {
+	return s.Each(ctx, Query{
+		Prefix: prefix,
+		Since:  since,
+		Until:  until,
+	}, f)
+}
 
-	if until > 0 {
-		db = db.Where("received_at <= ?", until)
-	}
+// Each 依查詢條件逐筆處理事件
+func (s *Store) Each(ctx context.Context, q Query, f func(*Event) error) error {
 
 	defer func() {
 		if v := recover(); v != nil {
@@ -203,30 +355,18 @@ func (s *Store) EachEvents(f func(*Event) error, prefix []string, since, until i
 		}
 	}()
 
-	var err error
-	for {
-		var list []*Event
-		ret := db.Offset(offset).Find(&list)
-		if ret.Error != nil {
-			return ret.Error
-		}
-
-		for _, ev := range list {
-			if err = f(ev); err != nil {
-				return err
-			}
-		}
-
-		if len(list) < limit {
-			break
+	cur := s.Cursor(ctx, q)
+	for cur.Next() {
+		if err := f(cur.Event()); err != nil {
+			return err
 		}
-		offset += limit
 	}
 
-	return err
+	return cur.Err()
 }
 
 // Auth table struct
+// 時間欄位皆為 unix nano
 type Auth struct {
 	Name           string `gorm:"column:name;index;size:40"`
 	IP             string `gorm:"column:ip;size:30"`
@@ -241,7 +381,20 @@ func (Auth) TableName() string {
 	return "auth"
 }
 
+// App 曾經登入過的名稱, GC 不清除
+// 指定傳送依此判斷離線的目標是否存入收件匣
+type App struct {
+	Name        string `gorm:"column:name;primary_key;size:40"`
+	FirstAuthAt int64  `gorm:"column:first_auth_at"`
+}
+
+// TableName ...
+func (App) TableName() string {
+	return "apps"
+}
+
 // Event table struct
+// ReceivedAt 為 unix nano
 type Event struct {
 	// hash(name:json)
 	Hash string `gorm:"column:hash;primary_key;size:40"`
@@ -250,10 +403,23 @@ type Event struct {
 	Prefix     string `gorm:"column:prefix;index;size:15"`
 	Length     int    `gorm:"column:length"`
 	Raw        string `gorm:"column:raw;type:longtext"`
-	ReceivedAt int64  `gorm:"column:received_at"`
+	ReceivedAt int64  `gorm:"column:received_at;index:idx_events_position"`
+	// 寫入順序, 與 received_at 組成分頁鍵值
+	Seq int64 `gorm:"column:seq;index:idx_events_position"`
+	// 壓縮識別鍵, 同 key 只保留最新一筆
+	Key string `gorm:"column:key;size:100"`
+	// 過期時間 (unix nano), 0 表示不會過期
+	ExpiresAt int64 `gorm:"column:expires_at;index"`
+	// 保留事件 (不存入 events 資料表), 送給 Meta 連線時帶上 retain
+	Retain bool `gorm:"-"`
 }
 
 // TableName ...
 func (Event) TableName() string {
 	return "events"
 }
+
+// Expired 在 t 時是否已過期
+func (e *Event) Expired(t time.Time) bool {
+	return e.ExpiresAt > 0 && e.ExpiresAt <= t.UnixNano()
+}
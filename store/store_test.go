@@ -1,8 +1,16 @@
 package store
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
 func TestAuth(t *testing.T) {
@@ -115,3 +123,521 @@ func TestEvent(t *testing.T) {
 
 	s.Close()
 }
+
+func TestCursor(t *testing.T) {
+
+	s, err := New(Config{
+		AuthDSN:    "file::memory:?cache=shared",
+		EventDSN:   "file::memory:?cache=shared",
+		GCDuration: "1m",
+	})
+	if err != nil {
+		t.Error(err)
+		t.Skip()
+	}
+	defer s.Close()
+
+	// 同一秒內的資料超過一頁, 只靠 received_at 會分頁錯誤
+	hashes := []string{"c1", "c2", "c3", "c4", "c5", "c6", "c7"}
+	for _, h := range hashes {
+		if err := s.newEvent(&Event{Hash: h, Prefix: "cursor", ReceivedAt: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := []string{}
+	cur := s.Cursor(context.Background(), Query{Prefix: []string{"cursor"}, PageSize: 2})
+	for cur.Next() {
+		seen = append(seen, cur.Event().Hash)
+		// 讀取中途刪除已讀過的資料不影響後續分頁
+		if len(seen) == 3 {
+			s.events.Delete(Event{}, "hash IN (?)", seen)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		t.Error(err)
+	}
+	if fmt.Sprint(seen) != fmt.Sprint(hashes) {
+		t.Errorf("expect %v, but %v", hashes, seen)
+	}
+
+	for _, e := range []*Event{
+		{Hash: "n1", Name: "query.a.x", Prefix: "query", ReceivedAt: 200},
+		{Hash: "n2", Name: "query.b", Prefix: "query", ReceivedAt: 201},
+		{Hash: "n3", Name: "other.a", Prefix: "other", ReceivedAt: 202},
+	} {
+		if err := s.newEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen = []string{}
+	cur = s.Cursor(context.Background(), Query{Names: []string{"query.a.*", "*.b"}, Since: 200})
+	for cur.Next() {
+		seen = append(seen, cur.Event().Hash)
+	}
+	if fmt.Sprint(seen) != "[n1 n2]" {
+		t.Error("query names error", seen)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cur = s.Cursor(ctx, Query{Prefix: []string{"cursor"}})
+	if cur.Next() {
+		t.Error("canceled cursor must stop")
+	}
+	if cur.Err() != context.Canceled {
+		t.Error("expect context.Canceled, but", cur.Err())
+	}
+}
+
+func TestMigrate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "events.db")
+
+	// 舊版資料表: 沒有 seq, 時間為秒
+	db, err := gorm.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("CREATE TABLE events (hash varchar(40) PRIMARY KEY, name varchar(30), prefix varchar(15), length integer, raw longtext, received_at bigint)")
+	db.Exec("CREATE TABLE auth (name varchar(40), ip varchar(30), connected_at bigint, disconnected_at bigint, recover_since bigint, recover_until bigint)")
+	db.Exec("INSERT INTO events (hash, prefix, received_at) VALUES ('old1', 'old', 1484027821), ('old2', 'old', 1484027822)")
+	db.Exec("INSERT INTO auth (name, connected_at, disconnected_at) VALUES ('game', 1484027800, 1484027900)")
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		// 第二次開啟不可重複轉換
+		s, err := New(Config{AuthDSN: dsn, EventDSN: dsn, GCDuration: "1m"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list := []*Event{}
+		s.EachEvents(func(ev *Event) error {
+			list = append(list, ev)
+			return nil
+		}, []string{"old"}, 0, 0)
+		if len(list) != 2 || list[0].ReceivedAt != 1484027821e9 || list[0].Seq == 0 || list[1].Seq <= list[0].Seq {
+			t.Errorf("(%d) migrate events fail: %+v %+v", i, list[0], list[1])
+		}
+
+		a, err := s.GetLast("game")
+		if err != nil {
+			t.Error(err)
+		} else if a.ConnectedAt != 1484027800e9 || a.DisconnectedAt != 1484027900e9 {
+			t.Errorf("(%d) migrate auth fail: %+v", i, a)
+		}
+		if known, _ := s.HasAuth("game"); !known {
+			t.Errorf("(%d) migrate apps fail", i)
+		}
+
+		// 新資料的序號接續舊資料
+		ev := &Event{Hash: fmt.Sprintf("new%d", i), Prefix: "new"}
+		s.newEvent(ev)
+		if ev.Seq <= list[len(list)-1].Seq {
+			t.Errorf("(%d) seq must continue: %d", i, ev.Seq)
+		}
+		s.Close()
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	rules, err := ParseRetention("audit.*=2160h; telemetry.*=1h,rows=100,bytes=2KB;x=rows=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Retention{
+		{Pattern: "audit.*", MaxAge: 2160 * time.Hour},
+		{Pattern: "telemetry.*", MaxAge: time.Hour, MaxRows: 100, MaxBytes: 2048},
+		{Pattern: "x", MaxRows: 3},
+	}
+	if fmt.Sprint(rules) != fmt.Sprint(expect) {
+		t.Errorf("expect %v, but %v", expect, rules)
+	}
+
+	for _, s := range []string{"audit.*", "=1h", "a=1x", "a=rows=x"} {
+		if _, err := ParseRetention(s); err == nil {
+			t.Errorf("ParseRetention(%s) must fail", s)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+
+	s, err := New(Config{
+		AuthDSN:    "file:gc?mode=memory&cache=shared",
+		EventDSN:   "file:gc?mode=memory&cache=shared",
+		GCDuration: "1h",
+		Retention: []Retention{
+			{Pattern: "audit.*", MaxAge: 90 * 24 * time.Hour},
+			{Pattern: "telemetry.*", MaxAge: time.Minute, MaxRows: 3},
+			{Pattern: "big.*", MaxBytes: 25},
+			// 沒有設定保留時間時沿用 GCDuration
+			{Pattern: "rows.*", MaxRows: 10},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	add := func(hash, name string, age time.Duration, length int) {
+		ev := &Event{Hash: hash, Name: name, Prefix: strings.SplitN(name, ".", 2)[0], Length: length, ReceivedAt: now.Add(-age).UnixNano()}
+		if err := s.newEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("audit-old", "audit.login", 30*24*time.Hour, 1)
+	add("other-old", "other.x", 2*time.Hour, 1)
+	add("other-new", "other.x", time.Second, 1)
+	// 大小寫不同不套用 audit 規則
+	add("AUDIT-old", "Audit.login", 2*time.Hour, 1)
+	for i := 0; i < 5; i++ {
+		add(fmt.Sprintf("telemetry-%d", i), "telemetry.cpu", time.Duration(5-i)*time.Second, 1)
+	}
+	add("telemetry-old", "telemetry.cpu", time.Hour, 1)
+	for i := 0; i < 4; i++ {
+		add(fmt.Sprintf("big-%d", i), "big.blob", time.Duration(4-i)*time.Second, 10)
+	}
+	add("rows-old", "rows.x", 2*time.Hour, 1)
+	add("rows-new", "rows.x", time.Second, 1)
+
+	report, err := s.GC(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(report)
+
+	left := map[string]bool{}
+	s.EachEvents(func(ev *Event) error {
+		left[ev.Hash] = true
+		return nil
+	}, nil, 0, 0)
+
+	for _, h := range []string{"audit-old", "other-new", "telemetry-2", "telemetry-3", "telemetry-4", "big-2", "big-3", "rows-new"} {
+		if !left[h] {
+			t.Errorf("%s must be kept", h)
+		}
+	}
+	for _, h := range []string{"other-old", "AUDIT-old", "telemetry-0", "telemetry-1", "telemetry-old", "big-0", "big-1", "rows-old"} {
+		if left[h] {
+			t.Errorf("%s must be deleted", h)
+		}
+	}
+
+	expect := []RuleReport{
+		{Pattern: "audit.*"},
+		{Pattern: "telemetry.*", Expired: 1, OverRows: 2},
+		{Pattern: "big.*", OverBytes: 2},
+		{Pattern: "rows.*", Expired: 1},
+		{Pattern: "*", Expired: 2},
+	}
+	if fmt.Sprint(report.Rules) != fmt.Sprint(expect) {
+		t.Errorf("report expect %v, but %v", expect, report.Rules)
+	}
+}
+
+func TestGC_interval(t *testing.T) {
+
+	reports := make(chan *GCReport, 10)
+	s, err := New(Config{
+		AuthDSN:    "file:gcinterval?mode=memory&cache=shared",
+		EventDSN:   "file:gcinterval?mode=memory&cache=shared",
+		GCDuration: "1h",
+		Retention: []Retention{
+			{Pattern: "short.*", MaxAge: time.Second},
+		},
+		OnGC: func(r *GCReport) {
+			select {
+			case reports <- r:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ev := &Event{Hash: "short-old", Name: "short.x", Prefix: "short", ReceivedAt: time.Now().Add(-time.Minute).UnixNano()}
+	if err := s.newEvent(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	// 依最短的規則定期 GC, 不必等到 GCDuration
+	select {
+	case r := <-reports:
+		if len(r.Rules) == 0 || r.Rules[0].Expired != 1 {
+			t.Error("short rule must be applied", r)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("gc must run at the shortest rule age")
+	}
+
+	if d := minGCInterval(time.Hour, 10*time.Minute, nil, []Compaction{{Pattern: "x.*", Horizon: time.Minute}}); d != time.Minute {
+		t.Error("expect 1m, but", d)
+	}
+	if d := minGCInterval(time.Hour, time.Hour, []Retention{{Pattern: "x.*", MaxAge: time.Millisecond}}, nil); d != gcIntervalFloor {
+		t.Error("gc interval must not be less than floor, but", d)
+	}
+}
+
+func TestGC_apps(t *testing.T) {
+
+	s, err := New(Config{
+		AuthDSN:    "file:gcapps?mode=memory&cache=shared",
+		EventDSN:   "file:gcapps?mode=memory&cache=shared",
+		GCDuration: "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour).UnixNano()
+	s.NewAuth(&Auth{Name: "worker", ConnectedAt: old, DisconnectedAt: old})
+	s.NewAuth(&Auth{ConnectedAt: old, DisconnectedAt: old})
+
+	report, err := s.GC(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Auth != 2 {
+		t.Error("gc auth report error:", report)
+	}
+	// 登入紀錄清除後仍視為曾經登入過
+	if known, err := s.HasAuth("worker"); !known || err != nil {
+		t.Error("app must be kept after gc", known, err)
+	}
+	if known, _ := s.HasAuth(""); known {
+		t.Error("anonymous auth must not be recorded")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+
+	list, err := ParseCompaction("user.profile.*=1h; config.*=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(list) != "[user.profile.*=1h0m0s config.*=10m0s]" {
+		t.Error("parse compaction error:", list)
+	}
+	if _, err := ParseCompaction("user.*"); err == nil {
+		t.Error("parse compaction must fail")
+	}
+
+	s, err := New(Config{
+		AuthDSN:    "file:compaction?mode=memory&cache=shared",
+		EventDSN:   "file:compaction?mode=memory&cache=shared",
+		GCDuration: "24h",
+		Compaction: []Compaction{{Pattern: "user.profile.*", Horizon: time.Hour}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	add := func(hash, name, key string, age time.Duration) {
+		ev := &Event{Hash: hash, Name: name, Prefix: strings.SplitN(name, ".", 2)[0], Key: key, ReceivedAt: now.Add(-age).UnixNano()}
+		if err := s.newEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("u1-a", "user.profile.updated", "u1", 3*time.Hour)
+	add("u1-b", "user.profile.updated", "u1", 2*time.Hour)
+	add("u1-c", "user.profile.updated", "u1", time.Minute)
+	add("u1-d", "user.profile.updated", "u1", time.Second)
+	add("u2-a", "user.profile.updated", "u2", 3*time.Hour)
+	// 沒有 key 或不符合規則的事件不壓縮
+	add("nokey", "user.profile.updated", "", 3*time.Hour)
+	add("login", "user.login", "u1", 3*time.Hour)
+
+	collect := func(q Query) []string {
+		var hashes []string
+		if err := s.Each(context.Background(), q, func(ev *Event) error {
+			hashes = append(hashes, ev.Hash)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return hashes
+	}
+
+	if v := collect(Query{Compact: true}); fmt.Sprint(v) != "[u2-a nokey login u1-c u1-d]" {
+		t.Error("compact cursor error:", v)
+	}
+	// until 之後的事件不能取代舊事件
+	if v := collect(Query{Compact: true, Until: now.Add(-90 * time.Minute).UnixNano()}); fmt.Sprint(v) != "[u2-a nokey login u1-b]" {
+		t.Error("compact cursor with until error:", v)
+	}
+	// 以 Now 計算 horizon
+	if v := collect(Query{Compact: true, Now: now.Add(-150 * time.Minute).UnixNano()}); len(v) != 7 {
+		t.Error("compact cursor with now error:", v)
+	}
+	if v := collect(Query{}); len(v) != 7 {
+		t.Error("cursor without compact must return all events:", v)
+	}
+
+	report, err := s.GC(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Compacted) != "[{user.profile.* 2}]" {
+		t.Error("compaction report error:", report.Compacted)
+	}
+	if v := collect(Query{}); fmt.Sprint(v) != "[u2-a nokey login u1-c u1-d]" {
+		t.Error("gc compaction error:", v)
+	}
+}
+
+func TestRetained(t *testing.T) {
+
+	s, err := New(Config{
+		AuthDSN:    "file:retained?mode=memory&cache=shared",
+		EventDSN:   "file:retained?mode=memory&cache=shared",
+		GCDuration: "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i, name := range []string{"config.b", "config.a", "config.b"} {
+		if err := s.SetRetained(&Event{Hash: fmt.Sprint(i), Name: name, Prefix: "config", Raw: fmt.Sprintf("%s:%d", name, i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := []string{}
+	s.EachRetained(func(e *Event) error {
+		list = append(list, e.Raw)
+		return nil
+	})
+	if fmt.Sprint(list) != "[config.a:1 config.b:2]" {
+		t.Error("retained error:", list)
+	}
+}
+
+func TestTTL(t *testing.T) {
+
+	s, err := New(Config{
+		AuthDSN:    "file:ttl?mode=memory&cache=shared",
+		EventDSN:   "file:ttl?mode=memory&cache=shared",
+		GCDuration: "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	for _, ev := range []*Event{
+		{Hash: "forever", Name: "quote.a", Prefix: "quote", ReceivedAt: now.Add(-time.Minute).UnixNano()},
+		{Hash: "expired", Name: "quote.a", Prefix: "quote", ReceivedAt: now.Add(-time.Minute).UnixNano(), ExpiresAt: now.Add(-time.Second).UnixNano()},
+		{Hash: "alive", Name: "quote.a", Prefix: "quote", ReceivedAt: now.Add(-time.Minute).UnixNano(), ExpiresAt: now.Add(time.Second).UnixNano()},
+	} {
+		if err := s.newEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetRetained(&Event{Hash: "expired", Name: "quote.a", Prefix: "quote", ExpiresAt: now.Add(-time.Second).UnixNano()})
+
+	collect := func(q Query) []string {
+		var hashes []string
+		s.Each(context.Background(), q, func(ev *Event) error {
+			hashes = append(hashes, ev.Hash)
+			return nil
+		})
+		return hashes
+	}
+
+	if v := collect(Query{Unexpired: now.UnixNano()}); fmt.Sprint(v) != "[forever alive]" {
+		t.Error("unexpired query error:", v)
+	}
+
+	report, err := s.GC(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TTL != 1 {
+		t.Error("gc ttl report error:", report)
+	}
+	if v := collect(Query{}); fmt.Sprint(v) != "[forever alive]" {
+		t.Error("gc ttl error:", v)
+	}
+	cnt := 0
+	s.EachRetained(func(*Event) error { cnt++; return nil })
+	if cnt != 0 {
+		t.Error("gc must purge expired retained event")
+	}
+}
+
+func TestInbox(t *testing.T) {
+
+	s, err := New(Config{
+		AuthDSN:    "file:inbox?mode=memory&cache=shared",
+		EventDSN:   "file:inbox?mode=memory&cache=shared",
+		GCDuration: "24h",
+		InboxSize:  2,
+		InboxTTL:   "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	add := func(app, raw string, age, ttl time.Duration) {
+		e := &Event{Name: "job.done", Raw: raw, ReceivedAt: now.Add(-age).UnixNano()}
+		if ttl > 0 {
+			e.ExpiresAt = now.Add(-age + ttl).UnixNano()
+		}
+		if err := s.AddInbox(app, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("a", "a1", 2*time.Hour, 0)
+	add("b", "b1", time.Minute, 0)
+	add("a", "a2", time.Minute, 0)
+	add("a", "a3", time.Minute, time.Second)
+	add("a", "a4", 0, 0)
+
+	list, err := s.GetInbox("a", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raws := []string{}
+	for _, in := range list {
+		raws = append(raws, in.Raw)
+	}
+	// 上限 2 筆, a3 已過期
+	if fmt.Sprint(raws) != "[a4]" {
+		t.Error("inbox error:", raws)
+	}
+
+	if err := s.DeleteInbox(list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.GC(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inbox != 1 {
+		t.Error("gc inbox report error:", report)
+	}
+	if list, _ := s.GetInbox("b", now); len(list) != 1 {
+		t.Error("inbox of other app must be kept:", list)
+	}
+}